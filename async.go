@@ -0,0 +1,144 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// SaveFuture is the pending result of SaveAsync.
+type SaveFuture struct {
+	donec chan struct{}
+	err   error
+}
+
+func newSaveFuture() *SaveFuture {
+	return &SaveFuture{donec: make(chan struct{})}
+}
+
+func (f *SaveFuture) resolve(err error) {
+	f.err = err
+	close(f.donec)
+}
+
+// Done returns a channel that is closed once the save completed.
+func (f *SaveFuture) Done() <-chan struct{} { return f.donec }
+
+// Wait waits for the save to complete and returns its result.
+func (f *SaveFuture) Wait() error {
+	<-f.donec
+	return f.err
+}
+
+// SaveAsync queues the given entries and state for saving, like Save, and
+// returns without waiting for them to be written. The returned future
+// completes once they are written and synced as the sync policy requires,
+// or with the error that prevented it; with the default SyncAlways policy,
+// they are then durable. A save with no entries that only changes the
+// commit index of the state is not synced, as the commit index can be
+// recovered from the rest of the cluster: its future completes as soon as it
+// is written, and it becomes durable with the next sync.
+// Saves are written in the order SaveAsync was called, and the queued ones
+// are committed together by a dedicated writer goroutine.
+//
+// ents must not be modified until the future completes.
+func (w *WAL) SaveAsync(st *walpb.HardState, ents []walpb.Entry) *SaveFuture {
+	f := newSaveFuture()
+	// short cut, do not call sync
+	if isEmptyHardState(st) && len(ents) == 0 {
+		f.resolve(nil)
+		return f
+	}
+	if err := w.checkEntrySizes(ents); err != nil {
+		f.resolve(err)
+		return f
+	}
+	if !w.enqueue(&saveReq{st: st, ents: ents, f: f, start: time.Now()}) {
+		f.resolve(ErrClosed)
+	}
+	return f
+}
+
+// checkEntrySizes fails with ErrMaxWALEntrySizeLimitExceeded if one of ents
+// is too large for a record, so that none of them is written.
+func (w *WAL) checkEntrySizes(ents []walpb.Entry) error {
+	if w.opts.fragmentBytes > 0 {
+		return nil
+	}
+	for i := range ents {
+		if int64(proto.Size(&ents[i]))+recordOverheadBytes >= w.opts.maxRecordBytes {
+			return ErrMaxWALEntrySizeLimitExceeded
+		}
+	}
+	return nil
+}
+
+// waitContext waits for the save of f to complete, or for ctx to be done. In
+// the latter case, the save is withdrawn and f completes with ctx.Err() if
+// the writer goroutine did not take it yet and no later save is queued after
+// it; otherwise it completes in the background, and the returned error tells
+// so.
+func (w *WAL) waitContext(ctx context.Context, f *SaveFuture) error {
+	select {
+	case <-f.Done():
+		return f.err
+	case <-ctx.Done():
+	}
+	if w.dequeue(f, ctx.Err()) {
+		return ctx.Err()
+	}
+	select {
+	case <-f.Done():
+		return f.err
+	default:
+	}
+	return &inProgressError{err: ctx.Err()}
+}
+
+// inProgressError is returned for a save given up on while it is still
+// being completed in the background. It matches ErrSaveInProgress and the
+// context error.
+type inProgressError struct {
+	err error
+}
+
+func (e *inProgressError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrSaveInProgress, e.err)
+}
+
+func (e *inProgressError) Is(target error) bool { return target == ErrSaveInProgress }
+
+func (e *inProgressError) Unwrap() error { return e.err }
+
+// DurableIndex returns the index of the last entry known to be on stable
+// storage.
+func (w *WAL) DurableIndex() uint64 {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	return w.durablei
+}
+
+// WaitDurable waits until the entry with the given index is on stable
+// storage. It returns ErrClosed if the WAL is closed before.
+func (w *WAL) WaitDurable(ctx context.Context, index uint64) error {
+	for {
+		w.dmu.Lock()
+		durable, closed, notifyc := w.durablei, w.closed, w.durablec
+		w.dmu.Unlock()
+		if durable >= index {
+			return nil
+		}
+		if closed {
+			return ErrClosed
+		}
+		select {
+		case <-notifyc:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
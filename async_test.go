@@ -0,0 +1,164 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestSaveAsync(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+
+	data := make([]byte, 100)
+	var fs []*SaveFuture
+	for i := 1; i <= 100; i++ {
+		fs = append(fs, w.SaveAsync(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Empty(t, w.WaitDurable(ctx, 100))
+	assert.Equal(t, uint64(100), w.DurableIndex())
+	for _, f := range fs {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("future not completed after WaitDurable")
+		}
+		assert.Empty(t, f.Wait())
+	}
+	w.Close()
+
+	assert.Equal(t, ErrClosed, w.SaveAsync(nil, []walpb.Entry{{Index: 101, Term: 1}}).Wait())
+	assert.Equal(t, ErrClosed, w.WaitDurable(context.Background(), 101))
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(100), state.Commit)
+	assert.Equal(t, 100, len(ents))
+	for i, ent := range ents {
+		assert.Equal(t, uint64(i+1), ent.Index)
+	}
+	assert.Equal(t, uint64(100), w.DurableIndex())
+}
+
+func TestSaveAsyncClose(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommitWindow(50*time.Millisecond))
+	assert.Empty(t, err)
+	f := w.SaveAsync(nil, []walpb.Entry{{Index: 1, Term: 1}})
+	// queued saves are committed on close
+	w.Close()
+	assert.Empty(t, f.Wait())
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(ents))
+}
+
+func TestWaitDurableContext(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.WaitDurable(ctx, 1))
+}
+
+func TestSaveAsyncNotAppendMode(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	// entries cannot be saved before all of them are read
+	assert.Equal(t, ErrNotAppendMode, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1}}))
+}
+
+func TestSaveAsyncWithdraw(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	defer w.Close()
+	save := func(i uint64) *SaveFuture {
+		return w.SaveAsync(nil, []walpb.Entry{{Index: i, Term: 1}})
+	}
+	pending := func() int {
+		w.wr.mu.Lock()
+		defer w.wr.mu.Unlock()
+		return len(w.wr.pending)
+	}
+
+	// hold the writer goroutine in the commit of the first save
+	w.mu.Lock()
+	f1 := save(1)
+	for pending() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f2, f3 := save(2), save(3)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the second save is not withdrawn, the third depends on it
+	err = w.waitContext(ctx, f2)
+	assert.True(t, errors.Is(err, ErrSaveInProgress), "%v", err)
+	assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(t, 2, pending())
+
+	// the last one is, and its future completes for every waiter
+	waitc := make(chan error, 1)
+	go func() { waitc <- f3.Wait() }()
+	err = w.waitContext(ctx, f3)
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, errors.Is(err, ErrSaveInProgress))
+	assert.Equal(t, 1, pending())
+	select {
+	case err := <-waitc:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait blocked on a withdrawn save")
+	}
+
+	w.mu.Unlock()
+	assert.Empty(t, f1.Wait())
+	assert.Empty(t, f2.Wait())
+	assert.Empty(t, w.Close())
+
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(ents))
+}
@@ -0,0 +1,470 @@
+// Command walctl inspects and maintains WAL directories.
+//
+// Usage:
+//
+//	walctl <command> [flags] <dir>
+//
+// The commands are:
+//
+//	ls         list the segments with their sequence, first index, size and fill ratio
+//	dump       print the records with their type, offset, crc and entry index and size
+//	verify     check the WAL with wal.Verify
+//	snapshots  list the snapshot records
+//	metadata   print the metadata
+//	repair     truncate a torn or corrupted tail with wal.Repair
+//
+// Every command takes -json to print one JSON object per line instead of text.
+// The commands reading records take -key-file to decrypt an encrypted WAL;
+// without it, encrypted records are only checked against the crc chain.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	wal "github.com/amazingchow/photon-dance-wal"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string, out io.Writer) error
+}
+
+var commands = []command{
+	{"ls", "list the segments with their sequence, first index, size and fill ratio", runLs},
+	{"dump", "print the records with their type, offset, crc and entry index and size", runDump},
+	{"verify", "check the WAL with wal.Verify", runVerify},
+	{"snapshots", "list the snapshot records", runSnapshots},
+	{"metadata", "print the metadata", runMetadata},
+	{"repair", "truncate a torn or corrupted tail with wal.Repair", runRepair},
+}
+
+var errUsage = errors.New("usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	if err == errUsage || err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "walctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: walctl <command> [flags] <dir>")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `run "walctl <command> -h" for the flags of a command`)
+}
+
+func run(args []string, out, errOut io.Writer) error {
+	if len(args) == 0 {
+		usage(errOut)
+		return errUsage
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet("walctl "+c.name, flag.ContinueOnError)
+		fs.SetOutput(errOut)
+		fs.Usage = func() {
+			fmt.Fprintf(errOut, "usage: walctl %s [flags] <dir>\n\n%s\n\nflags:\n", c.name, c.usage)
+			fs.PrintDefaults()
+		}
+		return c.run(fs, args[1:], out)
+	}
+	usage(errOut)
+	return errUsage
+}
+
+// parse parses the flags of a command and returns its directory argument.
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+// keyFlag adds the -key-file flag to the commands reading records. The
+// returned function gives the options to read the WAL with.
+func keyFlag(fs *flag.FlagSet) func() ([]wal.Option, error) {
+	path := fs.String("key-file", "", "decrypt the records with the keys of this file, in the format of wal.FileKeyProvider")
+	return func() ([]wal.Option, error) {
+		if *path == "" {
+			return nil, nil
+		}
+		kp, err := wal.NewFileKeyProvider(*path)
+		if err != nil {
+			return nil, err
+		}
+		return []wal.Option{wal.WithEncryption(kp)}, nil
+	}
+}
+
+// errSealed is returned for an encrypted record read without -key-file.
+func errSealed(ri wal.RecordInfo) error {
+	return fmt.Errorf("%s: record at offset %d is encrypted with key %q, use -key-file", ri.Segment, ri.Offset, ri.Record.KeyId)
+}
+
+// printer writes either aligned text rows or JSON lines.
+type printer struct {
+	json bool
+	tw   *tabwriter.Writer
+	enc  *json.Encoder
+}
+
+func newPrinter(out io.Writer, asJSON bool) *printer {
+	return &printer{
+		json: asJSON,
+		tw:   tabwriter.NewWriter(out, 0, 8, 2, ' ', 0),
+		enc:  json.NewEncoder(out),
+	}
+}
+
+// header prints the column names of the text rows.
+func (p *printer) header(columns string) {
+	if !p.json {
+		fmt.Fprintln(p.tw, columns)
+	}
+}
+
+// row prints v as JSON, or the text columns otherwise.
+func (p *printer) row(v interface{}, format string, args ...interface{}) error {
+	if p.json {
+		return p.enc.Encode(v)
+	}
+	_, err := fmt.Fprintf(p.tw, format, args...)
+	return err
+}
+
+func (p *printer) flush() error { return p.tw.Flush() }
+
+type segmentRow struct {
+	Name     string  `json:"name"`
+	Seq      uint64  `json:"seq"`
+	Index    uint64  `json:"index"`
+	Size     int64   `json:"size"`
+	Used     int64   `json:"used"`
+	Fill     float64 `json:"fill"`
+	Version  uint32  `json:"version"`            // segment format, 0 without a header
+	Features uint64  `json:"features,omitempty"` // required to read the segment
+	Writer   string  `json:"writer,omitempty"`
+}
+
+func runLs(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	segs, err := wal.Segments(dir)
+	if err != nil {
+		return err
+	}
+	p := newPrinter(out, *asJSON)
+	p.header("NAME\tSEQ\tINDEX\tSIZE\tUSED\tFILL\tVERSION\tFEATURES")
+	for _, s := range segs {
+		r := segmentRow{Name: s.Name, Seq: s.Seq, Index: s.Index, Size: s.Size, Used: s.Used}
+		if s.Size > 0 {
+			r.Fill = float64(s.Used) / float64(s.Size)
+		}
+		if h := s.Header; h != nil {
+			r.Version, r.Features, r.Writer = h.FormatVersion, h.RequiredFeatures, h.WriterVersion
+		}
+		if err = p.row(r, "%s\t%d\t%d\t%d\t%d\t%.1f%%\t%d\t%#x\n", r.Name, r.Seq, r.Index, r.Size, r.Used, 100*r.Fill, r.Version, r.Features); err != nil {
+			return err
+		}
+	}
+	return p.flush()
+}
+
+type recordRow struct {
+	Segment string  `json:"segment"`
+	Offset  int64   `json:"offset"`
+	Type    string  `json:"type"`
+	CRC     uint64  `json:"crc"`
+	Size    int     `json:"size"`            // of the data, decompressed
+	Codec   uint32  `json:"codec,omitempty"` // the data is stored compressed with
+	Key     string  `json:"key,omitempty"`   // the data is stored encrypted with
+	Index   *uint64 `json:"index,omitempty"` // entry and snapshot records
+	Term    *uint64 `json:"term,omitempty"`  // entry, state and snapshot records
+	Data    []byte  `json:"data,omitempty"`  // entry data or record data with -hex
+}
+
+// describe decodes the raft fields of a record.
+func describe(rec *walpb.Record, r *recordRow) (payload []byte, err error) {
+	switch rec.Type {
+	case walpb.RecordType_EntryType:
+		e := &walpb.Entry{}
+		if err = proto.Unmarshal(rec.Data, e); err != nil {
+			return nil, err
+		}
+		r.Index, r.Term = &e.Index, &e.Term
+		return e.Data, nil
+	case walpb.RecordType_SnapshotType:
+		s := &walpb.Snapshot{}
+		if err = proto.Unmarshal(rec.Data, s); err != nil {
+			return nil, err
+		}
+		r.Index, r.Term = &s.Index, &s.Term
+	case walpb.RecordType_StateType:
+		s := &walpb.HardState{}
+		if err = proto.Unmarshal(rec.Data, s); err != nil {
+			return nil, err
+		}
+		r.Term = &s.Term
+	case walpb.RecordType_MetadataType:
+		return rec.Data, nil
+	}
+	return nil, nil
+}
+
+func runDump(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	asHex := fs.Bool("hex", false, "print the raw record data in hex")
+	withPayload := fs.Bool("payload", false, "print the entry data and metadata")
+	keyOpts := keyFlag(fs)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOpts()
+	if err != nil {
+		return err
+	}
+
+	p := newPrinter(out, *asJSON)
+	// fixed-width columns, so that hex dumps can be interleaved
+	const format = "%-37s  %8v  %-12s  %8v  %8v  %5v  %-8s  %8s  %8s\n"
+	p.header(fmt.Sprintf(strings.TrimSuffix(format, "\n"), "SEGMENT", "OFFSET", "TYPE", "CRC", "SIZE", "CODEC", "KEY", "INDEX", "TERM"))
+	err = wal.ScanRecords(dir, func(ri wal.RecordInfo) error {
+		rec := ri.Record
+		r := recordRow{Segment: ri.Segment, Offset: ri.Offset, Type: rec.Type.String(), CRC: rec.Crc, Size: len(rec.Data), Codec: rec.Codec, Key: rec.KeyId}
+		var (
+			payload []byte
+			err     error
+		)
+		// without keys, encrypted records are left as stored
+		if opts != nil || rec.KeyId == "" {
+			if payload, err = describe(rec, &r); err != nil {
+				return err
+			}
+		}
+		switch {
+		case *asHex:
+			r.Data = rec.Data
+		case *withPayload:
+			r.Data = payload
+		}
+		index, term := "-", "-"
+		if r.Index != nil {
+			index = fmt.Sprint(*r.Index)
+		}
+		if r.Term != nil {
+			term = fmt.Sprint(*r.Term)
+		}
+		key := r.Key
+		if key == "" {
+			key = "-"
+		}
+		if err = p.row(r, format, r.Segment, r.Offset, r.Type, fmt.Sprintf("%08x", r.CRC), r.Size, r.Codec, key, index, term); err != nil {
+			return err
+		}
+		if !p.json && r.Data != nil {
+			_, err = io.WriteString(p.tw, hex.Dump(r.Data))
+		}
+		return err
+	}, opts...)
+	if ferr := p.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func runVerify(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	index := fs.Uint64("snap-index", 0, "index of the snapshot to verify from")
+	term := fs.Uint64("snap-term", 0, "term of the snapshot to verify from")
+	keyOpts := keyFlag(fs)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOpts()
+	if err != nil {
+		return err
+	}
+
+	verr := wal.Verify(dir, &walpb.Snapshot{Index: *index, Term: *term}, opts...)
+	if *asJSON {
+		r := struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error,omitempty"`
+		}{OK: verr == nil}
+		if verr != nil {
+			r.Error = verr.Error()
+		}
+		if err = json.NewEncoder(out).Encode(r); err != nil {
+			return err
+		}
+	} else if verr == nil {
+		fmt.Fprintln(out, "ok")
+	}
+	return verr
+}
+
+type snapshotRow struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Index   uint64 `json:"index"`
+	Term    uint64 `json:"term"`
+}
+
+func runSnapshots(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	keyOpts := keyFlag(fs)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOpts()
+	if err != nil {
+		return err
+	}
+
+	p := newPrinter(out, *asJSON)
+	p.header("SEGMENT\tOFFSET\tINDEX\tTERM")
+	err = wal.ScanRecords(dir, func(ri wal.RecordInfo) error {
+		if ri.Record.Type != walpb.RecordType_SnapshotType {
+			return nil
+		}
+		if opts == nil && ri.Record.KeyId != "" {
+			return errSealed(ri)
+		}
+		s := &walpb.Snapshot{}
+		if err := proto.Unmarshal(ri.Record.Data, s); err != nil {
+			return err
+		}
+		r := snapshotRow{Segment: ri.Segment, Offset: ri.Offset, Index: s.Index, Term: s.Term}
+		return p.row(r, "%s\t%d\t%d\t%d\n", r.Segment, r.Offset, r.Index, r.Term)
+	}, opts...)
+	if ferr := p.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+var errMetadataFound = errors.New("metadata found")
+
+func runMetadata(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	asHex := fs.Bool("hex", false, "print the metadata in hex")
+	keyOpts := keyFlag(fs)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	opts, err := keyOpts()
+	if err != nil {
+		return err
+	}
+
+	var metadata []byte
+	err = wal.ScanRecords(dir, func(ri wal.RecordInfo) error {
+		if ri.Record.Type != walpb.RecordType_MetadataType {
+			return nil
+		}
+		if opts == nil && ri.Record.KeyId != "" {
+			return errSealed(ri)
+		}
+		metadata = ri.Record.Data
+		return errMetadataFound
+	}, opts...)
+	if err != errMetadataFound {
+		if err == nil {
+			err = errors.New("no metadata record")
+		}
+		return err
+	}
+
+	switch {
+	case *asJSON:
+		return json.NewEncoder(out).Encode(struct {
+			Metadata []byte `json:"metadata"`
+		}{metadata})
+	case *asHex:
+		_, err = io.WriteString(out, hex.Dump(metadata))
+	default:
+		_, err = fmt.Fprintf(out, "%s\n", metadata)
+	}
+	return err
+}
+
+type repairRow struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+	Backup  string `json:"backup"`
+	Removed bool   `json:"removed"`
+	Cause   string `json:"cause"`
+	DryRun  bool   `json:"dryRun"`
+}
+
+func runRepair(fs *flag.FlagSet, args []string, out io.Writer) error {
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	dryRun := fs.Bool("dry-run", false, "only report what would be changed")
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	r, err := wal.Repair(dir, *dryRun)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		if *asJSON {
+			return json.NewEncoder(out).Encode(struct{}{})
+		}
+		_, err = fmt.Fprintln(out, "nothing to repair")
+		return err
+	}
+	row := repairRow{Segment: r.Segment, Offset: r.Offset, Size: r.Size, Backup: r.Backup, Removed: r.Removed, Cause: r.Cause.Error(), DryRun: *dryRun}
+	if *asJSON {
+		return json.NewEncoder(out).Encode(row)
+	}
+	backup, verb := "backed up", "truncated"
+	if row.Removed {
+		verb = "removed"
+	}
+	if row.DryRun {
+		backup, verb = "would be "+backup, "would be "+verb
+	}
+	_, err = fmt.Fprintf(out, "%s: %s at offset %d\n%d bytes %s to %s, segment %s\n",
+		row.Segment, row.Cause, row.Offset, row.Size-row.Offset, backup, row.Backup, verb)
+	return err
+}
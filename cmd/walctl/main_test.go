@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	wal "github.com/amazingchow/photon-dance-wal"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func createWAL(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "walctltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "wal")
+	w, err := wal.Create(p, []byte("metadata"), wal.WithSegmentSizeBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err = w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: make([]byte, 100)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.SaveSnapshot(&walpb.Snapshot{Index: 5, Term: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func runOut(t *testing.T, args ...string) (string, error) {
+	var out, errOut bytes.Buffer
+	err := run(args, &out, &errOut)
+	return out.String(), err
+}
+
+// jsonLines decodes each line of out into a new value returned by v.
+func jsonLines(t *testing.T, out string, v func() interface{}) {
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if err := json.Unmarshal([]byte(line), v()); err != nil {
+			t.Fatalf("%v: %q", err, line)
+		}
+	}
+}
+
+func TestWalctl(t *testing.T) {
+	p := createWAL(t)
+	defer os.RemoveAll(filepath.Dir(p))
+
+	out, err := runOut(t, "ls", "-json", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segs []segmentRow
+	jsonLines(t, out, func() interface{} {
+		segs = append(segs, segmentRow{})
+		return &segs[len(segs)-1]
+	})
+	if len(segs) < 2 {
+		t.Fatalf("segments = %d, want at least 2 after cuts", len(segs))
+	}
+	for i, s := range segs {
+		if s.Seq != uint64(i) || s.Used <= 0 || s.Fill <= 0 || s.Fill > 1 || s.Version != wal.FormatVersion {
+			t.Fatalf("unexpected segment %+v", s)
+		}
+	}
+
+	out, err = runOut(t, "dump", "-json", "-payload", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []recordRow
+	jsonLines(t, out, func() interface{} {
+		recs = append(recs, recordRow{})
+		return &recs[len(recs)-1]
+	})
+	var ents int
+	for _, r := range recs {
+		if r.Type == walpb.RecordType_EntryType.String() {
+			ents++
+			if r.Index == nil || *r.Index != uint64(ents) || len(r.Data) != 100 {
+				t.Fatalf("unexpected entry record %+v", r)
+			}
+		}
+	}
+	if ents != 10 {
+		t.Fatalf("entry records = %d, want 10", ents)
+	}
+
+	out, err = runOut(t, "snapshots", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+		t.Fatalf("snapshots output = %q, want a header and 2 snapshots", out)
+	}
+
+	out, err = runOut(t, "metadata", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "metadata\n" {
+		t.Fatalf("metadata = %q, want %q", out, "metadata\n")
+	}
+
+	if out, err = runOut(t, "verify", p); err != nil || out != "ok\n" {
+		t.Fatalf("verify = %q, %v", out, err)
+	}
+	out, err = runOut(t, "verify", "-json", "-snap-index", "7", p)
+	if err != wal.ErrSnapshotNotFound {
+		t.Fatalf("err = %v, want %v", err, wal.ErrSnapshotNotFound)
+	}
+	if !strings.Contains(out, `"ok":false`) {
+		t.Fatalf("verify output = %q", out)
+	}
+
+	if out, err = runOut(t, "repair", "-dry-run", p); err != nil || out != "nothing to repair\n" {
+		t.Fatalf("repair = %q, %v", out, err)
+	}
+
+	if _, err = runOut(t, "nope", p); err != errUsage {
+		t.Fatalf("err = %v, want %v", err, errUsage)
+	}
+}
+
+func TestWalctlKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "walctltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	if err = ioutil.WriteFile(keyFile, []byte("k1 "+strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := wal.NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "wal")
+	w, err := wal.Create(p, []byte("metadata"), wal.WithEncryption(kp), wal.WithMetadataEncryption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: []byte("secret")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without keys, records are dumped and verified as stored
+	out, err := runOut(t, "dump", "-json", "-payload", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, `"index"`) || !strings.Contains(out, `"key":"k1"`) {
+		t.Fatalf("dump output = %q", out)
+	}
+	if out, err = runOut(t, "verify", p); err != nil || out != "ok\n" {
+		t.Fatalf("verify = %q, %v", out, err)
+	}
+	if _, err = runOut(t, "metadata", p); err == nil {
+		t.Fatal("metadata of an encrypted WAL read without keys")
+	}
+
+	out, err = runOut(t, "metadata", "-key-file", keyFile, p)
+	if err != nil || out != "metadata\n" {
+		t.Fatalf("metadata = %q, %v", out, err)
+	}
+	out, err = runOut(t, "dump", "-json", "-key-file", keyFile, p)
+	if err != nil || !strings.Contains(out, `"index":1`) {
+		t.Fatalf("dump = %q, %v", out, err)
+	}
+}
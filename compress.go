@@ -0,0 +1,171 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// Codec compresses the data of records, see WithCompression. Its ID is stored
+// with every record it compressed, so that segments can mix codecs and a WAL
+// is read back with the codecs it was written with.
+type Codec interface {
+	// ID identifies the codec in the records. 0 marks raw data and IDs up
+	// to 15 are reserved for the built-in codecs.
+	ID() uint32
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// IDs of the built-in codecs.
+const (
+	CodecFlate uint32 = 1
+	CodecGzip  uint32 = 2
+
+	maxBuiltinCodec uint32 = 15
+)
+
+var builtinCodecs = map[uint32]Codec{
+	CodecFlate: FlateCodec(flate.DefaultCompression),
+	CodecGzip:  GzipCodec(gzip.DefaultCompression),
+}
+
+// compressor is implemented by the flate and gzip writers.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// streamCodec is a Codec on top of a stdlib compression stream. Writers are
+// pooled, they are expensive to allocate.
+type streamCodec struct {
+	id        uint32
+	newWriter func(w io.Writer) (compressor, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	pool      sync.Pool
+}
+
+// FlateCodec returns the built-in codec compressing with DEFLATE at the given
+// level of compress/flate.
+func FlateCodec(level int) Codec {
+	return &streamCodec{
+		id: CodecFlate,
+		newWriter: func(w io.Writer) (compressor, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+}
+
+// GzipCodec returns the built-in codec compressing with gzip at the given
+// level of compress/gzip.
+func GzipCodec(level int) Codec {
+	return &streamCodec{
+		id: CodecGzip,
+		newWriter: func(w io.Writer) (compressor, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+}
+
+func (c *streamCodec) ID() uint32 { return c.id }
+
+func (c *streamCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, ok := c.pool.Get().(compressor)
+	if ok {
+		zw.Reset(&buf)
+	} else {
+		var err error
+		if zw, err = c.newWriter(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	c.pool.Put(zw)
+	return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(data []byte) ([]byte, error) {
+	return c.decompressLimit(data, math.MaxInt64)
+}
+
+// decompressLimit inflates data up to maxBytes, so that a small record cannot
+// expand into an arbitrarily large allocation.
+func (c *streamCodec) decompressLimit(data []byte, maxBytes int64) ([]byte, error) {
+	zr, err := c.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(io.LimitReader(zr, maxBytes))
+}
+
+// limitedDecompressor is implemented by the codecs that can stop inflating a
+// record once it reaches the max record size.
+type limitedDecompressor interface {
+	decompressLimit(data []byte, maxBytes int64) ([]byte, error)
+}
+
+// compress replaces the data of rec with its compressed form if it is large
+// enough and compresses at all.
+func compress(c Codec, minBytes int, rec *walpb.Record) error {
+	// the header must be readable by any version
+	if c == nil || rec.Type == walpb.RecordType_CrcType || rec.Type == walpb.RecordType_HeaderType || len(rec.Data) < minBytes {
+		return nil
+	}
+	data, err := c.Compress(rec.Data)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(rec.Data) {
+		rec.Data, rec.Codec = data, c.ID()
+	}
+	return nil
+}
+
+// decompress restores the raw data of rec if it is compressed. The raw data
+// must be smaller than maxBytes.
+func decompress(codec func(id uint32) Codec, maxBytes int64, rec *walpb.Record) error {
+	if rec.Codec == 0 {
+		return nil
+	}
+	c := codec(rec.Codec)
+	if c == nil {
+		return fmt.Errorf("%w %d", ErrCodecNotFound, rec.Codec)
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if lc, ok := c.(limitedDecompressor); ok {
+		data, err = lc.decompressLimit(rec.Data, maxBytes)
+	} else {
+		data, err = c.Decompress(rec.Data)
+	}
+	if err != nil {
+		return fmt.Errorf("wal: failed to decompress record: %w", err)
+	}
+	if int64(len(data)) >= maxBytes {
+		return ErrMaxWALEntrySizeLimitExceeded
+	}
+	rec.Data = data
+	return nil
+}
@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// idCodec is a built-in codec under another ID.
+type idCodec struct {
+	Codec
+	id uint32
+}
+
+func (c idCodec) ID() uint32 { return c.id }
+
+// jsonData returns compressible entry data for revision i.
+func jsonData(i int) []byte {
+	var b bytes.Buffer
+	for j := 0; j < 20; j++ {
+		fmt.Fprintf(&b, `{"key":"/registry/pods/default/pod-%d","revision":%d,"value":"running"}`, j, i)
+	}
+	return b.Bytes()
+}
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	var want [][]byte
+	save := func(p string, opts ...Option) {
+		w, err := Create(p, []byte("metadata"), opts...)
+		assert.Empty(t, err)
+		for i := 1; i <= 20; i++ {
+			data := jsonData(i)
+			if i%5 == 0 {
+				data = []byte("small")
+			}
+			assert.Empty(t, w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}}))
+			if len(want) < 20 {
+				want = append(want, data)
+			}
+		}
+		assert.Empty(t, w.Close())
+	}
+	raw := filepath.Join(dir, "raw")
+	save(raw)
+	p := filepath.Join(dir, "wal")
+	save(p, WithCompression(GzipCodec(flate.BestSpeed), 64))
+
+	// large entries are stored compressed, small ones raw
+	err = ScanRecords(p, func(ri RecordInfo) error {
+		if ri.Record.Type == walpb.RecordType_EntryType {
+			if len(ri.Record.Data) > 64 {
+				assert.Equal(t, CodecGzip, ri.Record.Codec)
+			} else {
+				assert.Equal(t, uint32(0), ri.Record.Codec)
+			}
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	rawSegs, err := Segments(raw)
+	assert.Empty(t, err)
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, segs[0].Used*4 < rawSegs[0].Used, "compressed %d bytes, raw %d", segs[0].Used, rawSegs[0].Used)
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}))
+
+	// the built-in codecs are always known; append raw records to the same
+	// segment
+	w, err := Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, len(want), len(ents))
+	for i := range ents {
+		assert.Equal(t, want[i], ents[i].Data)
+	}
+	want = append(want, jsonData(21))
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 21, Term: 1, Data: want[20]}}))
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{}, WithCompression(FlateCodec(flate.BestCompression), 0))
+	assert.Empty(t, err)
+	_, _, ents, err = w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, len(want), len(ents))
+	assert.Equal(t, want[20], ents[20].Data)
+	assert.Empty(t, w.Close())
+}
+
+func TestCustomCodec(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	_, err = Create(p, []byte("metadata"), WithCompression(idCodec{FlateCodec(flate.BestSpeed), 3}, 0))
+	assert.NotEmpty(t, err, "IDs up to 15 are reserved")
+	c := idCodec{FlateCodec(flate.BestSpeed), 16}
+	w, err := Create(p, []byte("metadata"), WithCompression(c, 0))
+	assert.Empty(t, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: jsonData(1)}}))
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.True(t, errors.Is(err, ErrCodecNotFound), "%v", err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{}, WithCodecs(c))
+	assert.Empty(t, err)
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, jsonData(1), ents[0].Data)
+	assert.Empty(t, w.Close())
+}
+
+func TestDecompressLimit(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	// a few KB inflating to 16MB
+	data := make([]byte, 16*1024*1024)
+	w, err := Create(p, []byte("metadata"), WithMaxRecordBytes(64*1024*1024), WithCompression(GzipCodec(flate.BestCompression), 0))
+	assert.Empty(t, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: data}}))
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{}, WithMaxRecordBytes(1024*1024))
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.True(t, errors.Is(err, ErrMaxWALEntrySizeLimitExceeded), "%v", err)
+	w.Close()
+
+	// the record is not inflated past the limit
+	c := GzipCodec(flate.BestCompression)
+	z, err := c.Compress(data)
+	assert.Empty(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = decompress(func(uint32) Codec { return c }, 1024*1024, &walpb.Record{Codec: CodecGzip, Data: z})
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, ErrMaxWALEntrySizeLimitExceeded, err)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 8*1024*1024, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
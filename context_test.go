@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestContextCanceled(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 30)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := OpenContext(ctx, p, &walpb.Snapshot{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, VerifyContext(ctx, p, &walpb.Snapshot{}))
+
+	w, err := Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAllContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, w.Close())
+
+	// nothing is written once the context is done
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.Empty(t, err)
+	err = w.SaveContext(ctx, nil, []walpb.Entry{{Index: 31, Term: 1}})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, w.SaveSnapshotContext(ctx, &walpb.Snapshot{Index: 30, Term: 1}))
+	assert.Equal(t, context.Canceled, w.SyncContext(ctx))
+	assert.Empty(t, w.Close())
+
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 30, len(ents))
+	assert.Equal(t, ErrSnapshotNotFound, Verify(p, &walpb.Snapshot{Index: 30, Term: 1}))
+}
+
+func TestReplayContext(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 30)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	var n int
+	_, _, err = w.ReplayContext(ctx, func(ent *walpb.Entry) error {
+		if n++; n == 5 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 5, n)
+}
+
+func TestSaveContextWithdrawn(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	// the save waits in the queue for the group commit window
+	w, err := Create(p, []byte("metadata"), WithGroupCommitWindow(500*time.Millisecond))
+	assert.Empty(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = w.SaveContext(ctx, nil, []walpb.Entry{{Index: 1, Term: 1, Data: []byte("withdrawn")}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 2, Data: []byte("saved")}}))
+	assert.Empty(t, w.Close())
+
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(ents))
+	assert.Equal(t, []byte("saved"), ents[0].Data)
+}
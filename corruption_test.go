@@ -0,0 +1,45 @@
+package wal
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestCorruptionError(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 30)
+	defer cleanup()
+	paths, offs, _ := entryOffsets(t, p)
+	flipAt(t, paths[9], offs[9]+frameSizeBytes+100)
+
+	want := &CorruptionError{
+		Segment:    filepath.Base(paths[9]),
+		Offset:     offs[9],
+		RecordType: walpb.RecordType_EntryType,
+		LastIndex:  9,
+		Err:        walpb.ErrCRCMismatch,
+	}
+	_, err := readAllEntries(t, p)
+	var ce *CorruptionError
+	assert.True(t, errors.As(err, &ce), "%v", err)
+	assert.Equal(t, want, ce)
+	assert.True(t, errors.Is(err, walpb.ErrCRCMismatch))
+	assert.True(t, errors.Is(err, ErrCRCMismatch))
+	assert.False(t, errors.Is(err, ErrSliceOutOfRange))
+	assert.Contains(t, err.Error(), want.Segment)
+
+	err = Verify(p, &walpb.Snapshot{})
+	assert.True(t, errors.As(err, &ce), "%v", err)
+	assert.Equal(t, want, ce)
+}
+
+func TestCorruptionErrorUnknownSegment(t *testing.T) {
+	err := &CorruptionError{Offset: 8, RecordType: walpb.RecordType_CrcType, LastIndex: 3, Err: ErrCRCMismatch}
+	assert.Equal(t, "wal: corrupted CrcType record in segment at offset 8 after index 3: wal: crc mismatch", err.Error())
+	assert.True(t, errors.Is(err, walpb.ErrCRCMismatch))
+	assert.False(t, errors.Is(err, ErrFragmentSequence))
+}
@@ -0,0 +1,223 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+const crashDir = "/data/wal"
+
+func crashOptions(fs fileutil.FS) []Option {
+	return []Option{WithFS(fs), WithSegmentSizeBytes(8 * 1024), WithLogger(NopLogger())}
+}
+
+// newCrashFS returns a CrashFS driven by seed with the parent of crashDir
+// durably created.
+func newCrashFS(t *testing.T, seed int64) *fileutil.CrashFS {
+	fs := fileutil.NewCrashFS(seed)
+	assert.Empty(t, fs.MkdirAll("/data", fileutil.PrivateDirMode))
+	for _, dir := range []string{"/", "/data"} {
+		df, err := fs.OpenDir(dir)
+		assert.Empty(t, err)
+		assert.Empty(t, fs.Fsync(df))
+		df.Close()
+	}
+	return fs
+}
+
+// crashEntries returns n entries of random sizes, starting at index first.
+func crashEntries(rng *rand.Rand, first uint64, n int) []walpb.Entry {
+	ents := make([]walpb.Entry, n)
+	for i := range ents {
+		data := make([]byte, rng.Intn(1500))
+		rng.Read(data)
+		ents[i] = walpb.Entry{Index: first + uint64(i), Term: 1, Data: data}
+	}
+	return ents
+}
+
+// saveUntilCrash saves ents one by one to w until a save fails, and returns
+// the number of acknowledged entries.
+func saveUntilCrash(w *WAL, ents []walpb.Entry) (acked int) {
+	for i := range ents {
+		if err := w.Save(&walpb.HardState{Term: 1, Commit: ents[i].Index}, ents[i:i+1]); err != nil {
+			return acked
+		}
+		acked++
+	}
+	return acked
+}
+
+func createUntilCrash(fs fileutil.FS) *WAL {
+	w, err := Create(crashDir, []byte("metadata"), crashOptions(fs)...)
+	if err != nil {
+		return nil
+	}
+	return w
+}
+
+// recoverCrash opens the WAL left by a crash, repairing a torn tail, and
+// checks that it holds a prefix of want covering at least the acked entries.
+// It returns the WAL ready to append to and the number of recovered entries.
+func recoverCrash(t *testing.T, fs fileutil.FS, want []walpb.Entry, acked int) (*WAL, int) {
+	w, err := Open(crashDir, &walpb.Snapshot{}, crashOptions(fs)...)
+	if !assert.Empty(t, err) {
+		return nil, 0
+	}
+	metadata, _, ents, err := w.ReadAll()
+	if err == io.ErrUnexpectedEOF {
+		w.Close()
+		_, err = Repair(crashDir, false, crashOptions(fs)...)
+		if !assert.Empty(t, err) {
+			return nil, 0
+		}
+		w, err = Open(crashDir, &walpb.Snapshot{}, crashOptions(fs)...)
+		if !assert.Empty(t, err) {
+			return nil, 0
+		}
+		metadata, _, ents, err = w.ReadAll()
+	}
+	if !assert.Empty(t, err) {
+		w.Close()
+		return nil, 0
+	}
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.True(t, len(ents) >= acked, "recovered %d entries, acknowledged %d", len(ents), acked)
+	if !assert.True(t, len(ents) <= len(want)) {
+		return w, len(ents)
+	}
+	for i := range ents {
+		assert.Equal(t, want[i].Index, ents[i].Index)
+		assert.True(t, bytes.Equal(want[i].Data, ents[i].Data), "entry %d", want[i].Index)
+	}
+	return w, len(ents)
+}
+
+// TestCrashRecovery crashes the filesystem at random points while saving
+// entries, then checks that the WAL recovers a prefix of the saved entries
+// holding all the acknowledged ones. The recovered WAL is appended to and
+// crashed again, so that leftovers of torn writes are overwritten.
+func TestCrashRecovery(t *testing.T) {
+	// count the operations of a run without crash
+	fs := fileutil.NewCrashFS(0)
+	assert.Empty(t, fs.MkdirAll("/data", fileutil.PrivateDirMode))
+	w := createUntilCrash(fs)
+	assert.NotNil(t, w)
+	rng := rand.New(rand.NewSource(0))
+	assert.Equal(t, 40, saveUntilCrash(w, crashEntries(rng, 1, 40)))
+	assert.Empty(t, w.Close())
+	ops := fs.Ops()
+
+	for seed := int64(1); seed <= 200; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		fs := newCrashFS(t, seed)
+
+		fs.CrashAfter(1 + rng.Intn(ops))
+		want := crashEntries(rng, 1, 40)
+		acked := 0
+		w := createUntilCrash(fs)
+		if w != nil {
+			acked = saveUntilCrash(w, want)
+			w.Close()
+		}
+		fs = fs.Crash()
+		if w == nil && !Exist(crashDir, WithFS(fs)) {
+			continue // the creation was lost
+		}
+
+		w, n := recoverCrash(t, fs, want, acked)
+		if w == nil {
+			continue
+		}
+		want = append(want[:n], crashEntries(rng, uint64(n)+1, 20)...)
+		fs.CrashAfter(1 + rng.Intn(ops/2))
+		acked = n + saveUntilCrash(w, want[n:])
+		w.Close()
+		fs = fs.Crash()
+
+		w, _ = recoverCrash(t, fs, want, acked)
+		if w != nil {
+			w.Close()
+		}
+	}
+}
+
+// TestCrashRecoverySyncFileRange crashes a WAL synced with sync_file_range,
+// which makes nothing durable, and checks that the entries it reported
+// durable are recovered.
+func TestCrashRecoverySyncFileRange(t *testing.T) {
+	for seed := int64(1); seed <= 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		fs := newCrashFS(t, seed)
+		opts := append(crashOptions(fs), WithSyncMethod(SyncFileRange), WithFullSyncInterval(time.Hour))
+		w, err := Create(crashDir, []byte("metadata"), opts...)
+		if !assert.Empty(t, err) {
+			return
+		}
+		ents := crashEntries(rng, 1, 5)
+		assert.Empty(t, w.Save(nil, ents))
+		assert.Equal(t, uint64(0), w.DurableIndex())
+		assert.Empty(t, w.Sync())
+		assert.Equal(t, uint64(5), w.DurableIndex())
+
+		fs.CrashAfter(1 + rng.Intn(100))
+		want := append(ents, crashEntries(rng, 6, 35)...)
+		for i := 5; i < len(want); i++ {
+			if w.Save(nil, want[i:i+1]) != nil {
+				break
+			}
+			// a full sync now and then
+			if i%8 == 0 && w.Sync() != nil {
+				break
+			}
+		}
+		acked := int(w.DurableIndex())
+		w.Close()
+		fs = fs.Crash()
+
+		if w, _ = recoverCrash(t, fs, want, acked); w != nil {
+			w.Close()
+		}
+	}
+}
+
+// TestCrashedErrors checks that the WAL returns the errors of a crashed
+// filesystem instead of panicking, wherever the crash happens in a save.
+func TestCrashedErrors(t *testing.T) {
+	for n := 1; n <= 60; n++ {
+		fs := newCrashFS(t, int64(n))
+		w, err := Create(crashDir, []byte("metadata"), crashOptions(fs)...)
+		if !assert.Empty(t, err) {
+			return
+		}
+		fs.CrashAfter(n)
+		rng := rand.New(rand.NewSource(int64(n)))
+		ents := crashEntries(rng, 1, 40)
+		i := 0
+		for ; i < len(ents); i++ {
+			if err = w.Save(&walpb.HardState{Term: 1, Commit: ents[i].Index}, ents[i:i+1]); err != nil {
+				break
+			}
+		}
+		if i == len(ents) {
+			t.Fatalf("no crash after %d operations", n)
+		}
+		assert.True(t, errors.Is(err, fileutil.ErrCrashed), "save: %v", err)
+		// the WAL stays usable for the errors
+		err = w.Save(nil, ents[i:i+1])
+		assert.True(t, errors.Is(err, fileutil.ErrCrashed), "save again: %v", err)
+		err = w.SaveSnapshot(&walpb.Snapshot{Index: 1, Term: 1})
+		assert.True(t, errors.Is(err, fileutil.ErrCrashed), "snapshot: %v", err)
+		assert.True(t, errors.Is(w.Sync(), fileutil.ErrCrashed))
+		assert.True(t, errors.Is(w.Close(), fileutil.ErrCrashed))
+	}
+}
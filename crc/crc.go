@@ -9,11 +9,44 @@ package crc
 import (
 	"hash"
 	"hash/crc32"
+	"hash/crc64"
 )
 
 // The size of a CRC-32 checksum in bytes.
 const Size = 4
 
+// The size of a CRC-64 checksum in bytes.
+const Size64 = 8
+
+// Checksum is a checksum algorithm whose digests can start from the sum of
+// previous data, so that the sum is chained across writes.
+type Checksum interface {
+	// New returns a digest starting from the sum prev.
+	New(prev uint64) hash.Hash64
+}
+
+// CRC32C is the CRC-32 checksum with the Castagnoli polynomial.
+var CRC32C = NewCRC32(crc32.MakeTable(crc32.Castagnoli))
+
+// CRC64ECMA is the CRC-64 checksum with the ECMA polynomial.
+var CRC64ECMA = NewCRC64(crc64.MakeTable(crc64.ECMA))
+
+type crc32Checksum struct{ tab *crc32.Table }
+
+// NewCRC32 returns the CRC-32 Checksum with the polynomial represented by
+// the Table. Its sums are 32 bits wide.
+func NewCRC32(tab *crc32.Table) Checksum { return crc32Checksum{tab} }
+
+func (c crc32Checksum) New(prev uint64) hash.Hash64 { return &digest{uint32(prev), c.tab} }
+
+type crc64Checksum struct{ tab *crc64.Table }
+
+// NewCRC64 returns the CRC-64 Checksum with the polynomial represented by
+// the Table.
+func NewCRC64(tab *crc64.Table) Checksum { return crc64Checksum{tab} }
+
+func (c crc64Checksum) New(prev uint64) hash.Hash64 { return &digest64{prev, c.tab} }
+
 type digest struct {
 	crc uint32
 	tab *crc32.Table
@@ -37,7 +70,32 @@ func (d *digest) Write(p []byte) (n int, err error) {
 
 func (d *digest) Sum32() uint32 { return d.crc }
 
+func (d *digest) Sum64() uint64 { return uint64(d.crc) }
+
 func (d *digest) Sum(in []byte) []byte {
 	s := d.Sum32()
 	return append(in, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
 }
+
+type digest64 struct {
+	crc uint64
+	tab *crc64.Table
+}
+
+func (d *digest64) Size() int { return Size64 }
+
+func (d *digest64) BlockSize() int { return 1 }
+
+func (d *digest64) Reset() { d.crc = 0 }
+
+func (d *digest64) Write(p []byte) (n int, err error) {
+	d.crc = crc64.Update(d.crc, d.tab, p)
+	return len(p), nil
+}
+
+func (d *digest64) Sum64() uint64 { return d.crc }
+
+func (d *digest64) Sum(in []byte) []byte {
+	s := d.Sum64()
+	return append(in, byte(s>>56), byte(s>>48), byte(s>>40), byte(s>>32), byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
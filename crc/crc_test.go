@@ -5,7 +5,9 @@
 package crc
 
 import (
+	"hash"
 	"hash/crc32"
+	"hash/crc64"
 	"reflect"
 	"testing"
 )
@@ -57,3 +59,40 @@ func TestHash32(t *testing.T) {
 		t.Errorf("Sum32 after reset = %d, want %d", g, wsum32)
 	}
 }
+
+// TestChecksum tests that the digests of each Checksum resume from a previous
+// sum like the standard hashes continue writing.
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		c    Checksum
+		std  func() hash.Hash64
+		size int
+	}{
+		{CRC32C, func() hash.Hash64 { return hash32To64{crc32.New(crc32.MakeTable(crc32.Castagnoli))} }, Size},
+		{CRC64ECMA, func() hash.Hash64 { return crc64.New(crc64.MakeTable(crc64.ECMA)) }, Size64},
+	}
+	for i, tt := range tests {
+		stdhash := tt.std()
+		stdhash.Write([]byte("test data"))
+		h := tt.c.New(stdhash.Sum64())
+		if g := h.Size(); g != tt.size {
+			t.Errorf("#%d: size = %d, want %d", i, g, tt.size)
+		}
+		stdhash.Write([]byte("more data"))
+		h.Write([]byte("more data"))
+		if g, w := h.Sum64(), stdhash.Sum64(); g != w {
+			t.Errorf("#%d: Sum64 = %x, want %x", i, g, w)
+		}
+		if g, w := h.Sum(nil), stdhash.Sum(nil); !reflect.DeepEqual(g, w) {
+			t.Errorf("#%d: sum = %v, want %v", i, g, w)
+		}
+		if g := tt.c.New(0).Sum64(); g != 0 {
+			t.Errorf("#%d: Sum64 of no data = %x, want 0", i, g)
+		}
+	}
+}
+
+// hash32To64 widens the sums of a hash.Hash32.
+type hash32To64 struct{ hash.Hash32 }
+
+func (h hash32To64) Sum64() uint64 { return uint64(h.Sum32()) }
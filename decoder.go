@@ -17,13 +17,14 @@ package wal
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"sync"
 
 	"github.com/golang/protobuf/proto" // nolint
 
-	"github.com/amazingchow/photon-dance-wal/crc"
 	"github.com/amazingchow/photon-dance-wal/walpb"
 )
 
@@ -38,17 +39,49 @@ type decoder struct {
 
 	// lastValidOff file offset following the last valid decoded record
 	lastValidOff int64
-	crc          hash.Hash32
+	crc          hash.Hash64
+
+	// consumed is the number of readers that were read to the end
+	consumed int
+	// lastRecOff file offset of the last decoded record in the current reader
+	lastRecOff int64
+	// lastRecCRC crc chained up to the last decoded record
+	lastRecCRC uint64
+
+	maxRecordBytes int64
+	codec          func(id uint32) Codec
+	opener         opener
+	newDigest      func(prev uint64) hash.Hash64
+	metrics        Metrics
+	// unverified skips the checksums, to read the header telling which
+	// checksum the segment uses
+	unverified bool
+	// raw leaves the data of the records as stored
+	raw bool
+
+	// names are the file names of the segments read, and base the offset
+	// the first one is read from, to locate corrupted records.
+	names []string
+	base  int64
+	// lastIndex is the index of the last entry read, as tracked by the
+	// caller.
+	lastIndex uint64
 }
 
-func newDecoder(r ...io.Reader) *decoder {
+func newDecoder(opts *Options, r ...io.Reader) *decoder {
 	readers := make([]*bufio.Reader, len(r))
 	for i := range r {
 		readers[i] = bufio.NewReader(r[i])
 	}
 	return &decoder{
-		brs: readers,
-		crc: crc.New(0, crcTable),
+		brs:            readers,
+		crc:            opts.newDigest(0),
+		newDigest:      opts.newDigest,
+		maxRecordBytes: opts.maxRecordBytes,
+		codec:          opts.codecByID,
+		opener:         opener{keys: opts.keys, keepSealed: opts.keepSealed},
+		raw:            opts.rawRecords,
+		metrics:        opts.metrics,
 	}
 }
 
@@ -56,12 +89,64 @@ func (d *decoder) decode(rec *walpb.Record) error {
 	rec.Reset()
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.decodeRecord(rec)
+	if err := d.decodeRecord(rec); err != nil {
+		return err
+	}
+	if rec.Fragment == walpb.FragmentType_NoFragment {
+		return nil
+	}
+	return d.reassemble(rec)
+}
+
+// corruption returns a *CorruptionError for the record of type t at offset
+// off of the current reader, damaged as err tells.
+func (d *decoder) corruption(off int64, t walpb.RecordType, err error) error {
+	ce := &CorruptionError{Offset: off, RecordType: t, LastIndex: d.lastIndex, Err: err}
+	if d.consumed < len(d.names) {
+		ce.Segment = d.names[d.consumed]
+	}
+	if d.consumed == 0 {
+		ce.Offset += d.base
+	}
+	return ce
+}
+
+// reassemble decodes the fragments following the first one in rec, and
+// replaces rec with the whole record, located at its first fragment. A log
+// that ends within the fragments is torn.
+func (d *decoder) reassemble(rec *walpb.Record) error {
+	if rec.Fragment != walpb.FragmentType_FirstFragment {
+		return d.corruption(d.lastRecOff, rec.Type, ErrFragmentSequence)
+	}
+	off, crc, consumed := d.lastRecOff, d.lastRecCRC, d.consumed
+	data := append([]byte(nil), rec.Data...)
+	frag := &walpb.Record{}
+	for {
+		err := d.decodeRecord(frag)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		// the fragments are never split across segments
+		if d.consumed != consumed || frag.Type != rec.Type ||
+			(frag.Fragment != walpb.FragmentType_MiddleFragment && frag.Fragment != walpb.FragmentType_LastFragment) {
+			return d.corruption(d.lastRecOff, frag.Type, ErrFragmentSequence)
+		}
+		data = append(data, frag.Data...)
+		if frag.Fragment == walpb.FragmentType_LastFragment {
+			break
+		}
+	}
+	rec.Data, rec.Fragment = data, walpb.FragmentType_NoFragment
+	d.lastRecOff, d.lastRecCRC = off, crc
+	return nil
 }
 
 // raft max message size is set to 1 MB in etcd server
 // assume projects set reasonable message size limit,
-// thus entry size should never exceed 10 MB
+// thus entry size should never exceed 10 MB by default
 const maxWALEntrySizeLimit = int64(10 * 1024 * 1024)
 
 func (d *decoder) decodeRecord(rec *walpb.Record) error {
@@ -76,6 +161,7 @@ func (d *decoder) decodeRecord(rec *walpb.Record) error {
 		if len(d.brs) == 0 {
 			return io.EOF
 		}
+		d.consumed++
 		d.lastValidOff = 0
 		return d.decodeRecord(rec)
 	}
@@ -84,8 +170,8 @@ func (d *decoder) decodeRecord(rec *walpb.Record) error {
 	}
 
 	recBytes, padBytes := decodeFrameSize(l)
-	if recBytes >= maxWALEntrySizeLimit-padBytes {
-		return ErrMaxWALEntrySizeLimitExceeded
+	if recBytes >= d.maxRecordBytes-padBytes {
+		return d.corruption(d.lastValidOff, 0, ErrMaxWALEntrySizeLimitExceeded)
 	}
 
 	data := make([]byte, recBytes+padBytes)
@@ -101,17 +187,42 @@ func (d *decoder) decodeRecord(rec *walpb.Record) error {
 		if d.isTornEntry(data) {
 			return io.ErrUnexpectedEOF
 		}
-		return err
+		// proto reports truncated fields as io.ErrUnexpectedEOF, which must
+		// not be taken for a torn write
+		return d.corruption(d.lastValidOff, 0, fmt.Errorf("wal: failed to unmarshal record: %w", err))
 	}
 
+	d.lastRecOff = d.lastValidOff
+	d.lastRecCRC = d.crc.Sum64()
+
 	// skip crc checking if the record type is crcType
 	if rec.GetType() != walpb.RecordType_CrcType {
 		d.crc.Write(rec.Data)
-		if err := rec.Validate(d.crc.Sum32()); err != nil {
+		if d.unverified {
+			d.lastValidOff += frameSizeBytes + recBytes + padBytes
+			return nil
+		}
+		// Validate resets rec on a mismatch
+		t := rec.Type
+		if err := rec.Validate(d.crc.Sum64()); err != nil {
 			if d.isTornEntry(data) {
 				return io.ErrUnexpectedEOF
 			}
-			return err
+			d.metrics.ObserveCRCFailure()
+			return d.corruption(d.lastValidOff, t, err)
+		}
+		if !d.raw {
+			opened, err := d.opener.open(rec)
+			if err == nil && opened {
+				err = decompress(d.codec, d.maxRecordBytes, rec)
+			}
+			if err != nil {
+				// a missing key or codec is no damage of the record
+				if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrCodecNotFound) {
+					return err
+				}
+				return d.corruption(d.lastValidOff, t, err)
+			}
 		}
 	}
 	// record decoded as valid; point last valid offset to end of record
@@ -167,12 +278,12 @@ func (d *decoder) isTornEntry(data []byte) bool {
 	return false
 }
 
-func (d *decoder) updateCRC(prevCrc uint32) {
-	d.crc = crc.New(prevCrc, crcTable)
+func (d *decoder) updateCRC(prevCrc uint64) {
+	d.crc = d.newDigest(prevCrc)
 }
 
-func (d *decoder) lastCRC() uint32 {
-	return d.crc.Sum32()
+func (d *decoder) lastCRC() uint64 {
+	return d.crc.Sum64()
 }
 
 func (d *decoder) lastOffset() int64 { return d.lastValidOff }
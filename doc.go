@@ -25,11 +25,110 @@ to it with the Save method:
 	...
 	err := w.Save(s, ents)
 
+The raft HardState s is optional; when given it is written in the same batch
+and made durable together with the entries.
+
 After saving a raft snapshot to disk, SaveSnapshot method should be called to
 record it. So WAL can match with the saved snapshot when restarting.
 
 	err := w.SaveSnapshot(walpb.Snapshot{Index: 10, Term: 2})
 
+Per-instance settings such as the segment size, page alignment, max record
+size, file permission, sync behavior and logger are given as options:
+
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithSegmentSizeBytes(16*1000*1000))
+
+The same options should be passed to Open and OpenForRead. All file operations
+go through a fileutil.FS, the local filesystem unless another one is given
+with WithFS. A fileutil.MemFS keeps the whole WAL in memory, in the same
+format as on disk:
+
+	fs := fileutil.NewMemFS()
+	w, err := wal.Create("/wal", metadata, wal.WithFS(fs))
+	...
+	err = fs.Dump("/wal", "/var/lib/etcd/wal")
+
+A fileutil.CrashFS additionally simulates power failures, keeping only what
+was synced.
+
+SaveAsync queues a save and returns a future that completes once it is
+synced as the sync policy requires, so that callers can overlap other work
+with the disk sync. DurableIndex and WaitDurable expose the last entry on
+stable storage:
+
+	f := w.SaveAsync(&state, ents)
+	...
+	err := f.Wait()
+
+In-process consumers can follow a WAL in append mode and receive entries as
+soon as Save has made them durable:
+
+	fl, err := w.Follow(ctx, fromIndex)
+	...
+	for ent := range fl.Entries() { ... }
+
+Once a snapshot is saved, the segments it makes obsolete can be released and
+deleted, optionally keeping some history as allowed by a Retention; StartPurger
+does the same periodically in the background:
+
+	w.ReleaseLockTo(snap.Index)
+	removed, err := wal.Purge("/var/lib/etcd", snap.Index, wal.Retention{MaxSegments: 5})
+
+A corrupted record makes ReadAll, Replay and Verify fail with a
+*CorruptionError telling its segment, offset, type and the index of the last
+entry read before it; it matches its cause, such as ErrCRCMismatch, with
+errors.Is:
+
+	var ce *wal.CorruptionError
+	if errors.As(err, &ce) {
+		fmt.Println(ce.Segment, ce.Offset, ce.LastIndex)
+	}
+
+If ReadAll fails on a torn or corrupted tail, Repair truncates the tail segment
+after its last valid record, backing up the dropped bytes:
+
+	report, err := wal.Repair("/var/lib/etcd/wal", false)
+
+Segments and ScanRecords inspect the files of a WAL directory without opening
+it; the walctl command built on them lists, dumps, verifies and repairs WALs:
+
+	walctl dump -json /var/lib/etcd/wal
+
+Record data can be compressed with a Codec once it reaches a size threshold;
+each record keeps the ID of its codec, so a WAL can mix codecs and is read
+back transparently:
+
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithCompression(wal.GzipCodec(gzip.BestSpeed), 256))
+
+Entry and snapshot records, and optionally metadata records, can be encrypted
+with AES-GCM. Each record keeps the ID of its key; the current key of the
+KeyProvider is taken whenever a segment is cut, so keys rotate without
+rewriting older segments:
+
+	kp, err := wal.NewFileKeyProvider("/etc/etcd/wal.keys")
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithEncryption(kp))
+
+The crc chain covers the stored ciphertext, so Verify, Repair and walctl work
+without the keys.
+
+Save rejects an entry that does not fit in a record of the max record size with
+ErrMaxWALEntrySizeLimitExceeded, before writing anything. With fragmentation,
+larger entries are instead split into first, middle and last fragment records,
+which are read back as one entry; a log that ends within the fragments of an
+entry is torn:
+
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithFragmentation(1024*1024))
+
+A WAL reports its sync and save latencies, the records and bytes written,
+segment cuts, preallocations, replays and crc failures to a Metrics. The
+Collector implementation exports them in the Prometheus text format and as an
+expvar variable:
+
+	c := wal.NewCollector()
+	c.Publish("wal")
+	http.Handle("/metrics", c)
+	w, err := wal.Create("/var/lib/etcd", metadata, wal.WithMetrics(c))
+
 When a user has finished using a WAL it must be closed:
 
 	w.Close()
@@ -38,8 +137,16 @@ Each WAL file is a stream of WAL records. A WAL record is a length field and a w
 protobuf. The record protobuf contains a CRC, a type, and a data payload. The length field is a
 64-bit packed structure holding the length of the remaining logical record data in its lower
 56 bits and its physical padding in the first three bits of the most significant byte. Each
-record is 8-byte aligned so that the length field is never torn. The CRC contains the CRC32
-value of all record protobufs preceding the current record.
+record is 8-byte aligned so that the length field is never torn. The CRC contains the CRC32C
+value of all record protobufs preceding the current record, or their CRC64 value for a WAL
+created WithChecksum(walpb.ChecksumType_CRC64_ECMA).
+
+Each WAL file starts with a CRC record carrying the CRC of the previous files,
+followed by a header record with the format version, the checksum algorithm,
+the page size, the features required to read the file (compression,
+encryption, fragmentation) and the writer version. Open refuses files that
+require a newer format or unknown features; files without a header are of
+format version 0.
 
 WAL files are placed inside of the directory in the following format:
 $seq-$index.wal
@@ -68,8 +175,22 @@ snapshot to the end of the WAL are read first:
 
 	metadata, state, ents, err := w.ReadAll()
 
-This will give you the metadata, the last raft.State and the slice of
-raft.Entry items in the log.
+This will give you the metadata, the last walpb.HardState and the slice of
+walpb.Entry items in the log. For large logs, Replay streams the entries to a
+callback one at a time instead:
+
+	metadata, state, err := w.Replay(func(ent *walpb.Entry) error { ... })
+
+Open, ReadAll, Replay, Save, SaveSnapshot, Sync and Verify have variants taking
+a context, such as ReadAllContext, which give up with the context error once
+it is done. A save is either withdrawn before any of it is written, or
+completed as a whole in the background:
+
+	metadata, state, ents, err := w.ReadAllContext(ctx)
+
+When raft drops a conflicting suffix, TruncateSuffix physically removes every
+entry after the given index, so that it is never replayed again:
 
+	err := w.TruncateSuffix(index)
 */
 package wal
@@ -15,64 +15,128 @@
 package wal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"hash"
 	"io"
-	"os"
 	"sync"
 
 	"github.com/golang/protobuf/proto" // nolint
 
-	"github.com/amazingchow/photon-dance-wal/crc"
+	"github.com/amazingchow/photon-dance-wal/fileutil"
 	"github.com/amazingchow/photon-dance-wal/ioutil"
 	"github.com/amazingchow/photon-dance-wal/walpb"
 )
 
 const (
-	// walPageBytes is the alignment for flushing records to the backing Writer.
+	// walPageBytes is the default alignment for flushing records to the backing Writer.
 	// It should be a multiple of the minimum sector size so that WAL can safely
 	// distinguish between torn writes and ordinary data corruption.
 	walPageBytes = 8 * minSectorSize // 4KB
 	oneMB        = 1024 * 1024
+
+	// recordOverheadBytes bounds what a record adds to its data: the
+	// padding, the record fields, and the nonce and tag of the encryption
+	// with a key ID of up to 64 bytes.
+	recordOverheadBytes = 128
 )
 
 type encoder struct {
 	mu sync.Mutex
 	bw *ioutil.PageWriter
 
-	crc       hash.Hash32
+	crc       hash.Hash64
+	off       int64 // file offset of the next record
 	buf       []byte
 	pbuf      *proto.Buffer
 	uint64buf []byte
+
+	codec            Codec
+	compressMinBytes int
+	// sealer encrypts the records, nil if they are stored in clear.
+	sealer          *sealer
+	encryptMetadata bool
+
+	maxRecordBytes int64
+	newDigest      func(prev uint64) hash.Hash64
+	metrics        Metrics
+
+	// stage buffers the records encoded since begin, nil when records are
+	// written through.
+	stage *stage
+}
+
+// stage is a group of records that are either all written or all dropped.
+type stage struct {
+	buf  bytes.Buffer
+	off  int64  // offset of the first record
+	crc  uint64 // crc chained up to the first record
+	recs []stagedRecord
+}
+
+// stagedRecord is the type and size of a staged record, reported to the
+// metrics once it is written.
+type stagedRecord struct {
+	t     walpb.RecordType
+	bytes int
 }
 
-func newEncoder(w io.Writer, prevCrc uint32, pageOffset int) *encoder {
+func newEncoder(w io.Writer, prevCrc uint64, pageOffset int, opts *Options) *encoder {
 	buf := make([]byte, oneMB)
 	return &encoder{
-		bw:  ioutil.NewPageWriter(w, walPageBytes, pageOffset),
-		crc: crc.New(prevCrc, crcTable),
+		bw:  ioutil.NewPageWriter(w, opts.pageBytes, pageOffset),
+		crc: opts.newDigest(prevCrc),
+		off: int64(pageOffset),
 		// 1MB buffer
 		buf:       buf,
 		pbuf:      proto.NewBuffer(buf),
 		uint64buf: make([]byte, 8),
+
+		codec:            opts.codec,
+		compressMinBytes: opts.compressMinBytes,
+		encryptMetadata:  opts.encryptMetadata,
+		maxRecordBytes:   opts.maxRecordBytes,
+		newDigest:        opts.newDigest,
+		metrics:          opts.metrics,
 	}
 }
 
 // newFileEncoder creates a new encoder with current file offset for the page writer.
-func newFileEncoder(f *os.File, prevCrc uint32) (*encoder, error) {
+func newFileEncoder(f fileutil.File, prevCrc uint64, opts *Options) (*encoder, error) {
 	offset, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return nil, err
 	}
-	return newEncoder(f, prevCrc, int(offset)), nil
+	e := newEncoder(f, prevCrc, int(offset), opts)
+	if opts.keys != nil {
+		// the current key is taken for every new segment
+		if e.sealer, err = newSealer(opts.keys); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
 }
 
 func (e *encoder) encode(rec *walpb.Record) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// the decoder refuses records as large, even decompressed
+	if int64(len(rec.Data)) >= e.maxRecordBytes {
+		return ErrMaxWALEntrySizeLimitExceeded
+	}
+	// the crc covers the data as stored, compressed then encrypted
+	if err := compress(e.codec, e.compressMinBytes, rec); err != nil {
+		return err
+	}
+	if e.sealer != nil && encrypted(rec.Type, e.encryptMetadata) {
+		if err := e.sealer.seal(rec); err != nil {
+			return err
+		}
+	}
+	prevCrc := e.crc.Sum64()
 	e.crc.Write(rec.Data)
-	rec.Crc = e.crc.Sum32()
+	rec.Crc = e.crc.Sum64()
 	var (
 		data []byte
 		err  error
@@ -95,15 +159,63 @@ func (e *encoder) encode(rec *walpb.Record) error {
 	}
 
 	lenField, padBytes := encodeFrameSize(len(data))
-	if err = writeUint64(e.bw, lenField, e.uint64buf); err != nil {
+	if int64(len(data)+padBytes) >= e.maxRecordBytes {
+		// the record is not written, nor chained
+		e.crc = e.newDigest(prevCrc)
+		return ErrMaxWALEntrySizeLimitExceeded
+	}
+	var out io.Writer = e.bw
+	if e.stage != nil {
+		out = &e.stage.buf
+	}
+	if err = writeUint64(out, lenField, e.uint64buf); err != nil {
 		return err
 	}
 
 	if padBytes != 0 {
 		data = append(data, make([]byte, padBytes)...)
 	}
-	_, err = e.bw.Write(data)
-	return err
+	if _, err = out.Write(data); err != nil {
+		return err
+	}
+	e.off += frameSizeBytes + int64(len(data))
+	if e.stage != nil {
+		e.stage.recs = append(e.stage.recs, stagedRecord{t: rec.Type, bytes: frameSizeBytes + len(data)})
+	} else {
+		e.metrics.ObserveRecord(rec.Type, frameSizeBytes+len(data))
+	}
+	return nil
+}
+
+// begin buffers the records encoded from now on, until commit writes them
+// or rollback drops them as if they had never been encoded.
+func (e *encoder) begin() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stage = &stage{off: e.off, crc: e.crc.Sum64()}
+}
+
+// commit writes the records encoded since begin.
+func (e *encoder) commit() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := e.stage
+	e.stage = nil
+	if _, err := e.bw.Write(st.buf.Bytes()); err != nil {
+		return err
+	}
+	for _, rec := range st.recs {
+		e.metrics.ObserveRecord(rec.t, rec.bytes)
+	}
+	return nil
+}
+
+// rollback drops the records encoded since begin and unchains them.
+func (e *encoder) rollback() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.off, e.crc = e.stage.off, e.newDigest(e.stage.crc)
+	e.stage = nil
 }
 
 func encodeFrameSize(dataBytes int) (lenField uint64, padBytes int) {
@@ -0,0 +1,227 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// KeyProvider supplies the AES keys records are encrypted with, see
+// WithEncryption. Keys are 16, 24 or 32 bytes long, for AES-128, AES-192 or
+// AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key new segments are encrypted with, and its
+	// ID. It is asked for whenever a segment is started, so keys are rotated
+	// by changing the current key.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID, to decrypt the records written
+	// with it.
+	Key(id string) ([]byte, error)
+}
+
+// FileKeyProvider is a KeyProvider reading its keys from a file, one per
+// line as an ID and the hex encoded key separated by a space. Blank lines and
+// lines starting with # are ignored. The last key of the file is the current
+// one: a key is rotated by appending a new one and calling Reload. Old keys
+// must be kept as long as segments written with them remain.
+type FileKeyProvider struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[string][]byte
+	current string
+}
+
+// NewFileKeyProvider returns a FileKeyProvider with the keys of the file at
+// path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the keys of the file again. The keys are left unchanged if
+// the file is invalid.
+func (p *FileKeyProvider) Reload() error {
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string][]byte)
+	var current string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("wal: %s:%d: expected a key ID and a key", p.path, n)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("wal: %s:%d: %v", p.path, n, err)
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return fmt.Errorf("wal: %s:%d: %v", p.path, n, err)
+		}
+		keys[fields[0]], current = key, fields[0]
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+	if current == "" {
+		return fmt.Errorf("wal: %s: no key", p.path)
+	}
+
+	p.mu.Lock()
+	p.keys, p.current = keys, current
+	p.mu.Unlock()
+	return nil
+}
+
+// CurrentKey returns the last key of the file.
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current, p.keys[p.current], nil
+}
+
+// Key returns the key with the given ID. The file is read again if the key
+// is not known yet, as it may have been added for another WAL instance.
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	p.mu.Lock()
+	key, ok := p.keys[id]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok = p.keys[id]; !ok {
+		return nil, fmt.Errorf("%w %q", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// encrypted reports whether records of type t are encrypted.
+func encrypted(t walpb.RecordType, metadata bool) bool {
+	switch t {
+	case walpb.RecordType_EntryType, walpb.RecordType_SnapshotType:
+		return true
+	case walpb.RecordType_MetadataType:
+		return metadata
+	}
+	return false
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the ciphertext of rec to its type and codec, which
+// are stored in clear.
+func additionalData(rec *walpb.Record) []byte {
+	ad := make([]byte, 8)
+	binary.LittleEndian.PutUint32(ad, uint32(rec.Type))
+	binary.LittleEndian.PutUint32(ad[4:], rec.Codec)
+	return ad
+}
+
+// sealer encrypts records with one key.
+type sealer struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newSealer(keys KeyProvider) (*sealer, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("wal: invalid key %q: %v", id, err)
+	}
+	return &sealer{id: id, aead: aead}, nil
+}
+
+// seal replaces the data of rec with a random nonce followed by its
+// ciphertext.
+func (s *sealer) seal(rec *walpb.Record) error {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(rec.Data)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	rec.Data = s.aead.Seal(nonce, nonce, rec.Data, additionalData(rec))
+	rec.KeyId = s.id
+	return nil
+}
+
+// opener decrypts records with the keys of a provider.
+type opener struct {
+	keys KeyProvider
+	// keepSealed leaves the records as stored when there is no provider,
+	// instead of failing.
+	keepSealed bool
+	aeads      map[string]cipher.AEAD
+}
+
+// open restores the data of rec if it is encrypted, and reports whether it
+// did. rec keeps its key ID.
+func (o *opener) open(rec *walpb.Record) (bool, error) {
+	if rec.KeyId == "" {
+		return true, nil
+	}
+	if o.keys == nil {
+		if o.keepSealed {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w %q", ErrKeyNotFound, rec.KeyId)
+	}
+	aead, ok := o.aeads[rec.KeyId]
+	if !ok {
+		key, err := o.keys.Key(rec.KeyId)
+		if err != nil {
+			return false, err
+		}
+		if aead, err = newAEAD(key); err != nil {
+			return false, fmt.Errorf("wal: invalid key %q: %v", rec.KeyId, err)
+		}
+		if o.aeads == nil {
+			o.aeads = make(map[string]cipher.AEAD)
+		}
+		o.aeads[rec.KeyId] = aead
+	}
+	n := aead.NonceSize()
+	if len(rec.Data) < n {
+		return false, fmt.Errorf("wal: failed to decrypt record: ciphertext too short")
+	}
+	data, err := aead.Open(nil, rec.Data[:n], rec.Data[n:], additionalData(rec))
+	if err != nil {
+		return false, fmt.Errorf("wal: failed to decrypt record: %w", err)
+	}
+	rec.Data = data
+	return true, nil
+}
@@ -0,0 +1,184 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// appendKey adds a key with the given ID to the key file at path, making it
+// the current one.
+func appendKey(t *testing.T, path, id string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	assert.Empty(t, err)
+	_, err = fmt.Fprintf(f, "%s %x\n", id, bytes.Repeat([]byte(id[len(id)-1:]), 32))
+	assert.Empty(t, err)
+	assert.Empty(t, f.Close())
+}
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	appendKey(t, keyFile, "k1")
+	kp, err := NewFileKeyProvider(keyFile)
+	assert.Empty(t, err)
+
+	p := filepath.Join(dir, "wal")
+	opts := []Option{WithEncryption(kp), WithCompression(FlateCodec(flate.BestSpeed), 64), WithSegmentSizeBytes(4096)}
+	w, err := Create(p, []byte("metadata"), opts...)
+	assert.Empty(t, err)
+	save := func(first, last int) {
+		for i := first; i <= last; i++ {
+			err := w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}})
+			assert.Empty(t, err)
+		}
+	}
+	save(1, 10)
+	// rotate, the next segments are encrypted with k2
+	appendKey(t, keyFile, "k2")
+	assert.Empty(t, kp.Reload())
+	save(11, 40)
+	assert.Empty(t, w.Close())
+
+	// the records are checked and scanned without keys
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}))
+	keys := make(map[string]map[string]bool)
+	err = ScanRecords(p, func(ri RecordInfo) error {
+		rec := ri.Record
+		switch rec.Type {
+		case walpb.RecordType_EntryType, walpb.RecordType_SnapshotType:
+			assert.NotEmpty(t, rec.KeyId)
+			assert.False(t, bytes.Contains(rec.Data, []byte("registry")))
+			if keys[ri.Segment] == nil {
+				keys[ri.Segment] = make(map[string]bool)
+			}
+			keys[ri.Segment][rec.KeyId] = true
+		case walpb.RecordType_MetadataType:
+			assert.Empty(t, rec.KeyId)
+			assert.Equal(t, []byte("metadata"), rec.Data)
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 2)
+	assert.Equal(t, map[string]bool{"k1": true}, keys[segs[0].Name])
+	assert.Equal(t, map[string]bool{"k2": true}, keys[segs[len(segs)-1].Name])
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.True(t, errors.Is(err, ErrKeyNotFound), "%v", err)
+	assert.Empty(t, w.Close())
+
+	// a fresh provider reads the keys of both generations
+	kp, err = NewFileKeyProvider(keyFile)
+	assert.Empty(t, err)
+	w, err = Open(p, &walpb.Snapshot{}, WithEncryption(kp))
+	assert.Empty(t, err)
+	metadata, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.Equal(t, 40, len(ents))
+	for i, ent := range ents {
+		assert.Equal(t, jsonData(i+1), ent.Data)
+	}
+	assert.Empty(t, w.Close())
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}, WithEncryption(kp)))
+
+	// a wrong key does not authenticate, though the crc chain holds
+	assert.Empty(t, ioutil.WriteFile(keyFile, []byte(fmt.Sprintf("k1 %x\n", make([]byte, 32))), 0600))
+	kp, err = NewFileKeyProvider(keyFile)
+	assert.Empty(t, err)
+	w, err = Open(p, &walpb.Snapshot{}, WithEncryption(kp))
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.Contains(t, fmt.Sprint(err), "failed to decrypt record")
+	assert.Empty(t, w.Close())
+}
+
+func TestMetadataEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	appendKey(t, keyFile, "k1")
+	kp, err := NewFileKeyProvider(keyFile)
+	assert.Empty(t, err)
+
+	p := filepath.Join(dir, "wal")
+	_, err = Create(p, []byte("metadata"), WithMetadataEncryption())
+	assert.NotEmpty(t, err, "metadata encryption needs keys")
+	w, err := Create(p, []byte("metadata"), WithEncryption(kp), WithMetadataEncryption(), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	err = ScanRecords(p, func(ri RecordInfo) error {
+		if ri.Record.Type == walpb.RecordType_MetadataType {
+			assert.Equal(t, "k1", ri.Record.KeyId)
+			assert.NotEqual(t, []byte("metadata"), ri.Record.Data)
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	// the ciphertexts of the metadata differ from segment to segment
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}))
+
+	w, err = Open(p, &walpb.Snapshot{}, WithEncryption(kp))
+	assert.Empty(t, err)
+	metadata, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.Equal(t, 20, len(ents))
+	assert.Empty(t, w.Close())
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	for _, content := range []string{
+		"",
+		"# no key\n",
+		"k1\n",
+		"k1 zz\n",
+		"k1 0011\n",
+	} {
+		assert.Empty(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = NewFileKeyProvider(path)
+		assert.NotEmpty(t, err, "%q", content)
+	}
+
+	assert.Empty(t, ioutil.WriteFile(path, []byte("# keys\n\nk1 "+fmt.Sprintf("%x", make([]byte, 16))+"\n"), 0600))
+	kp, err := NewFileKeyProvider(path)
+	assert.Empty(t, err)
+	id, key, err := kp.CurrentKey()
+	assert.Empty(t, err)
+	assert.Equal(t, "k1", id)
+	assert.Equal(t, make([]byte, 16), key)
+
+	// unknown keys are looked up in the file again
+	appendKey(t, path, "k2")
+	key, err = kp.Key("k2")
+	assert.Empty(t, err)
+	assert.Equal(t, 32, len(key))
+	_, err = kp.Key("k3")
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+}
@@ -19,15 +19,13 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/rs/zerolog/log"
-
 	"github.com/amazingchow/photon-dance-wal/fileutil"
 )
 
 // FilePipeline pipelines allocating disk space
 type FilePipeline struct {
+	opts  *Options
 	dir   string
-	size  int64
 	count int
 
 	filec chan *fileutil.LockedFile
@@ -35,10 +33,16 @@ type FilePipeline struct {
 	donec chan struct{}
 }
 
-func NewFilePipeline(dir string, fileSize int64) *FilePipeline {
+// NewFilePipeline creates a FilePipeline that preallocates segment files
+// inside dir according to the given options.
+func NewFilePipeline(dir string, opts ...Option) *FilePipeline {
+	return newFilePipeline(dir, newOptions(opts))
+}
+
+func newFilePipeline(dir string, opts *Options) *FilePipeline {
 	fp := &FilePipeline{
+		opts:  opts,
 		dir:   dir,
-		size:  fileSize,
 		filec: make(chan *fileutil.LockedFile),
 		errc:  make(chan error, 1),
 		donec: make(chan struct{}),
@@ -65,11 +69,11 @@ func (fp *FilePipeline) Close() error {
 func (fp *FilePipeline) alloc() (f *fileutil.LockedFile, err error) {
 	// count % 2 so this file isn't the same as the one last published
 	fpath := filepath.Join(fp.dir, fmt.Sprintf("%d.tmp", fp.count%2))
-	if f, err = fileutil.LockFile(fpath, os.O_CREATE|os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if f, err = fp.opts.fs.LockFile(fpath, os.O_CREATE|os.O_WRONLY|fp.opts.syncFlag(), fp.opts.filePerm); err != nil {
 		return nil, err
 	}
-	if err = fileutil.Preallocate(f.File, fp.size, true); err != nil {
-		log.Error().Err(err).Int64("size", fp.size).Msg("failed to preallocate disk space when creating a new WAL file")
+	if err = fp.opts.preallocate(f.File); err != nil {
+		fp.opts.lg.Error("failed to preallocate disk space when creating a new WAL file", "error", err, "size", fp.opts.segmentSizeBytes)
 		f.Close()
 		return nil, err
 	}
@@ -88,7 +92,7 @@ func (fp *FilePipeline) run() {
 		select {
 		case fp.filec <- f:
 		case <-fp.donec:
-			os.Remove(f.Name())
+			fp.opts.fs.Remove(f.Name())
 			f.Close()
 			return
 		}
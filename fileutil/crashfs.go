@@ -0,0 +1,203 @@
+package fileutil
+
+import (
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"sort"
+)
+
+// SectorSize is the unit CrashFS persists unsynced data in: each sector is
+// either fully written or not written at all.
+const SectorSize = 512
+
+// ErrCrashed is returned by every operation of a CrashFS after its crash.
+var ErrCrashed = errors.New("fileutil: filesystem crashed")
+
+// CrashFS is a MemFS that simulates power failures. It remembers the data of
+// every file as of its last fsync and the entries of every directory as of
+// its last fsync, which is all a crash is guaranteed to keep.
+//
+// The filesystem left by a crash, see Crash, holds the entries of the synced
+// directories reachable from the roots. Each file has its synced data, except
+// that every sector changed since is randomly either kept from the synced
+// data or taken from the current one, so writes are lost or torn at sector
+// granularity. sync_file_range does not make anything durable.
+type CrashFS struct {
+	*MemFS
+
+	rng     *rand.Rand
+	data    map[*memNode][]byte              // file data as of the last sync
+	entries map[*memNode]map[string]*memNode // directory entries as of the last sync
+
+	ops     int      // operations so far
+	crashAt int      // operation to crash at, 0 if none
+	image   *CrashFS // filesystem left by the crash, nil until then
+}
+
+// NewCrashFS returns an empty CrashFS whose crashes are driven by seed.
+func NewCrashFS(seed int64) *CrashFS {
+	fs := &CrashFS{
+		MemFS:   NewMemFS(),
+		rng:     rand.New(rand.NewSource(seed)),
+		data:    make(map[*memNode][]byte),
+		entries: make(map[*memNode]map[string]*memNode),
+	}
+	fs.hooks = fs
+	return fs
+}
+
+// Ops returns the number of operations run so far.
+func (fs *CrashFS) Ops() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.ops
+}
+
+// CrashAfter makes the filesystem crash right before its n-th next operation,
+// which fails with ErrCrashed, as do all the later ones.
+func (fs *CrashFS) CrashAfter(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashAt = fs.ops + n
+}
+
+// Crash crashes the filesystem now, unless it has already crashed, and returns
+// what the crash left, as a machine finds its disk after a power failure. All
+// of the returned filesystem is durable, so that it can crash in turn.
+func (fs *CrashFS) Crash() *CrashFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crash()
+	return fs.image
+}
+
+// Crashed reports whether the filesystem has crashed.
+func (fs *CrashFS) Crashed() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.image != nil
+}
+
+func (fs *CrashFS) before(op string) error {
+	if fs.image != nil {
+		return ErrCrashed
+	}
+	fs.ops++
+	if fs.ops == fs.crashAt {
+		fs.crash()
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (fs *CrashFS) synced(f *memFile) {
+	if !f.n.dir {
+		fs.data[f.n] = append([]byte(nil), f.n.data...)
+		return
+	}
+	p, ok := fs.path(f.n)
+	if !ok {
+		return // removed
+	}
+	entries := make(map[string]*memNode)
+	for _, c := range fs.children(p) {
+		if filepath.Dir(c) == p {
+			entries[filepath.Base(c)] = fs.nodes[c]
+		}
+	}
+	fs.entries[f.n] = entries
+}
+
+// path returns the current path of n, which open files do not track across
+// renames. It must be called with fs.mu held.
+func (fs *CrashFS) path(n *memNode) (string, bool) {
+	for p, m := range fs.roots {
+		if m == n {
+			return p, true
+		}
+	}
+	for p, m := range fs.nodes {
+		if m == n {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// crash builds the filesystem left by a crash. It must be called with fs.mu
+// held.
+func (fs *CrashFS) crash() {
+	if fs.image != nil {
+		return
+	}
+	fs.image = NewCrashFS(fs.rng.Int63())
+	for _, p := range []string{".", "/"} {
+		if root, ok := fs.roots[p]; ok {
+			fs.restore(p, root)
+		}
+	}
+	fs.image.syncAll()
+}
+
+// syncAll makes everything in fs durable.
+func (fs *CrashFS) syncAll() {
+	for _, p := range []string{".", "/"} {
+		fs.lookup(p)
+	}
+	for p, n := range fs.roots {
+		fs.synced(&memFile{n: n, name: p})
+	}
+	for p, n := range fs.nodes {
+		fs.synced(&memFile{n: n, name: p})
+	}
+}
+
+// restore adds the durable entries of the directory n, found at p after the
+// crash, to the image.
+func (fs *CrashFS) restore(p string, n *memNode) {
+	// sorted so that a seed always leaves the same filesystem
+	var names []string
+	for name := range fs.entries[n] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := fs.entries[n][name]
+		cp := filepath.Join(p, name)
+		if c.dir {
+			fs.image.nodes[cp] = &memNode{dir: true, mode: c.mode, modTime: c.modTime}
+			fs.restore(cp, c)
+			continue
+		}
+		fs.image.nodes[cp] = &memNode{data: fs.tear(fs.data[c], c.data), mode: c.mode, modTime: c.modTime}
+	}
+}
+
+// tear returns the data of a file that held synced when it was last synced
+// and cur when the filesystem crashed.
+func (fs *CrashFS) tear(synced, cur []byte) []byte {
+	size := len(synced)
+	if len(cur) != size && fs.rng.Intn(2) == 0 {
+		size = len(cur)
+	}
+	data := make([]byte, size)
+	copy(data, synced)
+	for off := 0; off < size; off += SectorSize {
+		end := off + SectorSize
+		if end > size {
+			end = size
+		}
+		if fs.rng.Intn(2) == 0 {
+			continue
+		}
+		// the sector was written, with zeros past the end of cur
+		for i := off; i < end; i++ {
+			data[i] = 0
+			if i < len(cur) {
+				data[i] = cur[i]
+			}
+		}
+	}
+	return data
+}
@@ -0,0 +1,86 @@
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCrashFS(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		fs := NewCrashFS(seed)
+		if err := fs.MkdirAll("/d", PrivateDirMode); err != nil {
+			t.Fatal(err)
+		}
+		f, err := fs.OpenFile("/d/f", os.O_CREATE|os.O_RDWR, PrivateFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		synced := bytes.Repeat([]byte{1}, 2*SectorSize)
+		f.Write(synced)
+		if err = fs.Fsync(f); err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range []string{"/", "/d"} {
+			df, err := fs.OpenDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = fs.Fsync(df); err != nil {
+				t.Fatal(err)
+			}
+			df.Close()
+		}
+		// unsynced: a file entry and the rewrite of f
+		g, err := fs.OpenFile("/d/g", os.O_CREATE|os.O_RDWR, PrivateFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fs.Fsync(g); err != nil {
+			t.Fatal(err)
+		}
+		cur := bytes.Repeat([]byte{2}, 4*SectorSize)
+		f.Seek(0, 0)
+		f.Write(cur)
+		if err = fs.SyncFileRange(f); err != nil {
+			t.Fatal(err)
+		}
+
+		fs.CrashAfter(1)
+		if _, err = f.Write([]byte{3}); err != ErrCrashed {
+			t.Fatalf("err = %v, want %v", err, ErrCrashed)
+		}
+		if err = fs.Fsync(f); err != ErrCrashed {
+			t.Fatalf("err = %v, want %v", err, ErrCrashed)
+		}
+
+		img := fs.Crash()
+		if Exist(img, "/d/g") {
+			t.Fatal("unexpected unsynced entry /d/g")
+		}
+		r, err := img.OpenFile("/d/f", os.O_RDONLY, PrivateFileMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != len(synced) && len(b) != len(cur) {
+			t.Fatalf("seed %d: size = %d, want %d or %d", seed, len(b), len(synced), len(cur))
+		}
+		for off := 0; off < len(b); off += SectorSize {
+			sector := b[off : off+SectorSize]
+			var old []byte
+			if off < len(synced) {
+				old = synced[off : off+SectorSize]
+			} else {
+				old = make([]byte, SectorSize)
+			}
+			if !bytes.Equal(sector, old) && !bytes.Equal(sector, cur[off:off+SectorSize]) {
+				t.Fatalf("seed %d: sector at %d is neither old nor new", seed, off)
+			}
+		}
+	}
+}
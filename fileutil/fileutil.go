@@ -18,11 +18,8 @@ package fileutil
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-
-	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -32,28 +29,38 @@ const (
 	PrivateDirMode = 0700
 )
 
+// Logger receives the warnings of the functions of this package, with the
+// fields of a message given as alternating keys and values.
+type Logger interface {
+	Warn(msg string, fields ...interface{})
+}
+
 // IsDirWriteable checks if dir is writable by writing and removing a file
 // to dir. It returns nil if dir is writable.
-func IsDirWriteable(dir string) error {
-	f := filepath.Join(dir, ".touch")
-	if err := ioutil.WriteFile(f, []byte(""), PrivateFileMode); err != nil {
+func IsDirWriteable(fs FS, dir string) error {
+	p := filepath.Join(dir, ".touch")
+	f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, PrivateFileMode)
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
 		return err
 	}
-	return os.Remove(f)
+	return fs.Remove(p)
 }
 
 // TouchDirAll is similar to os.MkdirAll. It creates directories with 0700 permission if any directory
 // does not exists. TouchDirAll also ensures the given directory is writable.
-func TouchDirAll(dir string) error {
+func TouchDirAll(lg Logger, fs FS, dir string) error {
 	// If path is already a directory, MkdirAll does nothing and returns nil, so,
 	// first check if dir exist with an expected permission mode.
-	if Exist(dir) {
-		err := CheckDirPermission(dir, PrivateDirMode)
+	if Exist(fs, dir) {
+		err := CheckDirPermission(fs, dir, PrivateDirMode)
 		if err != nil {
-			log.Warn().Err(err).Msg("check file permission")
+			lg.Warn("check file permission", "error", err)
 		}
 	} else {
-		err := os.MkdirAll(dir, PrivateDirMode)
+		err := fs.MkdirAll(dir, PrivateDirMode)
 		if err != nil {
 			// if mkdirAll("a/text") and "text" is not
 			// a directory, this will return syscall.ENOTDIR
@@ -61,16 +68,16 @@ func TouchDirAll(dir string) error {
 		}
 	}
 
-	return IsDirWriteable(dir)
+	return IsDirWriteable(fs, dir)
 }
 
 // CreateDirAll is similar to TouchDirAll but returns error
 // if the deepest directory was not empty.
-func CreateDirAll(dir string) error {
-	err := TouchDirAll(dir)
+func CreateDirAll(lg Logger, fs FS, dir string) error {
+	err := TouchDirAll(lg, fs, dir)
 	if err == nil {
 		var ns []string
-		ns, err = ReadDir(dir)
+		ns, err = ReadDir(fs, dir)
 		if err != nil {
 			return err
 		}
@@ -82,14 +89,14 @@ func CreateDirAll(dir string) error {
 }
 
 // Exist returns true if a file or directory exists.
-func Exist(name string) bool {
-	_, err := os.Stat(name)
+func Exist(fs FS, name string) bool {
+	_, err := fs.Stat(name)
 	return err == nil
 }
 
 // ZeroToEnd zeros a file starting from SEEK_CUR to its SEEK_END. May temporarily
 // shorten the length of the file.
-func ZeroToEnd(f *os.File) error {
+func ZeroToEnd(fs FS, f File) error {
 	// TODO: support FALLOC_FL_ZERO_RANGE
 	off, err := f.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -103,7 +110,7 @@ func ZeroToEnd(f *os.File) error {
 		return err
 	}
 	// make sure blocks remain allocated
-	if err = Preallocate(f, lenf, true); err != nil {
+	if err = fs.Preallocate(f, lenf, true); err != nil {
 		return err
 	}
 	_, err = f.Seek(off, io.SeekStart)
@@ -112,12 +119,12 @@ func ZeroToEnd(f *os.File) error {
 
 // CheckDirPermission checks permission on an existing dir.
 // Returns error if dir is empty or exist with a different permission than specified.
-func CheckDirPermission(dir string, perm os.FileMode) error {
-	if !Exist(dir) {
+func CheckDirPermission(fs FS, dir string, perm os.FileMode) error {
+	if !Exist(fs, dir) {
 		return fmt.Errorf("directory %q empty, cannot check permission.", dir)
 	}
 	// check the existing permission on the directory
-	dirInfo, err := os.Stat(dir)
+	dirInfo, err := fs.Stat(dir)
 	if err != nil {
 		return err
 	}
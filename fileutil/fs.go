@@ -0,0 +1,63 @@
+package fileutil
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrNotOSFile is returned by the default FS when given a File it did not
+// open.
+var ErrNotOSFile = errors.New("fileutil: not an os file")
+
+// File is an open file of an FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// FS is the filesystem the WAL runs on. DefaultFS is the local filesystem.
+type FS interface {
+	// OpenFile opens the named file like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// OpenDir opens a directory for syncing.
+	OpenDir(path string) (File, error)
+	// Stat returns the FileInfo of the named file.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDirNames returns the names of the entries of the directory, in no
+	// particular order.
+	ReadDirNames(dir string) ([]string, error)
+	// MkdirAll creates a directory along with any necessary parents.
+	MkdirAll(path string, perm os.FileMode) error
+	// Rename renames oldpath to newpath, replacing newpath if it exists.
+	Rename(oldpath, newpath string) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// RemoveAll removes path and any children it contains.
+	RemoveAll(path string) error
+
+	// LockFile opens the named file and locks it exclusively, blocking while
+	// the lock is held by another open file; closing the file releases it.
+	LockFile(path string, flag int, perm os.FileMode) (*LockedFile, error)
+	// TryLockFile is like LockFile but fails with ErrLocked instead of
+	// blocking.
+	TryLockFile(path string, flag int, perm os.FileMode) (*LockedFile, error)
+	// Preallocate allocates the space for the first sizeInBytes bytes of f,
+	// extending its size if extendFile is set.
+	Preallocate(f File, sizeInBytes int64, extendFile bool) error
+
+	// Fsync syncs the data and the metadata of f, which may be a directory.
+	Fsync(f File) error
+	// Fdatasync syncs the data of f, and the metadata needed to read it.
+	Fdatasync(f File) error
+	// SyncFileRange writes back the dirty pages of f, without flushing its
+	// metadata nor the disk cache.
+	SyncFileRange(f File) error
+}
@@ -0,0 +1,97 @@
+// +build linux
+
+package fileutil
+
+import "os"
+
+// DefaultFS is the local filesystem, with open file descriptor locks when
+// the kernel supports them.
+var DefaultFS FS = osFS{}
+
+type osFS struct{}
+
+func osFile(f File) (*os.File, error) {
+	if lf, ok := f.(*LockedFile); ok {
+		f = lf.File
+	}
+	of, ok := f.(*os.File)
+	if !ok {
+		return nil, ErrNotOSFile
+	}
+	return of, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenDir(path string) (File, error) {
+	f, err := OpenDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+func (osFS) ReadDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (osFS) Remove(name string) error { return os.Remove(name) }
+
+func (osFS) RemoveAll(path string) error { return os.RemoveAll(path) }
+
+func (osFS) LockFile(path string, flag int, perm os.FileMode) (*LockedFile, error) {
+	return LockFile(path, flag, perm)
+}
+
+func (osFS) TryLockFile(path string, flag int, perm os.FileMode) (*LockedFile, error) {
+	return TryLockFile(path, flag, perm)
+}
+
+func (osFS) Preallocate(f File, sizeInBytes int64, extendFile bool) error {
+	of, err := osFile(f)
+	if err != nil {
+		return err
+	}
+	return Preallocate(of, sizeInBytes, extendFile)
+}
+
+func (osFS) Fsync(f File) error {
+	of, err := osFile(f)
+	if err != nil {
+		return err
+	}
+	return Fsync(of)
+}
+
+func (osFS) Fdatasync(f File) error {
+	of, err := osFile(f)
+	if err != nil {
+		return err
+	}
+	return Fdatasync(of)
+}
+
+func (osFS) SyncFileRange(f File) error {
+	of, err := osFile(f)
+	if err != nil {
+		return err
+	}
+	return SyncFileRange(of)
+}
@@ -14,13 +14,12 @@
 
 package fileutil
 
-import (
-	"errors"
-	"os"
-)
+import "errors"
 
 var (
 	ErrLocked = errors.New("fileutil: file already locked")
 )
 
-type LockedFile struct{ *os.File }
+// LockedFile is a file locked exclusively, see FS.LockFile. Closing it
+// releases the lock.
+type LockedFile struct{ File }
@@ -0,0 +1,599 @@
+package fileutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is an FS that keeps everything in memory. Open files refer to the
+// file itself rather than to its path, so they survive renames, and locks,
+// preallocation and truncation behave as on the local filesystem, so that
+// the WAL writes the same bytes as it does to disk. Syncing does nothing.
+type MemFS struct {
+	mu    sync.Mutex
+	cond  *sync.Cond // signaled when a lock is released
+	nodes map[string]*memNode
+	roots map[string]*memNode // "." and "/", created on first use
+	hooks memHooks
+}
+
+// memHooks observes the operations of a MemFS, see CrashFS. Its methods are
+// called with the MemFS mutex held.
+type memHooks interface {
+	// before is called before every operation, which fails with the returned
+	// error if it is not nil.
+	before(op string) error
+	// synced is called once the data and metadata of f are durable.
+	synced(f *memFile)
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	locked  bool
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	fs := &MemFS{nodes: make(map[string]*memNode), roots: make(map[string]*memNode)}
+	fs.cond = sync.NewCond(&fs.mu)
+	return fs
+}
+
+func memPath(name string) string { return filepath.Clean(name) }
+
+func isMemRoot(p string) bool { return p == "." || p == "/" }
+
+func memErr(op, path string, err error) error {
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// lookup returns the node at p, with the root directories always existing.
+// It must be called with fs.mu held.
+func (fs *MemFS) lookup(p string) (*memNode, bool) {
+	if isMemRoot(p) {
+		if fs.roots[p] == nil {
+			fs.roots[p] = &memNode{dir: true, mode: os.ModeDir | 0755}
+		}
+		return fs.roots[p], true
+	}
+	n, ok := fs.nodes[p]
+	return n, ok
+}
+
+// before runs the before hook of op, if any. It must be called with fs.mu
+// held.
+func (fs *MemFS) before(op string) error {
+	if fs.hooks == nil {
+		return nil
+	}
+	return fs.hooks.before(op)
+}
+
+// checkParent returns an error unless the parent directory of p exists.
+// It must be called with fs.mu held.
+func (fs *MemFS) checkParent(op, p string) error {
+	parent, ok := fs.lookup(filepath.Dir(p))
+	if !ok {
+		return memErr(op, p, syscall.ENOENT)
+	}
+	if !parent.dir {
+		return memErr(op, p, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// children returns the paths of the entries below the directory p, at any
+// depth. It must be called with fs.mu held.
+func (fs *MemFS) children(p string) []string {
+	prefix := p + string(filepath.Separator)
+	if p == string(filepath.Separator) {
+		prefix = p
+	}
+	var ps []string
+	for c := range fs.nodes {
+		if p == "." && !filepath.IsAbs(c) || p != "." && strings.HasPrefix(c, prefix) {
+			ps = append(ps, c)
+		}
+	}
+	return ps
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("open"); err != nil {
+		return nil, err
+	}
+	return fs.openFile(name, flag, perm)
+}
+
+func (fs *MemFS) openFile(name string, flag int, perm os.FileMode) (*memFile, error) {
+	p := memPath(name)
+	n, ok := fs.lookup(p)
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memErr("open", name, syscall.EEXIST)
+	case ok && n.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, memErr("open", name, syscall.EISDIR)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memErr("open", name, syscall.ENOENT)
+	case !ok:
+		if err := fs.checkParent("open", p); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm, modTime: time.Now()}
+		fs.nodes[p] = n
+	}
+	if flag&os.O_TRUNC != 0 && !n.dir {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &memFile{fs: fs, n: n, name: name, flag: flag}, nil
+}
+
+func (fs *MemFS) OpenDir(path string) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("open"); err != nil {
+		return nil, err
+	}
+	n, ok := fs.lookup(memPath(path))
+	if !ok {
+		return nil, memErr("open", path, syscall.ENOENT)
+	}
+	if !n.dir {
+		return nil, memErr("open", path, syscall.ENOTDIR)
+	}
+	return &memFile{fs: fs, n: n, name: path, flag: os.O_RDONLY}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("stat"); err != nil {
+		return nil, err
+	}
+	p := memPath(name)
+	n, ok := fs.lookup(p)
+	if !ok {
+		return nil, memErr("stat", name, syscall.ENOENT)
+	}
+	return n.info(filepath.Base(p)), nil
+}
+
+func (fs *MemFS) ReadDirNames(dir string) ([]string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("readdirent"); err != nil {
+		return nil, err
+	}
+	p := memPath(dir)
+	n, ok := fs.lookup(p)
+	if !ok {
+		return nil, memErr("open", dir, syscall.ENOENT)
+	}
+	if !n.dir {
+		return nil, memErr("readdirent", dir, syscall.ENOTDIR)
+	}
+	var names []string
+	for _, c := range fs.children(p) {
+		if filepath.Dir(c) == p {
+			names = append(names, filepath.Base(c))
+		}
+	}
+	return names, nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("mkdir"); err != nil {
+		return err
+	}
+	p := memPath(path)
+	var missing []string
+	for q := p; ; q = filepath.Dir(q) {
+		n, ok := fs.lookup(q)
+		if ok {
+			if !n.dir {
+				return memErr("mkdir", q, syscall.ENOTDIR)
+			}
+			break
+		}
+		missing = append(missing, q)
+	}
+	for _, q := range missing {
+		fs.nodes[q] = &memNode{dir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("rename"); err != nil {
+		return err
+	}
+	op, np := memPath(oldpath), memPath(newpath)
+	n, ok := fs.lookup(op)
+	if !ok || isMemRoot(op) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOENT}
+	}
+	if err := fs.checkParent("rename", np); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOENT}
+	}
+	if op == np {
+		return nil
+	}
+	if m, ok := fs.lookup(np); ok {
+		switch {
+		case n.dir && !m.dir:
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTDIR}
+		case !n.dir && m.dir:
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EISDIR}
+		case m.dir && len(fs.children(np)) > 0:
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if n.dir {
+		for _, c := range fs.children(op) {
+			fs.nodes[np+strings.TrimPrefix(c, op)] = fs.nodes[c]
+			delete(fs.nodes, c)
+		}
+	}
+	fs.nodes[np] = n
+	delete(fs.nodes, op)
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("remove"); err != nil {
+		return err
+	}
+	p := memPath(name)
+	n, ok := fs.lookup(p)
+	if !ok || isMemRoot(p) {
+		return memErr("remove", name, syscall.ENOENT)
+	}
+	if n.dir && len(fs.children(p)) > 0 {
+		return memErr("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("remove"); err != nil {
+		return err
+	}
+	p := memPath(path)
+	for _, c := range fs.children(p) {
+		delete(fs.nodes, c)
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+func (fs *MemFS) LockFile(path string, flag int, perm os.FileMode) (*LockedFile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("lock"); err != nil {
+		return nil, err
+	}
+	f, err := fs.openFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	for f.n.locked {
+		fs.cond.Wait()
+	}
+	f.n.locked, f.locked = true, true
+	return &LockedFile{f}, nil
+}
+
+func (fs *MemFS) TryLockFile(path string, flag int, perm os.FileMode) (*LockedFile, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.before("lock"); err != nil {
+		return nil, err
+	}
+	f, err := fs.openFile(path, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if f.n.locked {
+		return nil, ErrLocked
+	}
+	f.n.locked, f.locked = true, true
+	return &LockedFile{f}, nil
+}
+
+func (fs *MemFS) file(f File) (*memFile, error) {
+	if lf, ok := f.(*LockedFile); ok {
+		f = lf.File
+	}
+	mf, ok := f.(*memFile)
+	if !ok || mf.fs != fs {
+		return nil, syscall.EBADF
+	}
+	return mf, nil
+}
+
+func (fs *MemFS) Preallocate(f File, sizeInBytes int64, extendFile bool) error {
+	mf, err := fs.file(f)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err = fs.before("fallocate"); err != nil {
+		return err
+	}
+	if extendFile && sizeInBytes > int64(len(mf.n.data)) {
+		mf.n.grow(sizeInBytes)
+	}
+	return nil
+}
+
+func (fs *MemFS) Fsync(f File) error { return fs.sync("fsync", f, true) }
+
+func (fs *MemFS) Fdatasync(f File) error { return fs.sync("fdatasync", f, true) }
+
+// SyncFileRange only starts the writeback, it does not make anything durable.
+func (fs *MemFS) SyncFileRange(f File) error { return fs.sync("sync_file_range", f, false) }
+
+func (fs *MemFS) sync(op string, f File, durable bool) error {
+	mf, err := fs.file(f)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err = fs.before(op); err != nil {
+		return err
+	}
+	if durable && fs.hooks != nil {
+		fs.hooks.synced(mf)
+	}
+	return nil
+}
+
+// Dump writes the files below the directory src to the directory dst of the
+// local filesystem, creating it if needed.
+func (fs *MemFS) Dump(src, dst string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p := memPath(src)
+	if n, ok := fs.lookup(p); !ok || !n.dir {
+		return memErr("open", src, syscall.ENOTDIR)
+	}
+	if err := os.MkdirAll(dst, PrivateDirMode); err != nil {
+		return err
+	}
+	cs := fs.children(p)
+	sort.Strings(cs) // parents first
+	for _, c := range cs {
+		n := fs.nodes[c]
+		target := filepath.Join(dst, strings.TrimPrefix(c, p))
+		if n.dir {
+			if err := os.MkdirAll(target, n.mode.Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(target, n.data, n.mode.Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *memNode) grow(size int64) {
+	if size <= int64(cap(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, n.data)
+	n.data = data
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open file of a MemFS.
+type memFile struct {
+	fs     *MemFS
+	n      *memNode
+	name   string
+	flag   int
+	off    int64
+	locked bool // whether this file holds the lock of n
+	closed bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+// check returns an error if f is closed or cannot be used to write when
+// write is set. It must be called with f.fs.mu held.
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return memErr(op, f.name, os.ErrClosed)
+	}
+	if f.n.dir && op != "seek" && op != "close" && op != "stat" {
+		return memErr(op, f.name, syscall.EISDIR)
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return memErr(op, f.name, syscall.EBADF)
+	}
+	if !write && op == "read" && f.flag&os.O_WRONLY != 0 {
+		return memErr(op, f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("read"); err != nil {
+		return 0, err
+	}
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(b, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("read"); err != nil {
+		return 0, err
+	}
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(b, off)
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memFile) readAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(f.n.data)) {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(b, f.n.data[off:]), nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("write"); err != nil {
+		return 0, err
+	}
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.data))
+	}
+	if end := f.off + int64(len(b)); end > int64(len(f.n.data)) {
+		f.n.grow(end)
+	}
+	copy(f.n.data[f.off:], b)
+	f.off += int64(len(b))
+	f.n.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("seek"); err != nil {
+		return 0, err
+	}
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	default:
+		return 0, memErr("seek", f.name, syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, memErr("seek", f.name, syscall.EINVAL)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("stat"); err != nil {
+		return nil, err
+	}
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.n.info(filepath.Base(memPath(f.name))), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.fs.before("truncate"); err != nil {
+		return err
+	}
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return memErr("truncate", f.name, syscall.EINVAL)
+	}
+	if size > int64(len(f.n.data)) {
+		f.n.grow(size)
+	} else {
+		// zero the dropped bytes, they are visible again if the file grows
+		for i := range f.n.data[size:] {
+			f.n.data[size+int64(i)] = 0
+		}
+		f.n.data = f.n.data[:size]
+	}
+	f.n.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return memErr("close", f.name, os.ErrClosed)
+	}
+	f.closed = true
+	if f.locked {
+		f.n.locked, f.locked = false, false
+		f.fs.cond.Broadcast()
+	}
+	return nil
+}
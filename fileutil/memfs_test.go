@@ -0,0 +1,144 @@
+package fileutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemFSFiles(t *testing.T) {
+	fs := NewMemFS()
+	if err := fs.MkdirAll("/a/b", PrivateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("/a/c/f", os.O_CREATE|os.O_WRONLY, PrivateFileMode); err == nil {
+		t.Fatal("expected an error creating a file in a missing directory")
+	}
+
+	f, err := fs.OpenFile("/a/b/f.tmp", os.O_CREATE|os.O_RDWR, PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Preallocate(f, 16, true); err != nil {
+		t.Fatal(err)
+	}
+	// open files follow renames
+	if err = fs.Rename("/a/b/f.tmp", "/a/b/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Preallocate(f, 8, true); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	names, err := ReadDir(fs, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "f" {
+		t.Fatalf("names = %v, want [f]", names)
+	}
+	g, err := fs.OpenFile("/a/b/f", os.O_RDONLY, PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	b, err := ioutil.ReadAll(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := "he\x00\x00\x00\x00\x00\x00"; string(b) != w {
+		t.Fatalf("data = %q, want %q", b, w)
+	}
+	if _, err = g.ReadAt(make([]byte, 1), 8); err != io.EOF {
+		t.Fatalf("err = %v, want %v", err, io.EOF)
+	}
+
+	// directories move with their entries
+	if err = fs.Rename("/a/b", "/a/d"); err != nil {
+		t.Fatal(err)
+	}
+	if !Exist(fs, "/a/d/f") || Exist(fs, "/a/b/f") {
+		t.Fatal("expected /a/b/f to be moved to /a/d/f")
+	}
+	if err = fs.Remove("/a"); err == nil {
+		t.Fatal("expected an error removing a non-empty directory")
+	}
+	if err = fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if Exist(fs, "/a/d/f") {
+		t.Fatal("expected /a/d/f to be removed")
+	}
+}
+
+func TestMemFSLock(t *testing.T) {
+	fs := NewMemFS()
+	l, err := fs.LockFile("f", os.O_CREATE|os.O_WRONLY, PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.TryLockFile("f", os.O_WRONLY, PrivateFileMode); err != ErrLocked {
+		t.Fatalf("err = %v, want %v", err, ErrLocked)
+	}
+
+	lockc := make(chan *LockedFile)
+	go func() {
+		l2, err := fs.LockFile("f", os.O_WRONLY, PrivateFileMode)
+		if err != nil {
+			t.Error(err)
+		}
+		lockc <- l2
+	}()
+	select {
+	case <-lockc:
+		t.Fatal("lock acquired while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.Close()
+	select {
+	case l2 := <-lockc:
+		l2.Close()
+	case <-time.After(time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+}
+
+func TestMemFSDump(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "fileutiltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewMemFS()
+	if err = fs.MkdirAll("/data/sub", PrivateDirMode); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile("/data/sub/f", os.O_CREATE|os.O_WRONLY, PrivateFileMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+
+	if err = fs.Dump("/data", dir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "sub", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data" {
+		t.Fatalf("data = %q, want %q", b, "data")
+	}
+}
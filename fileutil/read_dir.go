@@ -15,7 +15,6 @@
 package fileutil
 
 import (
-	"os"
 	"path/filepath"
 	"sort"
 )
@@ -41,17 +40,11 @@ func (op *ReadDirOp) applyOpts(opts []ReadDirOption) {
 }
 
 // ReadDir returns the filenames in the given directory in sorted order.
-func ReadDir(d string, opts ...ReadDirOption) ([]string, error) {
+func ReadDir(fs FS, d string, opts ...ReadDirOption) ([]string, error) {
 	op := &ReadDirOp{}
 	op.applyOpts(opts)
 
-	dir, err := os.Open(d)
-	if err != nil {
-		return nil, err
-	}
-	defer dir.Close()
-
-	names, err := dir.Readdirnames(-1)
+	names, err := fs.ReadDirNames(d)
 	if err != nil {
 		return nil, err
 	}
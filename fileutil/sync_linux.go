@@ -19,8 +19,14 @@ package fileutil
 import (
 	"os"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
+// O_DSYNC makes every write to a file synchronous, like a write followed by
+// Fdatasync.
+const O_DSYNC = syscall.O_DSYNC
+
 // Fsync is a wrapper around file.Sync(). Special handling is needed on darwin platform.
 func Fsync(f *os.File) error {
 	return f.Sync()
@@ -32,3 +38,11 @@ func Fsync(f *os.File) error {
 func Fdatasync(f *os.File) error {
 	return syscall.Fdatasync(int(f.Fd()))
 }
+
+// SyncFileRange starts and waits for the write-out of all the dirty pages of
+// the file. Unlike Fdatasync, it neither flushes the metadata nor the disk
+// cache, so the data may still be lost on power failure.
+func SyncFileRange(f *os.File) error {
+	return unix.SyncFileRange(int(f.Fd()), 0, 0,
+		unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+}
@@ -0,0 +1,290 @@
+package wal
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// position is a location inside the WAL directory.
+type position struct {
+	seq uint64 // sequence of the segment file
+	off int64  // byte offset inside the segment file
+}
+
+// markDurable publishes the end of the tail as durable and wakes up followers.
+// It must be called with w.mu held, after the tail was flushed and synced.
+func (w *WAL) markDurable() {
+	tail := w.tail()
+	if tail == nil {
+		return
+	}
+	seq, _, err := parseWALName(filepath.Base(tail.Name()))
+	if err != nil {
+		// the tail is still a temporary file during cut
+		return
+	}
+	off, err := tail.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	w.durable = position{seq: seq, off: off}
+	w.durablei = w.enti
+	if w.durablec != nil {
+		close(w.durablec)
+	}
+	w.durablec = make(chan struct{})
+}
+
+// markClosed wakes up followers so that they notice the WAL is closed.
+func (w *WAL) markClosed() {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	if w.durablec != nil {
+		close(w.durablec)
+	}
+	w.durablec = make(chan struct{})
+}
+
+// truncation records where the WAL was last truncated by TruncateSuffix.
+type truncation struct {
+	gen uint64   // number of truncations so far
+	pos position // truncation point
+	crc uint64   // crc chained up to pos
+}
+
+// markTruncated publishes a suffix truncation at pos, the record of the entry
+// following index. Everything before pos is durable. It must be called with
+// w.mu held.
+func (w *WAL) markTruncated(index uint64, pos position, crc uint64) {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	w.trunc = truncation{gen: w.trunc.gen + 1, pos: pos, crc: crc}
+	w.durable = pos
+	w.durablei = index
+	if w.durablec != nil {
+		close(w.durablec)
+	}
+	w.durablec = make(chan struct{})
+}
+
+// lastTruncation returns the last suffix truncation.
+func (w *WAL) lastTruncation() truncation {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	return w.trunc
+}
+
+// durablePosition returns the durable position, whether the WAL is closed
+// and a channel that is closed once either of them changes.
+func (w *WAL) durablePosition() (position, bool, <-chan struct{}) {
+	w.dmu.Lock()
+	defer w.dmu.Unlock()
+	return w.durable, w.closed, w.durablec
+}
+
+// Follower streams the entries of a live WAL, see WAL.Follow.
+type Follower struct {
+	w    *WAL
+	from uint64
+
+	seq uint64        // sequence of the segment being read
+	f   fileutil.File // the segment being read
+	off int64         // offset of the next record in f
+	crc uint64        // crc chained up to off
+	gen uint64        // generation of the last truncation seen
+
+	entc chan *walpb.Entry
+	err  error
+}
+
+// Follow returns a Follower that delivers every entry with an index equal to
+// or larger than fromIndex as soon as it is durable. It first reads the
+// history from the segment files, then waits for Save to make new entries
+// durable, following the WAL across segment cuts.
+//
+// Entries are delivered in log order, one at a time; a slow consumer holds
+// the follower back but never blocks Save. When raft rewrote a conflicting
+// suffix, or after TruncateSuffix, an entry whose index is not larger than
+// the previous one is delivered and the consumer must drop everything it
+// holds from that index on.
+//
+// The follower stops when ctx is done, when the WAL is closed, or on a read
+// error; Entries is then closed and Err reports why.
+// The WAL must be in append mode.
+func (w *WAL) Follow(ctx context.Context, fromIndex uint64) (*Follower, error) {
+	w.mu.Lock()
+	appending := w.encoder != nil && w.tail() != nil
+	w.mu.Unlock()
+	if !appending {
+		return nil, ErrNotAppendMode
+	}
+
+	names, err := readWALNames(w.opts, w.dir)
+	if err != nil {
+		return nil, err
+	}
+	nameIndex, ok, err := searchIndex(names, fromIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	seq, _, err := parseWALName(names[nameIndex])
+	if err != nil {
+		return nil, err
+	}
+	f, err := w.opts.fs.OpenFile(filepath.Join(w.dir, names[nameIndex]), os.O_RDONLY, w.opts.filePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := &Follower{
+		w:    w,
+		from: fromIndex,
+		seq:  seq,
+		f:    f,
+		gen:  w.lastTruncation().gen,
+		entc: make(chan *walpb.Entry),
+	}
+	go fl.run(ctx)
+	return fl, nil
+}
+
+// Entries returns the channel the entries are delivered on. It is closed
+// when the follower stops.
+func (fl *Follower) Entries() <-chan *walpb.Entry { return fl.entc }
+
+// Err returns the reason the follower stopped. It is only valid after
+// Entries has been closed.
+func (fl *Follower) Err() error { return fl.err }
+
+func (fl *Follower) run(ctx context.Context) {
+	defer close(fl.entc)
+	defer func() { fl.f.Close() }()
+
+	for {
+		durable, closed, notifyc := fl.w.durablePosition()
+		if err := fl.rewind(); err != nil {
+			fl.err = err
+			return
+		}
+		var limit int64 = -1
+		if fl.seq == durable.seq {
+			limit = durable.off
+		}
+		if err := fl.read(ctx, limit); err != nil {
+			fl.err = err
+			return
+		}
+		if fl.seq < durable.seq {
+			// the segment was sealed by cut and fully read; move on
+			if err := fl.next(); err != nil {
+				if fl.w.lastTruncation().gen != fl.gen {
+					// the segment was removed by TruncateSuffix
+					continue
+				}
+				fl.err = err
+				return
+			}
+			continue
+		}
+		if closed {
+			fl.err = ErrClosed
+			return
+		}
+		select {
+		case <-notifyc:
+		case <-ctx.Done():
+			fl.err = ctx.Err()
+			return
+		}
+	}
+}
+
+// read delivers the records of the current segment between fl.off and limit.
+// A negative limit reads up to the end of the segment.
+func (fl *Follower) read(ctx context.Context, limit int64) error {
+	var err error
+	fl.off, fl.crc, err = scanSegment(fl.w.opts, fl.f, fl.seq, fl.off, limit, fl.crc, func(rec *walpb.Record, _ position) (bool, error) {
+		if rec.GetType() != walpb.RecordType_EntryType {
+			return true, nil
+		}
+		ent := &walpb.Entry{}
+		if err := proto.Unmarshal(rec.GetData(), ent); err != nil {
+			return false, err
+		}
+		if ent.Index < fl.from {
+			return true, nil
+		}
+		select {
+		case fl.entc <- ent:
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	})
+	return err
+}
+
+// rewind moves the follower back to the truncation point if the WAL was
+// truncated before the current position since the last call.
+func (fl *Follower) rewind() error {
+	t := fl.w.lastTruncation()
+	if t.gen == fl.gen {
+		return nil
+	}
+	fl.gen = t.gen
+	if !t.pos.less(position{seq: fl.seq, off: fl.off}) {
+		return nil
+	}
+	if t.pos.seq != fl.seq {
+		if err := fl.open(t.pos.seq); err != nil {
+			return err
+		}
+	}
+	fl.off, fl.crc = t.pos.off, t.crc
+	return nil
+}
+
+// next switches to the segment following the current one.
+func (fl *Follower) next() error {
+	if err := fl.open(fl.seq + 1); err != nil {
+		return err
+	}
+	fl.off = 0
+	return nil
+}
+
+// open switches to the segment with sequence seq.
+func (fl *Follower) open(seq uint64) error {
+	seqNames, err := readWALSeqNames(fl.w.opts, fl.w.dir)
+	if err != nil {
+		return err
+	}
+	name, ok := seqNames[seq]
+	if !ok {
+		return ErrFileNotFound
+	}
+	f, err := fl.w.opts.fs.OpenFile(filepath.Join(fl.w.dir, name), os.O_RDONLY, fl.w.opts.filePerm)
+	if err != nil {
+		return err
+	}
+	fl.f.Close()
+	fl.f, fl.seq = f, seq
+	return nil
+}
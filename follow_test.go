@@ -0,0 +1,99 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestFollow(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(1024))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	data := make([]byte, 100)
+	// history to be read from the segment files
+	for i := 1; i <= 10; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fl, err := w.Follow(ctx, 5)
+	assert.Empty(t, err)
+
+	// live entries, crossing several segment cuts
+	go func() {
+		for i := 11; i <= 40; i++ {
+			if err := w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1, Data: data}}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 5; i <= 40; i++ {
+		select {
+		case ent := <-fl.Entries():
+			assert.Equal(t, uint64(i), ent.Index)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for entry %d", i)
+		}
+	}
+	seq, err := w.seq()
+	assert.Empty(t, err)
+	assert.True(t, seq > 1)
+
+	cancel()
+	for range fl.Entries() {
+	}
+	assert.Equal(t, context.Canceled, fl.Err())
+}
+
+func TestFollowClose(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 1, Term: 1}})
+	assert.Empty(t, err)
+
+	fl, err := w.Follow(context.Background(), 1)
+	assert.Empty(t, err)
+	ent := <-fl.Entries()
+	assert.Equal(t, uint64(1), ent.Index)
+
+	w.Close()
+	for range fl.Entries() {
+	}
+	assert.Equal(t, ErrClosed, fl.Err())
+}
+
+func TestFollowNotAppendMode(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, err = w.Follow(context.Background(), 0)
+	assert.Equal(t, ErrNotAppendMode, err)
+}
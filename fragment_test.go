@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestSaveMaxRecordBytes(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	w, err := Create(p, []byte("metadata"), WithMaxRecordBytes(4096))
+	assert.Empty(t, err)
+	// nothing of a save with an oversized entry is written
+	err = w.Save(&walpb.HardState{Term: 1, Commit: 1}, []walpb.Entry{
+		{Index: 1, Term: 1, Data: []byte("small")},
+		{Index: 2, Term: 1, Data: make([]byte, 8000)},
+	})
+	assert.Equal(t, ErrMaxWALEntrySizeLimitExceeded, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: []byte("small")}}))
+	// a record only made too large by its framing is not chained either
+	w.mu.Lock()
+	err = w.encoder.encode(&walpb.Record{Type: walpb.RecordType_EntryType, Data: make([]byte, 4090)})
+	w.mu.Unlock()
+	assert.Equal(t, ErrMaxWALEntrySizeLimitExceeded, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 2, Term: 1, Data: []byte("small")}}))
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{}, WithMaxRecordBytes(4096))
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(ents))
+}
+
+func TestFragmentation(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	_, err = Create(p, []byte("metadata"), WithMaxRecordBytes(4096), WithFragmentation(4000))
+	assert.NotEmpty(t, err)
+	opts := []Option{WithMaxRecordBytes(4096), WithFragmentation(1000), WithSegmentSizeBytes(16 * 1024)}
+	w, err := Create(p, []byte("metadata"), opts...)
+	assert.Empty(t, err)
+	sizes := []int{10, 1000, 1001, 3000, 20000, 10}
+	for i, n := range sizes {
+		data := bytes.Repeat([]byte{byte(i + 1)}, n)
+		err = w.Save(&walpb.HardState{Term: 1, Commit: uint64(i + 1)}, []walpb.Entry{{Index: uint64(i + 1), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{}, opts...)
+	assert.Empty(t, err)
+	_, st, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(len(sizes)), st.Commit)
+	assert.Equal(t, len(sizes), len(ents))
+	for i, e := range ents {
+		assert.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, sizes[i]), e.Data, "#%d", i)
+	}
+	assert.Empty(t, w.Close())
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}))
+
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 1)
+	for _, s := range segs {
+		assert.Equal(t, FeatureFragmentation, s.Header.RequiredFeatures)
+	}
+	_, offs, _ := entryOffsets(t, p)
+	assert.Equal(t, len(sizes), len(offs))
+}
+
+func TestFragmentationTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	w, err := Create(p, []byte("metadata"), WithFragmentation(1000))
+	assert.Empty(t, err)
+	for i := 1; i <= 3; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: make([]byte, 5000)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	// zero the fragments following the first one of the last entry
+	paths, offs, _ := entryOffsets(t, p)
+	last, off := paths[len(paths)-1], offs[len(offs)-1]
+	b, err := ioutil.ReadFile(last)
+	assert.Empty(t, err)
+	recBytes, padBytes := decodeFrameSize(int64(binary.LittleEndian.Uint64(b[off:])))
+	next := off + frameSizeBytes + recBytes + padBytes
+	writeAt(t, last, next, make([]byte, 8000))
+	_, err = readAllEntries(t, p)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// the whole entry is dropped
+	r, err := Repair(p, false)
+	assert.Empty(t, err)
+	assert.Equal(t, off, r.Offset)
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(ents))
+}
+
+func TestFragmentSequence(t *testing.T) {
+	first := walpb.FragmentType_FirstFragment
+	middle := walpb.FragmentType_MiddleFragment
+	last := walpb.FragmentType_LastFragment
+	tests := []struct {
+		frags []walpb.FragmentType
+		data  string
+		err   error
+	}{
+		{[]walpb.FragmentType{first, last}, "01", nil},
+		{[]walpb.FragmentType{first, middle, middle, last}, "0123", nil},
+		{[]walpb.FragmentType{first}, "", io.ErrUnexpectedEOF},
+		{[]walpb.FragmentType{first, middle}, "", io.ErrUnexpectedEOF},
+		{[]walpb.FragmentType{middle, last}, "", ErrFragmentSequence},
+		{[]walpb.FragmentType{last}, "", ErrFragmentSequence},
+		{[]walpb.FragmentType{first, first, last}, "", ErrFragmentSequence},
+		{[]walpb.FragmentType{first, walpb.FragmentType_NoFragment}, "", ErrFragmentSequence},
+	}
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		enc := newEncoder(&buf, 0, 0, newOptions(nil))
+		for j, frag := range tt.frags {
+			rec := &walpb.Record{Type: walpb.RecordType_EntryType, Data: []byte{'0' + byte(j)}, Fragment: frag}
+			assert.Empty(t, enc.encode(rec))
+		}
+		assert.Empty(t, enc.flush())
+
+		d := newDecoder(newOptions(nil), &buf)
+		rec := &walpb.Record{}
+		err := d.decode(rec)
+		assert.True(t, errors.Is(err, tt.err), "#%d: %v", i, err)
+		if tt.err == nil {
+			assert.Equal(t, tt.data, string(rec.Data), "#%d", i)
+			assert.Equal(t, walpb.FragmentType_NoFragment, rec.Fragment, "#%d", i)
+			assert.Equal(t, int64(0), d.lastRecOff, "#%d", i)
+			assert.Equal(t, io.EOF, d.decode(rec), "#%d", i)
+		}
+	}
+}
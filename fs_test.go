@@ -0,0 +1,175 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// rootFS serves the paths of the local filesystem below root, so that a WAL
+// only works on it if every file operation goes through the FS.
+type rootFS struct {
+	root string
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+type rootFile struct {
+	fileutil.File
+	name string
+}
+
+func (f *rootFile) Name() string { return f.name }
+
+func (fs *rootFS) path(name string) string { return filepath.Join(fs.root, name) }
+
+func (fs *rootFS) count(op string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.calls[op]++
+}
+
+func (fs *rootFS) called(op string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.calls[op]
+}
+
+func (fs *rootFS) file(f fileutil.File, name string) fileutil.File {
+	return &rootFile{File: f, name: name}
+}
+
+func (fs *rootFS) unwrap(f fileutil.File) fileutil.File {
+	if lf, ok := f.(*fileutil.LockedFile); ok {
+		f = lf.File
+	}
+	return f.(*rootFile).File
+}
+
+func (fs *rootFS) OpenFile(name string, flag int, perm os.FileMode) (fileutil.File, error) {
+	f, err := fileutil.DefaultFS.OpenFile(fs.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fs.file(f, name), nil
+}
+
+func (fs *rootFS) OpenDir(path string) (fileutil.File, error) {
+	f, err := fileutil.DefaultFS.OpenDir(fs.path(path))
+	if err != nil {
+		return nil, err
+	}
+	return fs.file(f, path), nil
+}
+
+func (fs *rootFS) Stat(name string) (os.FileInfo, error) {
+	return fileutil.DefaultFS.Stat(fs.path(name))
+}
+
+func (fs *rootFS) ReadDirNames(dir string) ([]string, error) {
+	return fileutil.DefaultFS.ReadDirNames(fs.path(dir))
+}
+
+func (fs *rootFS) MkdirAll(path string, perm os.FileMode) error {
+	return fileutil.DefaultFS.MkdirAll(fs.path(path), perm)
+}
+
+func (fs *rootFS) Rename(oldpath, newpath string) error {
+	fs.count("rename")
+	return fileutil.DefaultFS.Rename(fs.path(oldpath), fs.path(newpath))
+}
+
+func (fs *rootFS) Remove(name string) error {
+	return fileutil.DefaultFS.Remove(fs.path(name))
+}
+
+func (fs *rootFS) RemoveAll(path string) error {
+	return fileutil.DefaultFS.RemoveAll(fs.path(path))
+}
+
+func (fs *rootFS) LockFile(path string, flag int, perm os.FileMode) (*fileutil.LockedFile, error) {
+	fs.count("lock")
+	l, err := fileutil.DefaultFS.LockFile(fs.path(path), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fileutil.LockedFile{File: fs.file(l.File, path)}, nil
+}
+
+func (fs *rootFS) TryLockFile(path string, flag int, perm os.FileMode) (*fileutil.LockedFile, error) {
+	fs.count("lock")
+	l, err := fileutil.DefaultFS.TryLockFile(fs.path(path), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fileutil.LockedFile{File: fs.file(l.File, path)}, nil
+}
+
+func (fs *rootFS) Preallocate(f fileutil.File, sizeInBytes int64, extendFile bool) error {
+	fs.count("preallocate")
+	return fileutil.DefaultFS.Preallocate(fs.unwrap(f), sizeInBytes, extendFile)
+}
+
+func (fs *rootFS) Fsync(f fileutil.File) error {
+	fs.count("fsync")
+	return fileutil.DefaultFS.Fsync(fs.unwrap(f))
+}
+
+func (fs *rootFS) Fdatasync(f fileutil.File) error {
+	fs.count("fdatasync")
+	return fileutil.DefaultFS.Fdatasync(fs.unwrap(f))
+}
+
+func (fs *rootFS) SyncFileRange(f fileutil.File) error {
+	fs.count("sync_file_range")
+	return fileutil.DefaultFS.SyncFileRange(fs.unwrap(f))
+}
+
+func TestFS(t *testing.T) {
+	root, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(root)
+
+	fs := &rootFS{root: root, calls: make(map[string]int)}
+	// the WAL directory only exists below root
+	p := "/wal"
+	opts := []Option{WithFS(fs), WithSegmentSizeBytes(1024)}
+	w, err := Create(p, []byte("metadata"), opts...)
+	assert.Empty(t, err)
+	data := make([]byte, 100)
+	for i := 1; i <= 20; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	err = w.TruncateSuffix(15)
+	assert.Empty(t, err)
+	w.Close()
+
+	names, err := fileutil.ReadDir(fileutil.DefaultFS, filepath.Join(root, p))
+	assert.Empty(t, err)
+	assert.NotEmpty(t, names)
+	for _, name := range names {
+		assert.True(t, strings.HasSuffix(name, ".wal") || strings.HasSuffix(name, ".tmp"), name)
+	}
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}, opts...))
+
+	w, err = Open(p, &walpb.Snapshot{}, opts...)
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 15, len(ents))
+
+	for _, op := range []string{"rename", "lock", "preallocate", "fsync", "fdatasync"} {
+		assert.True(t, fs.called(op) > 0, op)
+	}
+}
@@ -0,0 +1,214 @@
+package wal
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// saveReq is a save waiting for the writer goroutine.
+type saveReq struct {
+	st      *walpb.HardState
+	ents    []walpb.Entry
+	barrier bool // sync regardless of the sync policy, see Sync
+	f       *SaveFuture
+	start   time.Time // when the save was queued
+	err     error     // why the save was left out of its batch, see commit
+}
+
+// writer owns the queue of saves. A dedicated goroutine, started by the
+// first save, takes every queued save at once, encodes the batch and makes
+// it durable with a single sync, so that concurrent saves are committed
+// together. It also runs the background syncs of the sync policy.
+type writer struct {
+	mu      sync.Mutex
+	pending []*saveReq
+	started bool
+	closed  bool
+	notifyc chan struct{} // signals new saves or close to the goroutine
+	donec   chan struct{} // closed when the goroutine exits
+}
+
+// enqueue queues req, starting the writer goroutine if needed. It returns
+// false if the WAL is closed.
+func (w *WAL) enqueue(req *saveReq) bool {
+	w.wr.mu.Lock()
+	defer w.wr.mu.Unlock()
+	if w.wr.closed {
+		return false
+	}
+	if !w.wr.started {
+		w.wr.started = true
+		w.wr.notifyc = make(chan struct{}, 1)
+		w.wr.donec = make(chan struct{})
+		go w.runWriter()
+	}
+	w.wr.pending = append(w.wr.pending, req)
+	w.wr.notify()
+	return true
+}
+
+// dequeue withdraws the save of f from the queue, completing f with err. It
+// reports whether the save was withdrawn, in which case none of it is
+// written. A save is only withdrawn while no save queued after it may depend
+// on its entries.
+func (w *WAL) dequeue(f *SaveFuture, err error) bool {
+	w.wr.mu.Lock()
+	defer w.wr.mu.Unlock()
+	for i, req := range w.wr.pending {
+		if req.f != f {
+			continue
+		}
+		if !req.barrier {
+			for _, later := range w.wr.pending[i+1:] {
+				if !later.barrier {
+					return false
+				}
+			}
+		}
+		w.wr.pending = append(w.wr.pending[:i], w.wr.pending[i+1:]...)
+		f.resolve(err)
+		return true
+	}
+	return false
+}
+
+func (wr *writer) notify() {
+	select {
+	case wr.notifyc <- struct{}{}:
+	default:
+	}
+}
+
+// stopWriter commits the queued saves and stops the writer goroutine.
+func (w *WAL) stopWriter() {
+	w.wr.mu.Lock()
+	if w.wr.closed {
+		w.wr.mu.Unlock()
+		return
+	}
+	w.wr.closed = true
+	started := w.wr.started
+	if started {
+		w.wr.notify()
+	}
+	w.wr.mu.Unlock()
+	if started {
+		<-w.wr.donec
+	}
+}
+
+func (w *WAL) runWriter() {
+	defer close(w.wr.donec)
+
+	var tickc <-chan time.Time
+	if d := w.backgroundSyncInterval(); d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		tickc = ticker.C
+	}
+	for {
+		select {
+		case <-w.wr.notifyc:
+		case <-tickc:
+			w.backgroundSync()
+			continue
+		}
+
+		w.wr.mu.Lock()
+		closed := w.wr.closed
+		w.wr.mu.Unlock()
+		if !closed && w.opts.groupCommitWindow > 0 {
+			// let more saves join the batch
+			time.Sleep(w.opts.groupCommitWindow)
+		}
+
+		w.wr.mu.Lock()
+		batch := w.wr.pending
+		w.wr.pending = nil
+		w.wr.mu.Unlock()
+		if len(batch) > 0 {
+			err := w.commit(batch)
+			for _, req := range batch {
+				if req.err != nil {
+					req.f.resolve(req.err)
+				} else {
+					req.f.resolve(err)
+				}
+				if !req.barrier {
+					w.opts.metrics.ObserveSave(time.Since(req.start))
+				}
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// commit encodes a batch of saves and makes it durable with a single sync.
+// Each save is written as a whole or not at all: one that cannot be encoded
+// is left out, as are the saves after it in the batch, which may depend on
+// its entries, and its error is kept in the request. A write error fails
+// the whole batch.
+func (w *WAL) commit(batch []*saveReq) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.werr != nil {
+		return w.werr
+	}
+	if w.encoder == nil || w.tail() == nil {
+		return ErrNotAppendMode
+	}
+
+	mustSync, barrier, entries := false, false, 0
+	off := w.encoder.off
+	var failed error
+	for _, req := range batch {
+		if req.barrier {
+			barrier = true
+			continue
+		}
+		if failed != nil {
+			req.err = failed
+			continue
+		}
+		needSync := w.needSync(req.st, len(req.ents))
+		w.encoder.begin()
+		apply, err := w.saveEntries(req.st, req.ents)
+		if err != nil {
+			w.encoder.rollback()
+			failed, req.err = err, err
+			continue
+		}
+		if err = w.encoder.commit(); err != nil {
+			return w.fail(err)
+		}
+		apply()
+		entries += len(req.ents)
+		mustSync = mustSync || needSync
+	}
+
+	w.opts.metrics.ObserveBatch(entries)
+	w.opts.metrics.SetUnsyncedBytes(atomic.AddInt64(&w.unsynced, w.encoder.off-off))
+
+	curOff, err := w.tail().Seek(0, io.SeekCurrent)
+	if err != nil {
+		return w.fail(err)
+	}
+	if curOff < w.opts.segmentSizeBytes {
+		if barrier {
+			return w.fail(w.fullSync())
+		}
+		if mustSync && w.opts.syncPolicy.ShouldSync(w.UnsyncedBytes(), time.Since(w.lastSync)) {
+			return w.fail(w.sync())
+		}
+		return nil
+	}
+
+	return w.fail(w.cut())
+}
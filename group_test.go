@@ -0,0 +1,98 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestSaveConcurrent(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommitWindow(time.Millisecond))
+	assert.Empty(t, err)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Empty(t, w.Save(&walpb.HardState{Term: 1, Vote: uint64(i)}, nil))
+		}(i)
+	}
+	wg.Wait()
+	// entries saved in order after the concurrent states
+	err = w.Save(&walpb.HardState{Term: 2, Vote: 1}, []walpb.Entry{{Index: 1, Term: 2}, {Index: 2, Term: 2}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(2), state.Term)
+	assert.Equal(t, 2, len(ents))
+}
+
+// failingCodec stores records raw, but fails on those holding "bad".
+type failingCodec struct{}
+
+var errBadRecord = errors.New("bad record")
+
+func (failingCodec) ID() uint32 { return 16 }
+
+func (failingCodec) Compress(data []byte) ([]byte, error) {
+	if bytes.Contains(data, []byte("bad")) {
+		return nil, errBadRecord
+	}
+	return data, nil
+}
+
+func (failingCodec) Decompress(data []byte) ([]byte, error) { return data, nil }
+
+func TestCommitFailedSave(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithGroupCommitWindow(50*time.Millisecond), WithCompression(failingCodec{}, 0))
+	assert.Empty(t, err)
+	ent := func(i uint64, data string) walpb.Entry {
+		return walpb.Entry{Index: i, Term: 1, Data: []byte(data)}
+	}
+	// the second save fails after its first entry was encoded; the third
+	// depends on it
+	f1 := w.SaveAsync(nil, []walpb.Entry{ent(1, "ok"), ent(2, "ok")})
+	f2 := w.SaveAsync(&walpb.HardState{Term: 1, Commit: 4}, []walpb.Entry{ent(3, "ok"), ent(4, "bad")})
+	f3 := w.SaveAsync(nil, []walpb.Entry{ent(5, "ok")})
+	assert.Empty(t, f1.Wait())
+	assert.Equal(t, errBadRecord, f2.Wait())
+	assert.Equal(t, errBadRecord, f3.Wait())
+	assert.Equal(t, uint64(2), w.enti)
+	assert.Equal(t, uint64(2), w.DurableIndex())
+	assert.True(t, isEmptyHardState(w.state))
+
+	assert.Empty(t, w.Save(&walpb.HardState{Term: 1, Commit: 3}, []walpb.Entry{ent(3, "ok again")}))
+	assert.Empty(t, w.Close())
+
+	w, err = Open(p, &walpb.Snapshot{}, WithCodecs(failingCodec{}))
+	assert.Empty(t, err)
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(3), state.Commit)
+	assert.Equal(t, 3, len(ents))
+	assert.Equal(t, []byte("ok again"), ents[2].Data)
+	assert.Equal(t, uint64(0), w.ReplacedEntries())
+}
@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// FormatVersion is the version of the segment format written. Segments
+// without a header record are of version 0.
+const FormatVersion = 1
+
+// Features of a segment, flagged in its header.
+const (
+	// FeatureCompression marks segments written with compression, whose
+	// records may carry a codec ID.
+	FeatureCompression uint64 = 1 << iota
+	// FeatureEncryption marks segments written with encryption, whose
+	// records may carry a key ID.
+	FeatureEncryption
+	// FeatureFragmentation marks segments written with fragmentation, whose
+	// large records may be split into fragments.
+	FeatureFragmentation
+
+	knownFeatures = FeatureCompression | FeatureEncryption | FeatureFragmentation
+)
+
+const modulePath = "github.com/amazingchow/photon-dance-wal"
+
+// writerVersion identifies this implementation in the segment headers, with
+// the module version it was built from if known.
+var writerVersion = func() string {
+	version := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, m := range append(bi.Deps, &bi.Main) {
+			if m.Path == modulePath && m.Version != "" {
+				version = m.Version
+			}
+		}
+	}
+	return "photon-dance-wal " + version
+}()
+
+// newSegmentHeader returns the header of the segments written with opts.
+func newSegmentHeader(opts *Options) *walpb.SegmentHeader {
+	h := &walpb.SegmentHeader{
+		FormatVersion: FormatVersion,
+		Checksum:      opts.checksum,
+		PageBytes:     uint32(opts.pageBytes),
+		WriterVersion: writerVersion,
+	}
+	if opts.codec != nil {
+		h.RequiredFeatures |= FeatureCompression
+	}
+	if opts.keys != nil {
+		h.RequiredFeatures |= FeatureEncryption
+	}
+	if opts.fragmentBytes > 0 {
+		h.RequiredFeatures |= FeatureFragmentation
+	}
+	return h
+}
+
+// checkSegmentHeader returns ErrUnsupportedSegment if the segment with
+// header h cannot be read by this version. A nil h is for a segment of
+// format version 0.
+func checkSegmentHeader(name string, h *walpb.SegmentHeader) error {
+	if h == nil {
+		return nil
+	}
+	if h.FormatVersion > FormatVersion {
+		return fmt.Errorf("%w: %s has format version %d, %s reads up to %d", ErrUnsupportedSegment, name, h.FormatVersion, writerVersion, FormatVersion)
+	}
+	if _, ok := checksums[h.Checksum]; !ok {
+		return fmt.Errorf("%w: %s has checksum %v", ErrUnsupportedSegment, name, h.Checksum)
+	}
+	if unknown := h.RequiredFeatures &^ knownFeatures; unknown != 0 {
+		return fmt.Errorf("%w: %s requires features %#x", ErrUnsupportedSegment, name, unknown)
+	}
+	return nil
+}
+
+// readSegmentHeader returns the header of the segment f, nil if it has none.
+// A segment that cannot be decoded up to its header is left to the readers
+// of its records.
+func readSegmentHeader(opts *Options, f io.ReaderAt) (*walpb.SegmentHeader, error) {
+	d := newDecoder(opts, io.NewSectionReader(f, 0, math.MaxInt64))
+	// the header is checked once its checksum is known
+	d.unverified = true
+	rec := &walpb.Record{}
+	if err := d.decode(rec); err != nil || rec.Type != walpb.RecordType_CrcType {
+		return nil, nil
+	}
+	d.updateCRC(rec.Crc)
+	if err := d.decode(rec); err != nil || rec.Type != walpb.RecordType_HeaderType {
+		return nil, nil
+	}
+	h := &walpb.SegmentHeader{}
+	if err := proto.Unmarshal(rec.Data, h); err != nil {
+		return nil, fmt.Errorf("wal: failed to unmarshal segment header: %w", err)
+	}
+	return h, nil
+}
+
+// useSegmentHeader sets the checksum and page size of opts to those of the
+// segment with header h. The checksum must be the same for all the segments
+// read; the page size is the one the last segment was written with, so that
+// appending to it keeps its alignment.
+func useSegmentHeader(opts *Options, name string, h *walpb.SegmentHeader, first bool) error {
+	// segments of format version 0 use CRC32C
+	checksum := h.GetChecksum()
+	if !first && checksum != opts.checksum {
+		return fmt.Errorf("%w: %s has checksum %v, the previous segments %v", ErrUnsupportedSegment, name, checksum, opts.checksum)
+	}
+	opts.checksum = checksum
+
+	// nor do they record their page size
+	pageBytes := int(h.GetPageBytes())
+	if pageBytes == 0 {
+		return nil
+	}
+	if pageBytes%minSectorSize != 0 {
+		return fmt.Errorf("%w: %s has page size %d", ErrUnsupportedSegment, name, pageBytes)
+	}
+	opts.pageBytes = pageBytes
+	return nil
+}
+
+// readChecksum sets the checksum and page size of opts to those of the WAL
+// segment at path.
+func readChecksum(opts *Options, path string) error {
+	f, err := opts.fs.OpenFile(path, os.O_RDONLY, opts.filePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h, err := readSegmentHeader(opts, f)
+	if err == nil {
+		err = checkSegmentHeader(filepath.Base(path), h)
+	}
+	if err != nil {
+		return err
+	}
+	return useSegmentHeader(opts, filepath.Base(path), h, true)
+}
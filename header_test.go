@@ -0,0 +1,207 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto" // nolint
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// writeSegment writes a first segment into dir by hand, with the given header
+// or as format version 0 without one.
+func writeSegment(t *testing.T, dir string, h *walpb.SegmentHeader) {
+	assert.Empty(t, os.MkdirAll(dir, 0700))
+	f, err := os.Create(filepath.Join(dir, walName(0, 0)))
+	assert.Empty(t, err)
+	defer f.Close()
+	enc := newEncoder(f, 0, 0, newOptions(nil))
+	assert.Empty(t, enc.encode(&walpb.Record{Type: walpb.RecordType_CrcType}))
+	if h != nil {
+		b, err := proto.Marshal(h)
+		assert.Empty(t, err)
+		assert.Empty(t, enc.encode(&walpb.Record{Type: walpb.RecordType_HeaderType, Data: b}))
+	}
+	assert.Empty(t, enc.encode(&walpb.Record{Type: walpb.RecordType_MetadataType, Data: []byte("metadata")}))
+	b, err := proto.Marshal(&walpb.Snapshot{})
+	assert.Empty(t, err)
+	assert.Empty(t, enc.encode(&walpb.Record{Type: walpb.RecordType_SnapshotType, Data: b}))
+	assert.Empty(t, enc.flush())
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "keys")
+	appendKey(t, keyFile, "k1")
+	kp, err := NewFileKeyProvider(keyFile)
+	assert.Empty(t, err)
+
+	p := filepath.Join(dir, "wal")
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: jsonData(1)}}))
+	assert.Empty(t, w.Close())
+	w, err = Open(p, &walpb.Snapshot{}, WithSegmentSizeBytes(4096), WithEncryption(kp), WithCompression(GzipCodec(1), 0))
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.Empty(t, err)
+	for i := 2; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	// the features are those of the writer that started the segment
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 1)
+	for i, s := range segs {
+		h := s.Header
+		assert.NotNil(t, h)
+		assert.Equal(t, uint32(FormatVersion), h.FormatVersion)
+		assert.Equal(t, walpb.ChecksumType_CRC32C, h.Checksum)
+		assert.Equal(t, uint32(walPageBytes), h.PageBytes)
+		assert.Equal(t, writerVersion, h.WriterVersion)
+		if i == 0 {
+			assert.Equal(t, uint64(0), h.RequiredFeatures)
+		} else {
+			assert.Equal(t, FeatureCompression|FeatureEncryption, h.RequiredFeatures)
+		}
+	}
+}
+
+func TestSegmentHeaderVersions(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		h  *walpb.SegmentHeader
+		ok bool
+	}{
+		{nil, true},
+		{&walpb.SegmentHeader{FormatVersion: 1}, true},
+		{&walpb.SegmentHeader{FormatVersion: 1, OptionalFeatures: 1 << 40}, true},
+		{&walpb.SegmentHeader{FormatVersion: 1, RequiredFeatures: 1 << 40}, false},
+		{&walpb.SegmentHeader{FormatVersion: 1, Checksum: 100}, false},
+		{&walpb.SegmentHeader{FormatVersion: 1, PageBytes: 8192}, true},
+		{&walpb.SegmentHeader{FormatVersion: 1, PageBytes: 1000}, false},
+		{&walpb.SegmentHeader{FormatVersion: FormatVersion + 1}, false},
+	}
+	for i, tt := range tests {
+		p := filepath.Join(dir, walName(uint64(i), 0))
+		writeSegment(t, p, tt.h)
+
+		w, err := Open(p, &walpb.Snapshot{})
+		if !tt.ok {
+			assert.True(t, errors.Is(err, ErrUnsupportedSegment), "#%d: %v", i, err)
+			assert.True(t, errors.Is(Verify(p, &walpb.Snapshot{}), ErrUnsupportedSegment), "#%d", i)
+			continue
+		}
+		assert.Empty(t, err, "#%d", i)
+		metadata, _, _, err := w.ReadAll()
+		assert.Empty(t, err, "#%d", i)
+		assert.Equal(t, []byte("metadata"), metadata)
+		// appending to an old segment keeps it as it is, new segments get
+		// a header
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 1, Term: 1}}))
+		assert.Empty(t, w.cut())
+		assert.Empty(t, w.Close())
+		segs, err := Segments(p)
+		assert.Empty(t, err)
+		assert.Equal(t, 2, len(segs))
+		assert.Equal(t, tt.h == nil, segs[0].Header == nil, "#%d", i)
+		assert.NotNil(t, segs[1].Header)
+	}
+}
+
+func TestChecksumOption(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	_, err = Create(p, []byte("metadata"), WithChecksum(100))
+	assert.NotEmpty(t, err)
+	w, err := Create(p, []byte("metadata"), WithChecksum(walpb.ChecksumType_CRC64_ECMA), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	// the checksum is read from the segments, whatever the options
+	w, err = Open(p, &walpb.Snapshot{}, WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 20, len(ents))
+	for i := 21; i <= 40; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+	assert.Empty(t, Verify(p, &walpb.Snapshot{}))
+
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 2)
+	for _, s := range segs {
+		assert.Equal(t, walpb.ChecksumType_CRC64_ECMA, s.Header.Checksum)
+	}
+	var wide int
+	err = ScanRecords(p, func(ri RecordInfo) error {
+		if ri.Record.Crc > math.MaxUint32 {
+			wide++
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	assert.True(t, wide > 0, "no 64-bit checksum")
+
+	paths, offs, _ := entryOffsets(t, p)
+	flipAt(t, paths[len(paths)-1], offs[len(offs)-1]+frameSizeBytes+40)
+	_, err = readAllEntries(t, p)
+	assert.True(t, errors.Is(err, walpb.ErrCRCMismatch), "%v", err)
+}
+
+func TestPageBytesOption(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	w, err := Create(p, []byte("metadata"), WithPageBytes(8192), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	// the page size is read from the segments, whatever the options
+	w, err = Open(p, &walpb.Snapshot{}, WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 8192, w.opts.pageBytes)
+	for i := 21; i <= 40; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 2)
+	for _, s := range segs {
+		assert.Equal(t, uint32(8192), s.Header.PageBytes)
+	}
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 40, len(ents))
+}
@@ -0,0 +1,298 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// indexIntervalBytes is the distance in bytes between two checkpoints of the
+// entry index. ReadRange decodes at most about this much before reaching
+// the first requested entry.
+const indexIntervalBytes = 64 * 1024
+
+func (p position) less(o position) bool {
+	return p.seq < o.seq || (p.seq == o.seq && p.off < o.off)
+}
+
+// checkpoint locates an entry record, together with the crc chained up to
+// it, so that decoding can start right there.
+type checkpoint struct {
+	index uint64
+	pos   position
+	crc   uint64
+}
+
+// overwrite records that entries with an index equal to or larger than index
+// were rewritten at pos; copies located before pos are stale.
+type overwrite struct {
+	index uint64
+	pos   position
+}
+
+// entryIndex is a sparse in-memory index from raft index to record position.
+// It is filled while replaying the WAL and while saving entries.
+type entryIndex struct {
+	first, last uint64       // range of indexed entries
+	cps         []checkpoint // by increasing index and position
+	// ows are by increasing position and index; an overwrite is dropped
+	// once a later one rewrites from the same or a lower index.
+	ows []overwrite
+}
+
+func (ix *entryIndex) empty() bool { return len(ix.cps) == 0 }
+
+// add indexes the entry record with the given index at pos.
+func (ix *entryIndex) add(index uint64, pos position, crc uint64) {
+	cp := checkpoint{index: index, pos: pos, crc: crc}
+	if ix.empty() {
+		ix.first, ix.last = index, index
+		ix.cps = append(ix.cps, cp)
+		return
+	}
+	if index <= ix.last {
+		// a conflicting suffix is rewritten; forget about the old one
+		i := len(ix.cps)
+		for i > 0 && ix.cps[i-1].index >= index {
+			i--
+		}
+		ix.cps = append(ix.cps[:i], cp)
+		ix.overwritten(index, pos)
+		if index < ix.first {
+			ix.first = index
+		}
+		ix.last = index
+		return
+	}
+	ix.last = index
+	prev := ix.cps[len(ix.cps)-1].pos
+	if prev.seq != pos.seq || pos.off-prev.off >= indexIntervalBytes {
+		ix.cps = append(ix.cps, cp)
+	}
+}
+
+// lookup returns the last checkpoint at or before index.
+func (ix *entryIndex) lookup(index uint64) checkpoint {
+	i := sort.Search(len(ix.cps), func(i int) bool { return ix.cps[i].index > index })
+	return ix.cps[i-1]
+}
+
+// overwritten records that the entries from index on were rewritten at pos,
+// which is after every overwrite recorded so far.
+func (ix *entryIndex) overwritten(index uint64, pos position) {
+	i := len(ix.ows)
+	for i > 0 && ix.ows[i-1].index >= index {
+		i--
+	}
+	ix.ows = append(ix.ows[:i], overwrite{index: index, pos: pos})
+}
+
+// stale reports whether the copy of the entry with the given index at pos
+// was overwritten later on.
+func (ix *entryIndex) stale(index uint64, pos position) bool {
+	// the first overwrite after pos has the lowest index of those after pos
+	i := sort.Search(len(ix.ows), func(i int) bool { return pos.less(ix.ows[i].pos) })
+	return i < len(ix.ows) && ix.ows[i].index <= index
+}
+
+// truncate forgets the entries after index, whose records start at pos. The
+// copies of those entries left before pos become stale.
+func (ix *entryIndex) truncate(index uint64, pos position) {
+	i := len(ix.cps)
+	for i > 0 && ix.cps[i-1].index > index {
+		i--
+	}
+	ix.cps = ix.cps[:i]
+	j := sort.Search(len(ix.ows), func(j int) bool { return !ix.ows[j].pos.less(pos) })
+	ix.ows = ix.ows[:j]
+	ix.overwritten(index+1, pos)
+	if ix.empty() {
+		ix.first, ix.last = 0, 0
+		return
+	}
+	ix.last = index
+}
+
+// trim forgets the entries whose records are in the segments before seq, so
+// that the index only covers the segments a WAL still holds.
+func (ix *entryIndex) trim(seq uint64) {
+	i := sort.Search(len(ix.cps), func(i int) bool { return ix.cps[i].pos.seq >= seq })
+	j := sort.Search(len(ix.ows), func(j int) bool { return ix.ows[j].pos.seq >= seq })
+	if i == 0 && j == 0 {
+		return
+	}
+	// copy, so that the dropped part of the arrays is released
+	ix.cps = append([]checkpoint(nil), ix.cps[i:]...)
+	ix.ows = append([]overwrite(nil), ix.ows[j:]...)
+	if ix.empty() {
+		ix.first, ix.last = 0, 0
+		return
+	}
+	ix.first = ix.cps[0].index
+}
+
+// snapshot returns a copy of the index that can be used without holding w.mu.
+func (ix *entryIndex) snapshot() *entryIndex {
+	return &entryIndex{
+		first: ix.first,
+		last:  ix.last,
+		cps:   append([]checkpoint(nil), ix.cps...),
+		ows:   append([]overwrite(nil), ix.ows...),
+	}
+}
+
+// ReadRange returns the entries with index in [lo, hi) as currently found in
+// the WAL. It looks up a nearby position in an in-memory index, so only a
+// small part of the log is decoded, and every record read is crc-validated.
+// The returned entries are limited to maxBytes in total, but at least one
+// entry is returned if any; a maxBytes of 0 means no limit.
+//
+// ReadRange works on a WAL in append mode and on a read-only WAL after all
+// records have been read out with ReadAll or Replay; entries before the
+// snapshot the WAL was opened at, and those of the segments released with
+// ReleaseLockTo, are not available. Entries that are not durable yet are not
+// returned.
+func (w *WAL) ReadRange(lo, hi, maxBytes uint64) ([]*walpb.Entry, error) {
+	w.mu.Lock()
+	if w.index.empty() || lo >= hi || lo < w.index.first || hi > w.index.last+1 {
+		w.mu.Unlock()
+		return nil, ErrIndexOutOfRange
+	}
+	ix := w.index.snapshot()
+	appending := w.tail() != nil
+	w.mu.Unlock()
+
+	durable, _, _ := w.durablePosition()
+	seqNames, err := readWALSeqNames(w.opts, w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		ents []*walpb.Entry
+		size uint64
+		done bool
+	)
+	visit := func(rec *walpb.Record, pos position) (bool, error) {
+		if rec.GetType() != walpb.RecordType_EntryType {
+			return true, nil
+		}
+		ent := &walpb.Entry{}
+		if err := proto.Unmarshal(rec.GetData(), ent); err != nil {
+			return false, err
+		}
+		if ent.Index < lo || ix.stale(ent.Index, pos) {
+			return true, nil
+		}
+		if ent.Index >= hi {
+			done = true
+			return false, nil
+		}
+		if n := ent.Index - lo; n < uint64(len(ents)) {
+			ents = ents[:n]
+		}
+		size += uint64(proto.Size(ent))
+		if maxBytes > 0 && len(ents) > 0 && size > maxBytes {
+			done = true
+			return false, nil
+		}
+		ents = append(ents, ent)
+		done = uint64(len(ents)) == hi-lo
+		return !done, nil
+	}
+
+	cp := ix.lookup(lo)
+	seq, off, crc := cp.pos.seq, cp.pos.off, cp.crc
+	for !done {
+		limit := int64(-1)
+		if appending {
+			if durable.less(position{seq: seq}) {
+				break
+			}
+			if seq == durable.seq {
+				limit = durable.off
+			}
+		}
+		name, ok := seqNames[seq]
+		if !ok {
+			if appending {
+				return nil, ErrFileNotFound
+			}
+			break
+		}
+		f, err := w.opts.fs.OpenFile(filepath.Join(w.dir, name), os.O_RDONLY, w.opts.filePerm)
+		if err != nil {
+			return nil, err
+		}
+		_, crc, err = scanSegment(w.opts, f, seq, off, limit, crc, visit)
+		f.Close()
+		if err == io.ErrUnexpectedEOF && !appending {
+			// the tail of a read-only WAL may be a partial write
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if limit >= 0 {
+			break
+		}
+		seq, off = seq+1, 0
+	}
+	return ents, nil
+}
+
+// scanSegment decodes the records of the segment file f with sequence seq,
+// from off up to limit, or to the end of the segment if limit is negative.
+// The crc chain continues from crc. fn is called with each record and its
+// position until it returns false. scanSegment returns the offset and crc
+// following the last record that fn accepted.
+func scanSegment(opts *Options, f fileutil.File, seq uint64, off, limit int64, crc uint64, fn func(rec *walpb.Record, pos position) (bool, error)) (int64, uint64, error) {
+	var r io.Reader
+	if limit >= 0 {
+		if limit <= off {
+			return off, crc, nil
+		}
+		r = io.NewSectionReader(f, off, limit-off)
+	} else {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return off, crc, err
+		}
+		r = f
+	}
+
+	base := off
+	d := newDecoder(opts, r)
+	d.names, d.base = []string{filepath.Base(f.Name())}, base
+	d.updateCRC(crc)
+	rec := &walpb.Record{}
+	for {
+		err := d.decode(rec)
+		if err == io.EOF {
+			return off, crc, nil
+		}
+		if err != nil {
+			return off, crc, err
+		}
+
+		if rec.GetType() == walpb.RecordType_CrcType {
+			prev := d.crc.Sum64()
+			// do no need to match 0 crc, since the decoder is a new one at this case.
+			if prev != 0 && rec.Validate(prev) != nil {
+				opts.metrics.ObserveCRCFailure()
+				return off, crc, d.corruption(d.lastRecOff, walpb.RecordType_CrcType, ErrCRCMismatch)
+			}
+			d.updateCRC(rec.Crc)
+		}
+		ok, err := fn(rec, position{seq: seq, off: base + d.lastRecOff})
+		if err != nil || !ok {
+			return off, crc, err
+		}
+		off, crc = base+d.lastOffset(), d.lastCRC()
+	}
+}
@@ -0,0 +1,227 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestReadRange(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(256*1024))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	data := make([]byte, 4096)
+	for i := 1; i <= 200; i++ {
+		data[0] = byte(i)
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	seq, err := w.seq()
+	assert.Empty(t, err)
+	assert.True(t, seq > 1)
+	assert.True(t, len(w.index.cps) > int(seq)+1)
+
+	tests := []struct {
+		lo, hi, maxBytes uint64
+		wn               int
+	}{
+		{1, 2, 0, 1},
+		{1, 201, 0, 200},
+		{37, 151, 0, 114},
+		{100, 200, 3 * 4200, 3},
+		{100, 200, 1, 1},
+	}
+	for _, tt := range tests {
+		ents, err := w.ReadRange(tt.lo, tt.hi, tt.maxBytes)
+		assert.Empty(t, err)
+		assert.Equal(t, tt.wn, len(ents))
+		for i, ent := range ents {
+			assert.Equal(t, tt.lo+uint64(i), ent.Index)
+			assert.Equal(t, byte(ent.Index), ent.Data[0])
+		}
+	}
+
+	_, err = w.ReadRange(0, 10, 0)
+	assert.Equal(t, ErrIndexOutOfRange, err)
+	_, err = w.ReadRange(10, 202, 0)
+	assert.Equal(t, ErrIndexOutOfRange, err)
+}
+
+func TestReadRangeAfterOverwrite(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	for i := 1; i <= 10; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1}})
+		assert.Empty(t, err)
+	}
+	err = w.Save(nil, []walpb.Entry{
+		{Type: walpb.RecordType_EntryType, Index: 5, Term: 2},
+		{Type: walpb.RecordType_EntryType, Index: 6, Term: 2},
+		{Type: walpb.RecordType_EntryType, Index: 7, Term: 2},
+	})
+	assert.Empty(t, err)
+
+	check := func(w *WAL) {
+		ents, err := w.ReadRange(1, 8, 0)
+		assert.Empty(t, err)
+		assert.Equal(t, 7, len(ents))
+		for i, ent := range ents {
+			assert.Equal(t, uint64(i+1), ent.Index)
+			if ent.Index < 5 {
+				assert.Equal(t, uint64(1), ent.Term)
+			} else {
+				assert.Equal(t, uint64(2), ent.Term)
+			}
+		}
+		_, err = w.ReadRange(3, 9, 0)
+		assert.Equal(t, ErrIndexOutOfRange, err)
+	}
+	check(w)
+	w.Close()
+
+	// the index is rebuilt while reading out a reopened WAL
+	w, err = OpenForRead(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	assert.Empty(t, err)
+	check(w)
+}
+
+func TestReadRangeCorrupted(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	defer w.Close()
+	data := []byte("waldata")
+	for i := 1; i <= 3; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+
+	// flip a byte of the payload of an entry
+	fpath := filepath.Join(p, walName(0, 0))
+	b, err := ioutil.ReadFile(fpath)
+	assert.Empty(t, err)
+	off := w.index.lookup(1).pos.off
+	for i := int(off); i < len(b); i++ {
+		if b[i] == 'w' {
+			b[i] = 'W'
+			break
+		}
+	}
+	f, err := os.OpenFile(fpath, os.O_WRONLY, 0)
+	assert.Empty(t, err)
+	_, err = f.WriteAt(b[off:off+64], off)
+	assert.Empty(t, err)
+	f.Close()
+
+	_, err = w.ReadRange(1, 4, 0)
+	assert.NotEmpty(t, err)
+}
+
+func TestReadRangeAfterRelease(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	defer w.Close()
+	data := make([]byte, 1024)
+	for i := 1; i <= 20; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	assert.True(t, len(w.locks) > 3)
+
+	// the index only covers the segments still locked
+	assert.Empty(t, w.ReleaseLockTo(15))
+	_, first, err := parseWALName(filepath.Base(w.locks[0].Name()))
+	assert.Empty(t, err)
+	assert.True(t, first > 1)
+	assert.Equal(t, first, w.index.first)
+	assert.Equal(t, uint64(20), w.index.last)
+	_, err = w.ReadRange(first-1, 21, 0)
+	assert.Equal(t, ErrIndexOutOfRange, err)
+	ents, err := w.ReadRange(first, 21, 0)
+	assert.Empty(t, err)
+	assert.Equal(t, int(21-first), len(ents))
+}
+
+func TestEntryIndexStale(t *testing.T) {
+	pos := func(off int64) position { return position{seq: 1, off: off} }
+	ix := &entryIndex{}
+	for i := uint64(1); i <= 6; i++ {
+		ix.add(i, pos(int64(i)), 0)
+	}
+	ix.add(5, pos(10), 0)
+	ix.add(6, pos(11), 0)
+	ix.add(3, pos(12), 0)
+	// the overwrite at 3 covers the one at 5
+	assert.Equal(t, []overwrite{{index: 3, pos: pos(12)}}, ix.ows)
+	ix.add(4, pos(13), 0)
+	ix.add(4, pos(14), 0)
+	assert.Equal(t, []overwrite{{index: 3, pos: pos(12)}, {index: 4, pos: pos(14)}}, ix.ows)
+
+	tests := []struct {
+		index uint64
+		off   int64
+		w     bool
+	}{
+		{2, 2, false},
+		{3, 3, true},
+		{5, 10, true},
+		{3, 12, false},
+		{4, 13, true},
+		{4, 14, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.w, ix.stale(tt.index, pos(tt.off)), "index %d at %d", tt.index, tt.off)
+	}
+}
+
+func TestReadRangeAfterTruncate(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	defer w.Close()
+	for i := 1; i <= 3; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1}})
+		assert.Empty(t, err)
+	}
+	err = w.Save(nil, []walpb.Entry{
+		{Type: walpb.RecordType_EntryType, Index: 2, Term: 2},
+		{Type: walpb.RecordType_EntryType, Index: 3, Term: 2},
+	})
+	assert.Empty(t, err)
+
+	// the term 1 copies of 2 and 3 are left before the truncation point
+	assert.Empty(t, w.TruncateSuffix(1))
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 2, Term: 3}})
+	assert.Empty(t, err)
+	ents, err := w.ReadRange(1, 3, 0)
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(ents))
+	assert.Equal(t, uint64(3), ents[1].Term)
+}
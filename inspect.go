@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// SegmentInfo describes a segment file of a WAL directory.
+type SegmentInfo struct {
+	Name  string // file name
+	Seq   uint64 // sequence number
+	Index uint64 // raft index the segment starts after, as in its name
+	Size  int64  // file size, including the preallocated space
+	Used  int64  // bytes taken by the valid records at the start of the file
+	// Header tells how the segment was written, nil for a segment of format
+	// version 0.
+	Header *walpb.SegmentHeader
+}
+
+// Segments returns the segment files of the WAL in dirpath, by sequence.
+// Records are only decoded, not checked against the crc chain of the
+// previous segments.
+func Segments(dirpath string, opts ...Option) ([]SegmentInfo, error) {
+	o := newOptions(opts)
+	o.keepSealed = true
+	names, err := readWALNames(o, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if err = readChecksum(o, filepath.Join(dirpath, names[0])); err != nil {
+		return nil, err
+	}
+	segs := make([]SegmentInfo, 0, len(names))
+	for _, name := range names {
+		seq, index, _ := parseWALName(name)
+		f, err := o.fs.OpenFile(filepath.Join(dirpath, name), os.O_RDONLY, o.filePerm)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		h, err := readSegmentHeader(o, f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// a decoding error only ends the used part
+		used, _, _ := scanSegment(o, f, seq, 0, -1, 0, func(*walpb.Record, position) (bool, error) {
+			return true, nil
+		})
+		f.Close()
+		segs = append(segs, SegmentInfo{Name: name, Seq: seq, Index: index, Size: fi.Size(), Used: used, Header: h})
+	}
+	return segs, nil
+}
+
+// RecordInfo is a record read by ScanRecords, with its location. The data of
+// a compressed record is decompressed, its Codec tells how it is stored. An
+// encrypted record, with a KeyId, is decrypted if a key provider is given and
+// left as stored otherwise.
+type RecordInfo struct {
+	Segment string // file name of the segment holding the record
+	Offset  int64  // offset of the record frame in the segment
+	Record  *walpb.Record
+}
+
+// ScanRecords calls fn with every record of the WAL in dirpath, in order,
+// until fn returns an error, which is then returned. The records are checked
+// against the crc chain as they are read; the error that stops the scan is
+// returned, io.ErrUnexpectedEOF if the last record is torn.
+func ScanRecords(dirpath string, fn func(RecordInfo) error, opts ...Option) error {
+	o := newOptions(opts)
+	o.keepSealed = true
+	names, err := readWALNames(o, dirpath)
+	if err != nil {
+		return err
+	}
+	if err = readChecksum(o, filepath.Join(dirpath, names[0])); err != nil {
+		return err
+	}
+	var crc uint64
+	for _, name := range names {
+		seq, _, _ := parseWALName(name)
+		f, err := o.fs.OpenFile(filepath.Join(dirpath, name), os.O_RDONLY, o.filePerm)
+		if err != nil {
+			return err
+		}
+		_, crc, err = scanSegment(o, f, seq, 0, -1, crc, func(rec *walpb.Record, pos position) (bool, error) {
+			r := &walpb.Record{Type: rec.Type, Crc: rec.Crc, Data: rec.Data, Codec: rec.Codec, KeyId: rec.KeyId}
+			return true, fn(RecordInfo{Segment: name, Offset: pos.off, Record: r})
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
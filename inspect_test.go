@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto" // nolint
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+	writeTestWAL(t, p, WithSegmentSizeBytes(1024))
+
+	segs, err := Segments(p)
+	assert.Empty(t, err)
+	assert.True(t, len(segs) > 1)
+	for i, s := range segs {
+		assert.Equal(t, uint64(i), s.Seq)
+		assert.True(t, s.Used > 0 && s.Used <= s.Size, s.Name)
+	}
+
+	var (
+		last    uint64
+		snaps   int
+		prevSeg string
+		prevOff int64
+	)
+	err = ScanRecords(p, func(ri RecordInfo) error {
+		if ri.Segment == prevSeg {
+			assert.True(t, ri.Offset > prevOff)
+		} else {
+			assert.Equal(t, int64(0), ri.Offset)
+			assert.Equal(t, walpb.RecordType_CrcType, ri.Record.Type)
+		}
+		prevSeg, prevOff = ri.Segment, ri.Offset
+		switch ri.Record.Type {
+		case walpb.RecordType_EntryType:
+			e := &walpb.Entry{}
+			assert.Empty(t, proto.Unmarshal(ri.Record.Data, e))
+			last = e.Index
+		case walpb.RecordType_SnapshotType:
+			snaps++
+		}
+		return nil
+	})
+	assert.Empty(t, err)
+	// writeTestWAL truncates after 45, dropping its snapshot record too
+	assert.Equal(t, uint64(45), last)
+	assert.Equal(t, 1, snaps)
+	assert.Equal(t, segs[len(segs)-1].Name, prevSeg)
+
+	_, err = Segments(filepath.Join(dir, "missing"))
+	assert.NotEmpty(t, err)
+}
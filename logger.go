@@ -0,0 +1,56 @@
+package wal
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog"
+)
+
+// Logger logs the events of a WAL, see WithLogger. The fields of a message
+// are given as alternating keys and values.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+type zerologLogger struct {
+	lg zerolog.Logger
+}
+
+// NewZerologLogger returns a Logger writing to lg.
+func NewZerologLogger(lg zerolog.Logger) Logger {
+	return zerologLogger{lg: lg}
+}
+
+func (l zerologLogger) Debug(msg string, fields ...interface{}) { logEvent(l.lg.Debug(), msg, fields) }
+func (l zerologLogger) Info(msg string, fields ...interface{})  { logEvent(l.lg.Info(), msg, fields) }
+func (l zerologLogger) Warn(msg string, fields ...interface{})  { logEvent(l.lg.Warn(), msg, fields) }
+func (l zerologLogger) Error(msg string, fields ...interface{}) { logEvent(l.lg.Error(), msg, fields) }
+
+func logEvent(e *zerolog.Event, msg string, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var v interface{}
+		if i+1 < len(fields) {
+			v = fields[i+1]
+		}
+		if err, ok := v.(error); ok {
+			e = e.AnErr(key, err)
+		} else {
+			e = e.Interface(key, v)
+		}
+	}
+	e.Msg(msg)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NopLogger returns a Logger discarding every message.
+func NopLogger() Logger { return nopLogger{} }
@@ -0,0 +1,77 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// recordLogger is a Logger keeping the messages logged.
+type recordLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordLogger) log(msg string) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, msg)
+	l.mu.Unlock()
+}
+
+func (l *recordLogger) Debug(msg string, _ ...interface{}) { l.log(msg) }
+func (l *recordLogger) Info(msg string, _ ...interface{})  { l.log(msg) }
+func (l *recordLogger) Warn(msg string, _ ...interface{})  { l.log(msg) }
+func (l *recordLogger) Error(msg string, _ ...interface{}) { l.log(msg) }
+
+func TestZerologLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lg := NewZerologLogger(zerolog.New(&buf))
+	lg.Warn("slow sync", "error", errors.New("boom"), "path", "/wal", "took", 1.5)
+
+	var v map[string]interface{}
+	assert.Empty(t, json.Unmarshal(buf.Bytes(), &v))
+	assert.Equal(t, map[string]interface{}{
+		"level":   "warn",
+		"message": "slow sync",
+		"error":   "boom",
+		"path":    "/wal",
+		"took":    1.5,
+	}, v)
+}
+
+func TestWithLogger(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	lg := &recordLogger{}
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(4096), WithLogger(lg))
+	assert.Empty(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+	assert.Contains(t, lg.msgs, "created a new WAL segment")
+
+	_, err = Create(filepath.Join(dir, "nolog"), []byte("metadata"), WithLogger(nil))
+	assert.NotEmpty(t, err)
+}
+
+func TestBadWALNames(t *testing.T) {
+	names := []string{walName(0, 0), "0000000000000001.tmp"}
+	_, _, err := searchIndex(names, 1)
+	assert.True(t, errors.Is(err, errBadWALName), "%v", err)
+	_, err = isValidSeq(names)
+	assert.True(t, errors.Is(err, errBadWALName), "%v", err)
+}
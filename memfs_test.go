@@ -0,0 +1,76 @@
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// writeTestWAL creates a WAL at p and saves the same records whatever the
+// filesystem is.
+func writeTestWAL(t *testing.T, p string, opts ...Option) {
+	w, err := Create(p, []byte("metadata"), opts...)
+	assert.Empty(t, err)
+	data := []byte("somedata")
+	for i := 1; i <= 50; i++ {
+		err = w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	err = w.SaveSnapshot(&walpb.Snapshot{Index: 20, Term: 1})
+	assert.Empty(t, err)
+	err = w.TruncateSuffix(45)
+	assert.Empty(t, err)
+	assert.Empty(t, w.Close())
+}
+
+func TestMemFS(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+
+	disk := filepath.Join(dir, "disk")
+	writeTestWAL(t, disk, WithSegmentSizeBytes(1024))
+
+	fs := fileutil.NewMemFS()
+	assert.Empty(t, fs.MkdirAll("/data", fileutil.PrivateDirMode))
+	opts := []Option{WithFS(fs), WithSegmentSizeBytes(1024)}
+	writeTestWAL(t, "/data/wal", opts...)
+
+	w, err := Open("/data/wal", &walpb.Snapshot{Index: 20, Term: 1}, opts...)
+	assert.Empty(t, err)
+	_, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(50), state.Commit)
+	assert.Equal(t, 25, len(ents))
+	assert.Empty(t, w.Close())
+
+	// the memory WAL holds the same bytes as the disk one
+	dumped := filepath.Join(dir, "dumped")
+	assert.Empty(t, fs.Dump("/data/wal", dumped))
+	names, err := fileutil.ReadDir(fileutil.DefaultFS, disk)
+	assert.Empty(t, err)
+	dnames, err := fileutil.ReadDir(fileutil.DefaultFS, dumped)
+	assert.Empty(t, err)
+	assert.Equal(t, names, dnames)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(disk, name))
+		assert.Empty(t, err)
+		db, err := ioutil.ReadFile(filepath.Join(dumped, name))
+		assert.Empty(t, err)
+		assert.True(t, bytes.Equal(b, db), name)
+	}
+
+	w, err = Open(dumped, &walpb.Snapshot{Index: 20, Term: 1})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err = w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 25, len(ents))
+}
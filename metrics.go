@@ -0,0 +1,312 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// Metrics receives the measurements of a WAL, see WithMetrics. Its methods
+// are called from the goroutines using the WAL and must not block.
+type Metrics interface {
+	// ObserveSync is called with the duration of each sync of the tail
+	// segment.
+	ObserveSync(d time.Duration)
+	// ObserveSave is called with the time each save took, from its call to
+	// its completion.
+	ObserveSave(d time.Duration)
+	// ObserveBatch is called with the number of entries of each batch of
+	// saves committed together.
+	ObserveBatch(entries int)
+	// ObserveRecord is called for each record written, with its size
+	// including the framing.
+	ObserveRecord(t walpb.RecordType, bytes int)
+	// ObserveCut is called whenever a new segment is cut.
+	ObserveCut()
+	// ObservePreallocate is called with the duration of each preallocation
+	// of a segment file.
+	ObservePreallocate(d time.Duration)
+	// ObserveReplay is called when ReadAll or Replay ends, with its duration
+	// and the number of records read.
+	ObserveReplay(d time.Duration, records int)
+	// ObserveCRCFailure is called whenever a record does not match the crc
+	// chain.
+	ObserveCRCFailure()
+	// SetUnsyncedBytes is called with the number of bytes written since the
+	// last sync whenever it changes, see UnsyncedBytes.
+	SetUnsyncedBytes(n int64)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveSync(time.Duration)           {}
+func (nopMetrics) ObserveSave(time.Duration)           {}
+func (nopMetrics) ObserveBatch(int)                    {}
+func (nopMetrics) ObserveRecord(walpb.RecordType, int) {}
+func (nopMetrics) ObserveCut()                         {}
+func (nopMetrics) ObservePreallocate(time.Duration)    {}
+func (nopMetrics) ObserveReplay(time.Duration, int)    {}
+func (nopMetrics) ObserveCRCFailure()                  {}
+func (nopMetrics) SetUnsyncedBytes(int64)              {}
+
+// exponentialBuckets returns n bucket bounds, starting at start and each
+// factor times the previous one.
+func exponentialBuckets(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// histogram counts observations in buckets of increasing upper bounds.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // by bucket, the last one for the values above all bounds
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)]++
+	h.sum += v
+	h.count++
+}
+
+// Collector is the default Metrics implementation. It keeps the
+// measurements in memory and exports them in the Prometheus text format or
+// as an expvar variable.
+type Collector struct {
+	mu             sync.Mutex
+	syncs          *histogram
+	saves          *histogram
+	batches        *histogram
+	preallocations *histogram
+	replays        *histogram
+	records        map[walpb.RecordType]uint64
+	bytes          map[walpb.RecordType]uint64
+	cuts           uint64
+	replayed       uint64
+	crcFailures    uint64
+	unsynced       int64
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		syncs:          newHistogram(exponentialBuckets(0.001, 2, 14)),
+		saves:          newHistogram(exponentialBuckets(0.0001, 2, 18)),
+		batches:        newHistogram(exponentialBuckets(1, 2, 14)),
+		preallocations: newHistogram(exponentialBuckets(0.001, 2, 14)),
+		replays:        newHistogram(exponentialBuckets(0.01, 2, 14)),
+		records:        make(map[walpb.RecordType]uint64),
+		bytes:          make(map[walpb.RecordType]uint64),
+	}
+}
+
+// ObserveSync adds d to the sync latency histogram.
+func (c *Collector) ObserveSync(d time.Duration) {
+	c.mu.Lock()
+	c.syncs.observe(d.Seconds())
+	c.mu.Unlock()
+}
+
+// ObserveSave adds d to the save latency histogram.
+func (c *Collector) ObserveSave(d time.Duration) {
+	c.mu.Lock()
+	c.saves.observe(d.Seconds())
+	c.mu.Unlock()
+}
+
+// ObserveBatch adds entries to the batch size histogram.
+func (c *Collector) ObserveBatch(entries int) {
+	c.mu.Lock()
+	c.batches.observe(float64(entries))
+	c.mu.Unlock()
+}
+
+// ObserveRecord counts a record of type t and its bytes.
+func (c *Collector) ObserveRecord(t walpb.RecordType, bytes int) {
+	c.mu.Lock()
+	c.records[t]++
+	c.bytes[t] += uint64(bytes)
+	c.mu.Unlock()
+}
+
+// ObserveCut counts a segment cut.
+func (c *Collector) ObserveCut() {
+	c.mu.Lock()
+	c.cuts++
+	c.mu.Unlock()
+}
+
+// ObservePreallocate adds d to the preallocation latency histogram.
+func (c *Collector) ObservePreallocate(d time.Duration) {
+	c.mu.Lock()
+	c.preallocations.observe(d.Seconds())
+	c.mu.Unlock()
+}
+
+// ObserveReplay adds d to the replay duration histogram and counts the
+// records replayed.
+func (c *Collector) ObserveReplay(d time.Duration, records int) {
+	c.mu.Lock()
+	c.replays.observe(d.Seconds())
+	c.replayed += uint64(records)
+	c.mu.Unlock()
+}
+
+// ObserveCRCFailure counts a crc failure.
+func (c *Collector) ObserveCRCFailure() {
+	c.mu.Lock()
+	c.crcFailures++
+	c.mu.Unlock()
+}
+
+// SetUnsyncedBytes sets the unsynced bytes gauge to n.
+func (c *Collector) SetUnsyncedBytes(n int64) {
+	c.mu.Lock()
+	c.unsynced = n
+	c.mu.Unlock()
+}
+
+// recordTypeLabel returns the label of the metrics of records of type t,
+// such as "entry" for walpb.RecordType_EntryType.
+func recordTypeLabel(t walpb.RecordType) string {
+	return strings.TrimSuffix(strings.ToLower(t.String()), "type")
+}
+
+// sortedTypes returns the record types of m by value.
+func sortedTypes(m map[walpb.RecordType]uint64) []walpb.RecordType {
+	ts := make([]walpb.RecordType, 0, len(m))
+	for t := range m {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	return ts
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text exposition
+// format.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	hist := func(name, help string, h *histogram) {
+		header(name, "histogram", help)
+		var n uint64
+		for i, b := range h.bounds {
+			n += h.counts[i]
+			fmt.Fprintf(bw, "%s_bucket{le=%q} %d\n", name, formatFloat(b), n)
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(bw, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+	}
+	byType := func(name, help string, m map[walpb.RecordType]uint64) {
+		header(name, "counter", help)
+		for _, t := range sortedTypes(m) {
+			fmt.Fprintf(bw, "%s{type=%q} %d\n", name, recordTypeLabel(t), m[t])
+		}
+	}
+	value := func(name, typ, help string, v int64) {
+		header(name, typ, help)
+		fmt.Fprintf(bw, "%s %d\n", name, v)
+	}
+
+	c.mu.Lock()
+	hist("wal_fsync_duration_seconds", "The latency distribution of the syncs of the WAL.", c.syncs)
+	hist("wal_save_duration_seconds", "The latency distribution of the saves to the WAL.", c.saves)
+	hist("wal_save_batch_entries", "The distribution of the number of entries committed together.", c.batches)
+	byType("wal_records_written_total", "The number of records written, by record type.", c.records)
+	byType("wal_bytes_written_total", "The number of bytes written, by record type.", c.bytes)
+	value("wal_segments_cut_total", "counter", "The number of segments cut.", int64(c.cuts))
+	hist("wal_preallocate_duration_seconds", "The latency distribution of the preallocations of segment files.", c.preallocations)
+	hist("wal_replay_duration_seconds", "The duration distribution of the replays of the WAL.", c.replays)
+	value("wal_records_replayed_total", "counter", "The number of records read by replays.", int64(c.replayed))
+	value("wal_crc_failures_total", "counter", "The number of records found not to match the crc chain.", int64(c.crcFailures))
+	value("wal_unsynced_bytes", "gauge", "The number of bytes written since the last sync.", c.unsynced)
+	c.mu.Unlock()
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WritePrometheus(w) // nolint
+}
+
+type expvarHistogram struct {
+	Buckets map[string]uint64 `json:"buckets"`
+	Sum     float64           `json:"sum"`
+	Count   uint64            `json:"count"`
+}
+
+func (h *histogram) expvar() expvarHistogram {
+	eh := expvarHistogram{Buckets: make(map[string]uint64, len(h.counts)), Sum: h.sum, Count: h.count}
+	var n uint64
+	for i, b := range h.bounds {
+		n += h.counts[i]
+		eh.Buckets[formatFloat(b)] = n
+	}
+	eh.Buckets["+Inf"] = h.count
+	return eh
+}
+
+func expvarByType(m map[walpb.RecordType]uint64) map[string]uint64 {
+	em := make(map[string]uint64, len(m))
+	for t, v := range m {
+		em[recordTypeLabel(t)] = v
+	}
+	return em
+}
+
+// String returns the metrics as a JSON object, so that a Collector is an
+// expvar.Var.
+func (c *Collector) String() string {
+	c.mu.Lock()
+	v := map[string]interface{}{
+		"fsync_duration_seconds":       c.syncs.expvar(),
+		"save_duration_seconds":        c.saves.expvar(),
+		"save_batch_entries":           c.batches.expvar(),
+		"records_written":              expvarByType(c.records),
+		"bytes_written":                expvarByType(c.bytes),
+		"segments_cut":                 c.cuts,
+		"preallocate_duration_seconds": c.preallocations.expvar(),
+		"replay_duration_seconds":      c.replays.expvar(),
+		"records_replayed":             c.replayed,
+		"crc_failures":                 c.crcFailures,
+		"unsynced_bytes":               c.unsynced,
+	}
+	c.mu.Unlock()
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// Publish publishes the metrics as the expvar variable with the given name.
+// Like expvar.Publish, it panics if the name is already taken.
+func (c *Collector) Publish(name string) {
+	expvar.Publish(name, c)
+}
@@ -0,0 +1,88 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestCollector(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	c := NewCollector()
+	opts := []Option{WithSegmentSizeBytes(4096), WithMetrics(c)}
+	w, err := Create(p, []byte("metadata"), opts...)
+	assert.Empty(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+	w, err = Open(p, &walpb.Snapshot{}, opts...)
+	assert.Empty(t, err)
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Empty(t, w.Close())
+
+	var buf bytes.Buffer
+	assert.Empty(t, c.WritePrometheus(&buf))
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE wal_fsync_duration_seconds histogram",
+		"wal_save_duration_seconds_count 20",
+		"wal_save_batch_entries_sum 20",
+		`wal_records_written_total{type="entry"} 20`,
+		"wal_crc_failures_total 0",
+		"wal_unsynced_bytes 0",
+		"wal_replay_duration_seconds_count 1",
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+
+	var v struct {
+		RecordsWritten  map[string]uint64 `json:"records_written"`
+		BytesWritten    map[string]uint64 `json:"bytes_written"`
+		SegmentsCut     uint64            `json:"segments_cut"`
+		RecordsReplayed uint64            `json:"records_replayed"`
+		Fsync           expvarHistogram   `json:"fsync_duration_seconds"`
+	}
+	c.Publish("wal_test")
+	assert.Empty(t, json.Unmarshal([]byte(expvar.Get("wal_test").String()), &v))
+	assert.Equal(t, uint64(20), v.RecordsWritten["entry"])
+	assert.True(t, v.BytesWritten["entry"] > 20*uint64(len(jsonData(1))))
+	assert.True(t, v.SegmentsCut > 0)
+	assert.True(t, v.RecordsReplayed > uint64(len(ents)))
+	assert.True(t, v.Fsync.Count > 0)
+	assert.Equal(t, v.Fsync.Count, v.Fsync.Buckets["+Inf"])
+
+	paths, offs, _ := entryOffsets(t, p)
+	flipAt(t, paths[len(paths)-1], offs[len(offs)-1]+frameSizeBytes+40)
+	w, err = Open(p, &walpb.Snapshot{}, opts...)
+	assert.Empty(t, err)
+	_, _, _, err = w.ReadAll()
+	assert.True(t, errors.Is(err, walpb.ErrCRCMismatch), "%v", err)
+	assert.Empty(t, w.Close())
+	assert.Equal(t, uint64(1), c.crcFailures)
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.002, 0.004})
+	for _, d := range []time.Duration{time.Millisecond, 1500 * time.Microsecond, time.Second} {
+		h.observe(d.Seconds())
+	}
+	assert.Equal(t, []uint64{1, 1, 0, 1}, h.counts)
+	eh := h.expvar()
+	assert.Equal(t, map[string]uint64{"0.001": 1, "0.002": 2, "0.004": 2, "+Inf": 3}, eh.Buckets)
+}
@@ -0,0 +1,312 @@
+package wal
+
+import (
+	"fmt"
+	"hash"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/amazingchow/photon-dance-wal/crc"
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// Options holds the per-instance configuration of a WAL.
+type Options struct {
+	// segmentSizeBytes is the preallocated size of each wal segment file.
+	segmentSizeBytes int64
+	// pageBytes is the alignment for flushing records to the segment file.
+	pageBytes int
+	// maxRecordBytes is the upper bound of a single encoded record.
+	maxRecordBytes int64
+	// filePerm is the permission used when creating segment files.
+	filePerm os.FileMode
+	// unsafeNoSync disables fsync; only use it for tests or ephemeral data.
+	unsafeNoSync bool
+	// syncPolicy decides when saves are synced.
+	syncPolicy SyncPolicy
+	// syncMethod is the system call used to sync.
+	syncMethod SyncMethod
+	// fullSyncInterval bounds the time between two full syncs with
+	// SyncFileRange.
+	fullSyncInterval time.Duration
+	// groupCommitWindow is how long the writer goroutine waits for more
+	// concurrent saves before committing.
+	groupCommitWindow time.Duration
+	// codec compresses the data of the records written, nil for none.
+	codec Codec
+	// compressMinBytes is the size from which record data is compressed.
+	compressMinBytes int
+	// codecs are the codecs other than the built-in ones records are read
+	// with, by ID.
+	codecs map[uint32]Codec
+	// keys supplies the keys records are encrypted with, nil for none.
+	keys KeyProvider
+	// encryptMetadata encrypts the metadata records too.
+	encryptMetadata bool
+	// fragmentBytes is the size above which entries are split into
+	// fragment records of that size, 0 to never split them.
+	fragmentBytes int
+	// checksum is the checksum chained over the records. It is set by
+	// Create and read from the segments otherwise.
+	checksum walpb.ChecksumType
+	// keepSealed makes decoders without keys return encrypted records as
+	// stored, for the checks that only need the crc chain.
+	keepSealed bool
+	// rawRecords makes decoders return every record as stored, neither
+	// decrypted nor decompressed, for Repair, which only needs the crc chain.
+	rawRecords bool
+
+	// fs is the filesystem the WAL runs on.
+	fs fileutil.FS
+	// metrics receives the measurements of the WAL.
+	metrics Metrics
+
+	lg Logger
+}
+
+// Option configures a WAL instance.
+type Option func(*Options)
+
+// WithSegmentSizeBytes sets the preallocated size of each segment file.
+func WithSegmentSizeBytes(n int64) Option {
+	return func(opts *Options) { opts.segmentSizeBytes = n }
+}
+
+// WithPageBytes sets the alignment for flushing records to the segment file.
+// It must be a positive multiple of the minimum sector size (512 bytes),
+// otherwise torn writes cannot be told apart from data corruption. It is
+// recorded in the segment headers: an existing WAL keeps the page size it was
+// created with.
+func WithPageBytes(n int) Option {
+	return func(opts *Options) { opts.pageBytes = n }
+}
+
+// WithMaxRecordBytes sets the bound of the size of a record. Saving a larger
+// entry fails with ErrMaxWALEntrySizeLimitExceeded, unless fragmentation is
+// enabled, and the decoder refuses larger records.
+func WithMaxRecordBytes(n int64) Option {
+	return func(opts *Options) { opts.maxRecordBytes = n }
+}
+
+// WithFilePerm sets the permission used when creating segment files.
+func WithFilePerm(perm os.FileMode) Option {
+	return func(opts *Options) { opts.filePerm = perm }
+}
+
+// WithUnsafeNoFsync disables fsync. Data saved to the WAL may be lost on
+// power failure.
+func WithUnsafeNoFsync() Option {
+	return func(opts *Options) { opts.unsafeNoSync = true }
+}
+
+// WithSyncPolicy sets when saves are synced, see SyncPolicy.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(opts *Options) { opts.syncPolicy = p }
+}
+
+// WithSyncMethod sets the system call used to sync, see SyncMethod.
+func WithSyncMethod(m SyncMethod) Option {
+	return func(opts *Options) { opts.syncMethod = m }
+}
+
+// WithFullSyncInterval sets the longest time between two full syncs when
+// syncing with SyncFileRange.
+func WithFullSyncInterval(d time.Duration) Option {
+	return func(opts *Options) { opts.fullSyncInterval = d }
+}
+
+// WithGroupCommitWindow makes the writer goroutine wait for d before
+// committing, so that more concurrent saves join its batch. It trades
+// latency for fewer syncs; by default only the saves that queue up during
+// the previous sync are batched.
+func WithGroupCommitWindow(d time.Duration) Option {
+	return func(opts *Options) { opts.groupCommitWindow = d }
+}
+
+// WithCompression compresses the data of the records written with c when
+// it has at least minBytes and gets smaller. The records keep the ID of c,
+// and c is also used to read records back.
+func WithCompression(c Codec, minBytes int) Option {
+	return func(opts *Options) {
+		opts.codec, opts.compressMinBytes = c, minBytes
+		WithCodecs(c)(opts)
+	}
+}
+
+// WithCodecs adds codecs records can be read with, besides the built-in
+// ones, for WALs written by another instance with custom codecs.
+func WithCodecs(cs ...Codec) Option {
+	return func(opts *Options) {
+		if opts.codecs == nil {
+			opts.codecs = make(map[uint32]Codec)
+		}
+		for _, c := range cs {
+			if c != nil {
+				opts.codecs[c.ID()] = c
+			}
+		}
+	}
+}
+
+// WithEncryption encrypts the entry and snapshot records written with
+// AES-GCM, with the current key of kp when their segment is started, and
+// decrypts the records read with the keys of kp. Each record keeps the ID of
+// its key, so keys are rotated at the next segment cut without rewriting the
+// older segments.
+func WithEncryption(kp KeyProvider) Option {
+	return func(opts *Options) { opts.keys = kp }
+}
+
+// WithMetadataEncryption encrypts the metadata records too. It requires
+// WithEncryption.
+func WithMetadataEncryption() Option {
+	return func(opts *Options) { opts.encryptMetadata = true }
+}
+
+// WithFragmentation splits the entries larger than n bytes into fragment
+// records of n bytes, so that entries of any size can be saved. The decoder
+// reassembles the fragments. n must leave room for the record framing below
+// the max record size.
+func WithFragmentation(n int) Option {
+	return func(opts *Options) { opts.fragmentBytes = n }
+}
+
+// WithChecksum sets the checksum chained over the records of a new WAL, to
+// walpb.ChecksumType_CRC64_ECMA for a 64-bit one. It is recorded in the
+// segment headers: an existing WAL keeps the checksum it was created with.
+func WithChecksum(t walpb.ChecksumType) Option {
+	return func(opts *Options) { opts.checksum = t }
+}
+
+// WithFS sets the filesystem the WAL runs on. It defaults to the local
+// filesystem.
+func WithFS(fs fileutil.FS) Option {
+	return func(opts *Options) { opts.fs = fs }
+}
+
+// WithMetrics sets the Metrics the WAL reports to, such as a Collector. No
+// metrics are kept by default.
+func WithMetrics(m Metrics) Option {
+	return func(opts *Options) { opts.metrics = m }
+}
+
+// WithLogger sets the logger used by the WAL, by default the global zerolog
+// logger. Use NopLogger to discard the messages.
+func WithLogger(lg Logger) Option {
+	return func(opts *Options) { opts.lg = lg }
+}
+
+func newOptions(opts []Option) *Options {
+	op := &Options{
+		segmentSizeBytes: SegmentSizeBytes,
+		pageBytes:        walPageBytes,
+		maxRecordBytes:   maxWALEntrySizeLimit,
+		filePerm:         fileutil.PrivateFileMode,
+		syncPolicy:       SyncAlways(),
+		syncMethod:       SyncFdatasync,
+		fullSyncInterval: time.Second,
+		fs:               fileutil.DefaultFS,
+		metrics:          nopMetrics{},
+		lg:               NewZerologLogger(log.Logger),
+	}
+	op.applyOpts(opts)
+	return op
+}
+
+func (op *Options) applyOpts(opts []Option) {
+	for _, opt := range opts {
+		opt(op)
+	}
+}
+
+func (op *Options) validate() error {
+	if op.segmentSizeBytes <= 0 {
+		return fmt.Errorf("wal: invalid segment size %d", op.segmentSizeBytes)
+	}
+	if op.pageBytes <= 0 || op.pageBytes%minSectorSize != 0 {
+		return fmt.Errorf("wal: page size %d is not a multiple of %d", op.pageBytes, minSectorSize)
+	}
+	if op.maxRecordBytes <= 0 {
+		return fmt.Errorf("wal: invalid max record size %d", op.maxRecordBytes)
+	}
+	if op.syncPolicy == nil {
+		return fmt.Errorf("wal: missing sync policy")
+	}
+	if op.syncMethod < SyncFdatasync || op.syncMethod > SyncFileRange {
+		return fmt.Errorf("wal: unknown sync method %d", op.syncMethod)
+	}
+	if op.syncMethod == SyncFileRange && op.fullSyncInterval <= 0 {
+		return fmt.Errorf("wal: invalid full sync interval %v", op.fullSyncInterval)
+	}
+	if op.fs == nil {
+		return fmt.Errorf("wal: missing filesystem")
+	}
+	if op.metrics == nil {
+		return fmt.Errorf("wal: missing metrics")
+	}
+	if op.lg == nil {
+		return fmt.Errorf("wal: missing logger")
+	}
+	if op.groupCommitWindow < 0 {
+		return fmt.Errorf("wal: invalid group commit window %v", op.groupCommitWindow)
+	}
+	if op.compressMinBytes < 0 {
+		return fmt.Errorf("wal: invalid compression threshold %d", op.compressMinBytes)
+	}
+	for id := range op.codecs {
+		if id == 0 {
+			return fmt.Errorf("wal: codec ID 0 is reserved for raw data")
+		}
+		if _, ok := builtinCodecs[id]; !ok && id <= maxBuiltinCodec {
+			return fmt.Errorf("wal: codec ID %d is reserved for built-in codecs", id)
+		}
+	}
+	if op.fragmentBytes < 0 || (op.fragmentBytes > 0 && int64(op.fragmentBytes)+recordOverheadBytes >= op.maxRecordBytes) {
+		return fmt.Errorf("wal: invalid fragment size %d for max record size %d", op.fragmentBytes, op.maxRecordBytes)
+	}
+	if _, ok := checksums[op.checksum]; !ok {
+		return fmt.Errorf("wal: unknown checksum %v", op.checksum)
+	}
+	if op.encryptMetadata && op.keys == nil {
+		return fmt.Errorf("wal: metadata encryption without a key provider")
+	}
+	return nil
+}
+
+// checksums are the implementations of the checksums of the segment headers.
+var checksums = map[walpb.ChecksumType]crc.Checksum{
+	walpb.ChecksumType_CRC32C:     crc.CRC32C,
+	walpb.ChecksumType_CRC64_ECMA: crc.CRC64ECMA,
+}
+
+// newDigest returns a digest of the checksum of the WAL starting from prev.
+func (op *Options) newDigest(prev uint64) hash.Hash64 {
+	return checksums[op.checksum].New(prev)
+}
+
+// codecByID returns the codec with the given ID, nil if it is unknown.
+func (op *Options) codecByID(id uint32) Codec {
+	if c, ok := op.codecs[id]; ok {
+		return c
+	}
+	return builtinCodecs[id]
+}
+
+// syncFlag returns the extra flag to open the segment files for writing with.
+func (op *Options) syncFlag() int {
+	if op.syncMethod == SyncODsync {
+		return fileutil.O_DSYNC
+	}
+	return 0
+}
+
+// preallocate preallocates the segment file f to the segment size.
+func (op *Options) preallocate(f fileutil.File) error {
+	start := time.Now()
+	err := op.fs.Preallocate(f, op.segmentSizeBytes, true)
+	op.metrics.ObservePreallocate(time.Since(start))
+	return err
+}
@@ -0,0 +1,204 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+)
+
+// Retention limits the history Purge keeps before the segment covering the
+// snapshot. Segments are kept, newest first, as long as they are within all
+// the limits; zero fields impose no limit. The zero Retention keeps nothing
+// before the snapshot.
+type Retention struct {
+	MaxSegments int           // max number of segments in the directory
+	MaxBytes    int64         // max total size of the segments in the directory
+	MaxAge      time.Duration // max time since a segment was last written
+}
+
+func (r Retention) unlimited() bool {
+	return r.MaxSegments <= 0 && r.MaxBytes <= 0 && r.MaxAge <= 0
+}
+
+// keeps reports whether a segment is kept, given the number and the total
+// size of the segments from it to the newest one.
+func (r Retention) keeps(n int, size int64, modTime time.Time) bool {
+	if r.unlimited() {
+		return false
+	}
+	if r.MaxSegments > 0 && n > r.MaxSegments {
+		return false
+	}
+	if r.MaxBytes > 0 && size > r.MaxBytes {
+		return false
+	}
+	if r.MaxAge > 0 && time.Since(modTime) > r.MaxAge {
+		return false
+	}
+	return true
+}
+
+// Purge deletes the segment files in dirpath whose entries are all before
+// snapIndex, except those kept by the retention r, and returns the paths of
+// the deleted files, oldest first.
+//
+// The newest segment covering snapIndex, which is where Open starts reading
+// at that snapshot, and all later segments are never deleted. Neither is any
+// segment still locked by a WAL, see ReleaseLockTo; Purge stops at the first
+// locked segment so that the remaining segments stay contiguous. The
+// directory is synced after deleting.
+func Purge(dirpath string, snapIndex uint64, r Retention, opts ...Option) ([]string, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	names, err := readWALNames(o, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	last, ok, err := searchIndex(names, snapIndex)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	// find the oldest segment kept, walking from the newest one
+	keep := last
+	var size int64
+	for i := len(names) - 1; i >= 0; i-- {
+		fi, err := o.fs.Stat(filepath.Join(dirpath, names[i]))
+		if err != nil {
+			return nil, err
+		}
+		size += fi.Size()
+		if i < last {
+			if !r.keeps(len(names)-i, size, fi.ModTime()) {
+				break
+			}
+			keep = i
+		}
+	}
+
+	var removed []string
+	for _, name := range names[:keep] {
+		path := filepath.Join(dirpath, name)
+		l, err := o.fs.TryLockFile(path, os.O_WRONLY, o.filePerm)
+		if err == fileutil.ErrLocked {
+			o.lg.Warn("stopped purging at a locked WAL segment", "path", path)
+			break
+		}
+		if err != nil {
+			return removed, err
+		}
+		if err = o.fs.Remove(path); err != nil {
+			l.Close()
+			return removed, err
+		}
+		l.Close()
+		o.lg.Info("purged WAL segment", "path", path)
+		removed = append(removed, path)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	dirFile, err := o.fs.OpenDir(dirpath)
+	if err != nil {
+		return removed, err
+	}
+	defer dirFile.Close()
+	return removed, o.fs.Fsync(dirFile)
+}
+
+// PurgeReport is the outcome of a purge run by a Purger.
+type PurgeReport struct {
+	Removed []string // paths of the deleted files
+	Err     error
+}
+
+// Purger runs Purge periodically in the background, see StartPurger.
+type Purger struct {
+	reportc chan PurgeReport
+	stopc   chan struct{}
+	donec   chan struct{}
+}
+
+// StartPurger starts purging dirpath every interval, up to the snapshot index
+// returned by snapIndex at that time, keeping the history allowed by r.
+//
+// Runs that removed a file or failed are reported on Reports. The purger never
+// waits for the consumer: a report still unread is merged into the next one.
+// The interval must be positive.
+func StartPurger(dirpath string, interval time.Duration, snapIndex func() uint64, r Retention, opts ...Option) (*Purger, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("wal: invalid purge interval %v", interval)
+	}
+	p := &Purger{
+		reportc: make(chan PurgeReport, 1),
+		stopc:   make(chan struct{}),
+		donec:   make(chan struct{}),
+	}
+	go p.run(dirpath, interval, snapIndex, r, opts)
+	return p, nil
+}
+
+// Reports returns the channel purge runs are reported on. It holds at most
+// one report, which adds up the runs since the last one read, and is closed
+// once the purger has stopped.
+func (p *Purger) Reports() <-chan PurgeReport { return p.reportc }
+
+// Stop stops the purger and waits for the purge in progress, if any.
+func (p *Purger) Stop() {
+	select {
+	case <-p.stopc:
+	default:
+		close(p.stopc)
+	}
+	<-p.donec
+}
+
+func (p *Purger) run(dirpath string, interval time.Duration, snapIndex func() uint64, r Retention, opts []Option) {
+	defer close(p.donec)
+	defer close(p.reportc)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, err := Purge(dirpath, snapIndex(), r, opts...)
+		if len(removed) > 0 || err != nil {
+			p.report(PurgeReport{Removed: removed, Err: err})
+		}
+		select {
+		case <-ticker.C:
+		case <-p.stopc:
+			return
+		}
+	}
+}
+
+// report queues rep on reportc without blocking, merging the report still
+// unread into it. The purger is the only sender, so this takes at most two
+// rounds.
+func (p *Purger) report(rep PurgeReport) {
+	for {
+		select {
+		case p.reportc <- rep:
+			return
+		default:
+		}
+		select {
+		case old := <-p.reportc:
+			rep.Removed = append(old.Removed, rep.Removed...)
+			if rep.Err == nil {
+				rep.Err = old.Err
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// createSegments creates a WAL in p with entries 1 to n spread over several
+// segments and returns it, still open.
+func createSegments(t *testing.T, p string, n int) *WAL {
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(1024))
+	assert.Empty(t, err)
+	data := make([]byte, 100)
+	for i := 1; i <= n; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	return w
+}
+
+func TestPurge(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w := createSegments(t, p, 40)
+	snap := &walpb.Snapshot{Index: 30, Term: 1}
+	err = w.SaveSnapshot(snap)
+	assert.Empty(t, err)
+
+	// all segments are still locked by w
+	removed, err := Purge(p, snap.Index, Retention{})
+	assert.Empty(t, err)
+	assert.Empty(t, removed)
+
+	err = w.ReleaseLockTo(snap.Index)
+	assert.Empty(t, err)
+	names, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	last, _, err := searchIndex(names, snap.Index)
+	assert.Empty(t, err)
+	assert.True(t, last > 1)
+
+	removed, err = Purge(p, snap.Index, Retention{})
+	assert.Empty(t, err)
+	assert.Equal(t, last, len(removed))
+	for i, path := range removed {
+		assert.Equal(t, filepath.Join(p, names[i]), path)
+	}
+	left, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.Equal(t, names[last:], left)
+	w.Close()
+
+	w, err = Open(p, snap)
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 10, len(ents))
+	assert.Equal(t, uint64(31), ents[0].Index)
+}
+
+func TestPurgeRetention(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w := createSegments(t, p, 40)
+	defer w.Close()
+	err = w.ReleaseLockTo(40)
+	assert.Empty(t, err)
+	names, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.True(t, len(names) > 3)
+
+	// recent segments are kept
+	removed, err := Purge(p, 40, Retention{MaxAge: time.Hour})
+	assert.Empty(t, err)
+	assert.Empty(t, removed)
+
+	removed, err = Purge(p, 40, Retention{MaxSegments: 3})
+	assert.Empty(t, err)
+	assert.Equal(t, len(names)-3, len(removed))
+	left, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.Equal(t, names[len(names)-3:], left)
+
+	// the newest segment covering the snapshot is always kept
+	removed, err = Purge(p, 40, Retention{MaxBytes: 1})
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(removed))
+	left, err = readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.Equal(t, names[len(names)-1:], left)
+}
+
+func TestPurger(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w := createSegments(t, p, 40)
+	defer w.Close()
+	err = w.ReleaseLockTo(40)
+	assert.Empty(t, err)
+
+	_, err = StartPurger(p, 0, func() uint64 { return 40 }, Retention{})
+	assert.NotEmpty(t, err)
+	pr, err := StartPurger(p, 10*time.Millisecond, func() uint64 { return 40 }, Retention{})
+	assert.Empty(t, err)
+	select {
+	case rep := <-pr.Reports():
+		assert.Empty(t, rep.Err)
+		assert.NotEmpty(t, rep.Removed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for purge")
+	}
+	pr.Stop()
+	for range pr.Reports() {
+	}
+
+	names, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 1, len(names))
+}
+
+func TestPurgerUnreadReports(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	// every run fails on the missing directory, and nobody reads the reports
+	var runs int32
+	pr, err := StartPurger(filepath.Join(p, "missing"), time.Millisecond, func() uint64 {
+		atomic.AddInt32(&runs, 1)
+		return 0
+	}, Retention{})
+	assert.Empty(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&runs) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("purger stalled on its reports")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pr.Stop()
+	rep, ok := <-pr.Reports()
+	assert.True(t, ok)
+	assert.NotEmpty(t, rep.Err)
+	_, ok = <-pr.Reports()
+	assert.False(t, ok)
+
+	// an unread report is merged into the next one
+	pr = &Purger{reportc: make(chan PurgeReport, 1)}
+	pr.report(PurgeReport{Removed: []string{"a"}, Err: os.ErrNotExist})
+	pr.report(PurgeReport{Removed: []string{"b"}})
+	assert.Equal(t, PurgeReport{Removed: []string{"a", "b"}, Err: os.ErrNotExist}, <-pr.reportc)
+}
@@ -0,0 +1,180 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// RepairReport describes what Repair changed, or would change in a dry run.
+type RepairReport struct {
+	Segment string // path of the damaged tail segment
+	Offset  int64  // offset following the last valid record of the segment
+	Size    int64  // size of the segment before the repair
+	Backup  string // path of the file holding the bytes from Offset on
+	// Removed is set when the segment holds no valid record at all; it is
+	// then renamed to Backup rather than truncated.
+	Removed bool
+	Cause   error // the damage found, io.ErrUnexpectedEOF for a torn write
+}
+
+// Repair fixes a WAL whose ReadAll fails because the last records of the
+// tail segment are torn or corrupted. The bytes of the tail segment from the
+// end of its last valid record on are copied to a backup file with the
+// ".broken" suffix, which Open ignores silently, then the segment is truncated
+// there and its preallocated space zeroed again. With dryRun, nothing is
+// changed.
+//
+// Repair returns a nil report if the WAL is intact. Damage before the tail
+// segment, or followed by more data in the tail segment, is the corruption of
+// durable records rather than a partial write; Repair rejects it with
+// ErrCorruptNotTail, since cutting the log there would lose acknowledged
+// entries.
+//
+// Repair only checks the crc chain, without decoding the data of the records,
+// so it needs neither the keys nor the codecs the records were written with.
+// The tail segment must not be locked by an open WAL.
+func Repair(dirpath string, dryRun bool, opts ...Option) (*RepairReport, error) {
+	o := newOptions(opts)
+	// the crc chain is checked without the keys and codecs of the records
+	o.rawRecords = true
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	names, err := readWALNames(o, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	if err = readChecksum(o, filepath.Join(dirpath, names[0])); err != nil {
+		return nil, err
+	}
+
+	var (
+		crc  uint64
+		off  int64
+		path string
+	)
+	for i, name := range names {
+		seq, _, _ := parseWALName(name)
+		path = filepath.Join(dirpath, name)
+		f, err := o.fs.OpenFile(path, os.O_RDONLY, o.filePerm)
+		if err != nil {
+			return nil, err
+		}
+		off, crc, err = scanSegment(o, f, seq, 0, -1, crc, func(*walpb.Record, position) (bool, error) {
+			return true, nil
+		})
+		f.Close()
+		if err == nil {
+			continue
+		}
+		if i != len(names)-1 {
+			o.lg.Warn("found WAL corruption before the tail segment", "error", err, "path", path, "offset", off)
+			return nil, ErrCorruptNotTail
+		}
+		return repairTail(o, path, off, err, dryRun)
+	}
+	return nil, nil
+}
+
+func repairTail(o *Options, path string, off int64, cause error, dryRun bool) (*RepairReport, error) {
+	f, err := o.fs.TryLockFile(path, os.O_RDWR, o.filePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &RepairReport{Segment: path, Offset: off, Size: fi.Size(), Backup: path + ".broken", Removed: off == 0, Cause: cause}
+
+	if cause != io.ErrUnexpectedEOF {
+		// a corrupted record, unlike a torn one, may be followed by valid ones
+		if more, err := dataAfterRecord(f, off, r.Size); err != nil || more {
+			if err != nil {
+				return nil, err
+			}
+			o.lg.Warn("found WAL corruption followed by more records", "error", cause, "path", path, "offset", off)
+			return nil, ErrCorruptNotTail
+		}
+	}
+
+	o.lg.Info("repairing WAL tail segment", "error", cause, "path", path, "offset", off, "dry-run", dryRun)
+	if dryRun {
+		return r, nil
+	}
+
+	dir, err := o.fs.OpenDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	if r.Removed {
+		if err = o.fs.Rename(path, r.Backup); err != nil {
+			return nil, err
+		}
+		return r, o.fs.Fsync(dir)
+	}
+
+	// back up the damaged bytes, durably, before dropping them
+	bf, err := o.fs.OpenFile(r.Backup, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, o.filePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(bf, io.NewSectionReader(f, off, r.Size-off)); err == nil {
+		err = o.fs.Fsync(bf)
+	}
+	bf.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = o.fs.Fsync(dir); err != nil {
+		return nil, err
+	}
+
+	if _, err = f.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err = fileutil.ZeroToEnd(o.fs, f.File); err != nil {
+		return nil, err
+	}
+	return r, o.fs.Fsync(f.File)
+}
+
+// dataAfterRecord reports whether there are non-zero bytes after the record
+// whose frame starts at off in the segment f of the given size. Only the
+// frame header is trusted to locate the end of the record.
+func dataAfterRecord(f io.ReaderAt, off, size int64) (bool, error) {
+	end := off + frameSizeBytes
+	var frame [frameSizeBytes]byte
+	if _, err := f.ReadAt(frame[:], off); err != nil && err != io.EOF {
+		return false, err
+	}
+	recBytes, padBytes := decodeFrameSize(int64(binary.LittleEndian.Uint64(frame[:])))
+	if recBytes >= 0 && end+recBytes+padBytes <= size {
+		end += recBytes + padBytes
+	}
+
+	buf := make([]byte, 32*1024)
+	for end < size {
+		n, err := f.ReadAt(buf, end)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return true, nil
+			}
+		}
+		end += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto" // nolint
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// entryOffsets returns the segment path and offset of every entry record,
+// and of the record following it.
+func entryOffsets(t *testing.T, p string, opts ...Option) (paths []string, offs, next []int64) {
+	err := ScanRecords(p, func(ri RecordInfo) error {
+		if len(next) < len(offs) {
+			next = append(next, ri.Offset)
+		}
+		if ri.Record.Type == walpb.RecordType_EntryType {
+			paths = append(paths, filepath.Join(p, ri.Segment))
+			offs = append(offs, ri.Offset)
+		}
+		return nil
+	}, opts...)
+	assert.Empty(t, err)
+	return paths, offs, next
+}
+
+// writeAt overwrites the file at path with b at off.
+func writeAt(t *testing.T, path string, off int64, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	assert.Empty(t, err)
+	_, err = f.WriteAt(b, off)
+	assert.Empty(t, err)
+	assert.Empty(t, f.Close())
+}
+
+// flipAt inverts the byte at off in the file at path.
+func flipAt(t *testing.T, path string, off int64) {
+	b, err := ioutil.ReadFile(path)
+	assert.Empty(t, err)
+	writeAt(t, path, off, []byte{^b[off]})
+}
+
+func createRepairWAL(t *testing.T, n int) (string, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	p := filepath.Join(dir, "wal")
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(4096))
+	assert.Empty(t, err)
+	for i := 1; i <= n; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 200)
+		err = w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	assert.Empty(t, w.Close())
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func readAllEntries(t *testing.T, p string) ([]*walpb.Entry, error) {
+	w, err := Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	return ents, err
+}
+
+func TestRepairTornTail(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 30)
+	defer cleanup()
+
+	// zero the last entry past its frame, as a torn write leaves it
+	paths, offs, next := entryOffsets(t, p)
+	last, off := paths[len(paths)-1], offs[len(offs)-1]
+	writeAt(t, last, off+frameSizeBytes, make([]byte, next[len(next)-1]-off-frameSizeBytes))
+	_, err := readAllEntries(t, p)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	before, err := ioutil.ReadFile(last)
+	assert.Empty(t, err)
+	r, err := Repair(p, true)
+	assert.Empty(t, err)
+	assert.Equal(t, &RepairReport{Segment: last, Offset: off, Size: int64(len(before)), Backup: last + ".broken", Cause: io.ErrUnexpectedEOF}, r)
+	after, err := ioutil.ReadFile(last)
+	assert.Empty(t, err)
+	assert.Equal(t, before, after, "dry run changed the segment")
+	_, err = os.Stat(r.Backup)
+	assert.True(t, os.IsNotExist(err))
+
+	r, err = Repair(p, false)
+	assert.Empty(t, err)
+	assert.Equal(t, off, r.Offset)
+	backup, err := ioutil.ReadFile(r.Backup)
+	assert.Empty(t, err)
+	assert.Equal(t, before[off:], backup)
+	after, err = ioutil.ReadFile(last)
+	assert.Empty(t, err)
+	assert.Equal(t, len(before), len(after))
+	assert.Equal(t, make([]byte, len(after)-int(off)), after[off:])
+
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 29, len(ents))
+	// the backup is left alone by Open
+	lg := &recordLogger{}
+	w, err := Open(p, &walpb.Snapshot{}, WithLogger(lg))
+	assert.Empty(t, err)
+	assert.Empty(t, w.Close())
+	assert.NotContains(t, lg.msgs, "ignored file in WAL directory")
+	r, err = Repair(p, false)
+	assert.Empty(t, err)
+	assert.Nil(t, r)
+}
+
+func TestRepairCorruptLastRecord(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 30)
+	defer cleanup()
+
+	// flip the last data byte of the last record, which is followed by nothing
+	paths, offs, _ := entryOffsets(t, p)
+	last := paths[len(paths)-1]
+	var (
+		stateOff int64
+		size     int
+	)
+	err := ScanRecords(p, func(ri RecordInfo) error {
+		stateOff, size = ri.Offset, proto.Size(ri.Record)
+		return nil
+	})
+	assert.Empty(t, err)
+	assert.True(t, stateOff > offs[len(offs)-1])
+	flipAt(t, last, stateOff+frameSizeBytes+int64(size)-1)
+
+	r, err := Repair(p, false)
+	assert.Empty(t, err)
+	assert.Equal(t, stateOff, r.Offset)
+	assert.True(t, errors.Is(r.Cause, walpb.ErrCRCMismatch), "%v", r.Cause)
+	ents, err := readAllEntries(t, p)
+	assert.Empty(t, err)
+	assert.Equal(t, 30, len(ents))
+}
+
+func TestRepairRejectsMidLogCorruption(t *testing.T) {
+	p, cleanup := createRepairWAL(t, 60)
+	defer cleanup()
+
+	paths, offs, _ := entryOffsets(t, p)
+	assert.NotEqual(t, paths[0], paths[len(paths)-1])
+
+	// in the tail segment, followed by more records
+	i := len(paths) - 3
+	assert.Equal(t, paths[i], paths[len(paths)-1])
+	flipAt(t, paths[i], offs[i]+frameSizeBytes+10)
+	_, err := Repair(p, true)
+	assert.Equal(t, ErrCorruptNotTail, err)
+
+	// before the tail segment
+	flipAt(t, paths[i], offs[i]+frameSizeBytes+10)
+	flipAt(t, paths[0], offs[0]+frameSizeBytes+10)
+	r, err := Repair(p, false)
+	assert.Equal(t, ErrCorruptNotTail, err)
+	assert.Nil(t, r)
+}
+
+func TestRepairUnknownCodec(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "wal")
+
+	c := idCodec{FlateCodec(flate.BestSpeed), 20}
+	w, err := Create(p, []byte("metadata"), WithCompression(c, 0))
+	assert.Empty(t, err)
+	for i := 1; i <= 3; i++ {
+		assert.Empty(t, w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: jsonData(i)}}))
+	}
+	assert.Empty(t, w.Close())
+
+	// the records of a codec Repair is not given are no damage
+	r, err := Repair(p, false)
+	assert.Empty(t, err)
+	assert.Nil(t, r)
+
+	paths, offs, next := entryOffsets(t, p, WithCodecs(c))
+	last, off := paths[len(paths)-1], offs[len(offs)-1]
+	writeAt(t, last, off+frameSizeBytes, make([]byte, next[len(next)-1]-off-frameSizeBytes))
+	r, err = Repair(p, false)
+	assert.Empty(t, err)
+	assert.Equal(t, off, r.Offset)
+	assert.Equal(t, io.ErrUnexpectedEOF, r.Cause)
+
+	w, err = Open(p, &walpb.Snapshot{}, WithCodecs(c))
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(ents))
+	assert.Equal(t, jsonData(2), ents[1].Data)
+}
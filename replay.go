@@ -0,0 +1,241 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// Replay reads out records of the current WAL like ReadAll, but decodes one
+// record at a time and hands each entry after the opened snapshot to fn
+// instead of keeping them all in memory.
+//
+// Entries are passed in log order. When raft rewrote a conflicting suffix,
+// fn sees an entry whose index is not larger than the previous one; the
+// caller must then drop everything it holds from that index on. As with
+// ReadAll, such an overwrite is only accepted if its term is higher.
+//
+// If fn returns an error, Replay stops and returns it; the WAL cannot be
+// appended to afterwards and should be closed. Otherwise, once all records
+// are read, the WAL is ready for appending exactly as after ReadAll.
+func (w *WAL) Replay(fn func(ent *walpb.Entry) error) (metadata []byte, state *walpb.HardState, err error) {
+	return w.ReplayContext(context.Background(), fn)
+}
+
+// ReplayContext is like Replay, but stops with ctx.Err() between two records
+// once ctx is done, as if fn had returned it.
+func (w *WAL) ReplayContext(ctx context.Context, fn func(ent *walpb.Entry) error) (metadata []byte, state *walpb.HardState, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	metadata, state, err = w.replay(ctx, fn)
+	if err != nil && err != ErrSnapshotNotFound {
+		return nil, nil, err
+	}
+	return metadata, state, err
+}
+
+func (w *WAL) replay(ctx context.Context, fn func(ent *walpb.Entry) error) (metadata []byte, state *walpb.HardState, err error) {
+	rec := &walpb.Record{}
+
+	if w.decoder == nil {
+		return nil, nil, ErrDecoderNotFound
+	}
+	state = &walpb.HardState{}
+	decoder := w.decoder
+	tracker := &entryTracker{last: w.start.Index}
+
+	var (
+		match   bool
+		records int
+	)
+	defer func(start time.Time) {
+		w.opts.metrics.ObserveReplay(time.Since(start), records)
+	}(time.Now())
+	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		records++
+		switch rec.GetType() {
+		case walpb.RecordType_EntryType:
+			ent := &walpb.Entry{}
+			proto.Unmarshal(rec.GetData(), ent) // nolint
+			if ent.Index > w.start.Index {
+				if err = tracker.track(ent); err != nil {
+					if err == ErrSliceOutOfRange {
+						err = decoder.corruption(decoder.lastRecOff, rec.Type, err)
+					}
+					return nil, nil, err
+				}
+				pos := position{seq: w.startSeq + uint64(decoder.consumed), off: decoder.lastRecOff}
+				w.index.add(ent.Index, pos, decoder.lastRecCRC)
+				if err = fn(ent); err != nil {
+					return nil, nil, err
+				}
+			}
+			w.enti = ent.Index
+			decoder.lastIndex = ent.Index
+
+		case walpb.RecordType_StateType:
+			state = &walpb.HardState{}
+			proto.Unmarshal(rec.GetData(), state) // nolint
+
+		case walpb.RecordType_MetadataType:
+			if metadata != nil && !bytes.Equal(metadata, rec.GetData()) {
+				return nil, nil, ErrMetadataConflict
+			}
+			metadata = rec.GetData()
+
+		case walpb.RecordType_CrcType:
+			crc := decoder.crc.Sum64()
+			// current crc of decoder must match the crc of the record.
+			// do no need to match 0 crc, since the decoder is a new one at this case.
+			if crc != 0 && rec.Validate(crc) != nil {
+				w.opts.metrics.ObserveCRCFailure()
+				return nil, nil, decoder.corruption(decoder.lastRecOff, walpb.RecordType_CrcType, ErrCRCMismatch)
+			}
+			decoder.updateCRC(rec.Crc)
+
+		case walpb.RecordType_HeaderType:
+			// checked when the segment was opened
+
+		case walpb.RecordType_SnapshotType:
+			var snap walpb.Snapshot
+			proto.Unmarshal(rec.Data, &snap) // nolint
+			if snap.Index == w.start.Index {
+				if snap.Term != w.start.Term {
+					return nil, nil, ErrSnapshotMismatch
+				}
+				match = true
+			}
+
+		default:
+			return nil, nil, decoder.corruption(decoder.lastRecOff, rec.Type, ErrUnexpectedRecordType)
+		}
+	}
+
+	switch w.tail() {
+	case nil:
+		// We do not have to read out all entries in read mode.
+		// The last record maybe a partial written one, so
+		// ErrunexpectedEOF might be returned.
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+	default:
+		// We must read all of the entries if WAL is opened in write mode.
+		if err != io.EOF {
+			return nil, nil, err
+		}
+		// decodeRecord() will return io.EOF if it detects a zero record,
+		// but this zero record may be followed by non-zero records from
+		// a torn write. Overwriting some of these non-zero records, but
+		// not all, will cause CRC errors on WAL open. Since the records
+		// were never fully synced to disk in the first place, it's safe
+		// to zero them out to avoid any CRC errors from new writes.
+		if _, err = w.tail().Seek(w.decoder.lastOffset(), io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		if err = fileutil.ZeroToEnd(w.opts.fs, w.tail().File); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = nil
+	if !match {
+		err = ErrSnapshotNotFound
+	}
+
+	// close decoder, disable reading
+	if w.readClose != nil {
+		w.readClose()
+		w.readClose = nil
+	}
+	w.start = &walpb.Snapshot{}
+
+	w.metadata = metadata
+	w.state = state
+
+	w.replaced = tracker.replaced
+	if tracker.replaced > 0 {
+		w.opts.lg.Info("replaced conflicting entries with higher term during recovery", "replaced-entries", tracker.replaced)
+	}
+
+	if w.tail() != nil {
+		// create encoder (chain crc with the decoder), enable appending
+		w.encoder, err = newFileEncoder(w.tail().File, w.decoder.lastCRC(), w.opts)
+		if err != nil {
+			return
+		}
+		w.markDurable()
+	}
+	w.decoder = nil
+
+	return metadata, state, err
+}
+
+// termRun is a run of consecutive entries sharing the same term,
+// starting at index.
+type termRun struct {
+	index uint64
+	term  uint64
+}
+
+// entryTracker follows the indexes and terms of replayed entries without
+// keeping the entries themselves, so that overwrites can be validated
+// while streaming.
+type entryTracker struct {
+	last     uint64    // index of the last tracked entry
+	runs     []termRun // term runs of the tracked entries, by increasing index
+	replaced uint64    // number of entries overwritten so far
+}
+
+func (t *entryTracker) track(ent *walpb.Entry) error {
+	if ent.Index > t.last+1 {
+		// a gap in the log
+		return ErrSliceOutOfRange
+	}
+	if ent.Index <= t.last {
+		// an 'uncommitted' suffix is being overwritten, which is only
+		// legal when a newer leader rewrote it with a higher term. Entries
+		// written before terms were recorded carry term 0 and are
+		// overwritten unchecked, as they used to be.
+		if prev := t.termAt(ent.Index); ent.Term != 0 && ent.Term <= prev {
+			return &TermConflictError{Index: ent.Index, Term: ent.Term, PrevTerm: prev}
+		}
+		t.replaced += t.last - ent.Index + 1
+		t.truncate(ent.Index)
+	}
+	if n := len(t.runs); n == 0 || t.runs[n-1].term != ent.Term {
+		t.runs = append(t.runs, termRun{index: ent.Index, term: ent.Term})
+	}
+	t.last = ent.Index
+	return nil
+}
+
+// termAt returns the term of the tracked entry at index.
+func (t *entryTracker) termAt(index uint64) uint64 {
+	for i := len(t.runs) - 1; i >= 0; i-- {
+		if t.runs[i].index <= index {
+			return t.runs[i].term
+		}
+	}
+	return 0
+}
+
+// truncate forgets the tracked entries from index on.
+func (t *entryTracker) truncate(index uint64) {
+	i := len(t.runs)
+	for i > 0 && t.runs[i-1].index >= index {
+		i--
+	}
+	t.runs = t.runs[:i]
+	t.last = index - 1
+}
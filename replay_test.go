@@ -0,0 +1,88 @@
+package wal
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto" // nolint
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestReplay(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	for i := 1; i <= 5; i++ {
+		err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Term: 1}})
+		assert.Empty(t, err)
+	}
+	// overwrite the suffix from index 4
+	st := &walpb.HardState{Term: 2, Vote: 1, Commit: 3}
+	err = w.Save(st, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 4, Term: 2}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+
+	var indexes []uint64
+	metadata, state, err := w.Replay(func(ent *walpb.Entry) error {
+		indexes = append(indexes, ent.Index)
+		return nil
+	})
+	assert.Empty(t, err)
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.True(t, proto.Equal(st, state))
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 4}, indexes)
+	assert.Equal(t, uint64(2), w.ReplacedEntries())
+
+	// the WAL switched to append mode
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 5, Term: 2}})
+	assert.Empty(t, err)
+}
+
+func TestReplayCallbackError(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 1, Term: 1}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+
+	errStop := errors.New("stop")
+	_, _, err = w.Replay(func(ent *walpb.Entry) error { return errStop })
+	assert.Equal(t, errStop, err)
+}
+
+func TestEntryTracker(t *testing.T) {
+	tr := &entryTracker{last: 0}
+	for i := uint64(1); i <= 6; i++ {
+		assert.Empty(t, tr.track(&walpb.Entry{Index: i, Term: (i + 1) / 2}))
+	}
+	assert.Equal(t, uint64(3), tr.termAt(6))
+	assert.Equal(t, uint64(2), tr.termAt(3))
+
+	assert.Equal(t, ErrSliceOutOfRange, tr.track(&walpb.Entry{Index: 8, Term: 3}))
+	assert.True(t, errors.Is(tr.track(&walpb.Entry{Index: 3, Term: 2}), ErrEntryTermConflict))
+
+	assert.Empty(t, tr.track(&walpb.Entry{Index: 3, Term: 4}))
+	assert.Equal(t, uint64(4), tr.replaced)
+	assert.Equal(t, uint64(3), tr.last)
+	assert.Equal(t, uint64(4), tr.termAt(3))
+	assert.Equal(t, uint64(1), tr.termAt(2))
+}
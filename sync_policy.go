@@ -0,0 +1,210 @@
+package wal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// SyncPolicy decides when the records saved to the WAL are synced to stable
+// storage. Until they are, Save returns without them being durable and they
+// are not reported by DurableIndex, Follow or ReadRange.
+//
+// Cut, SaveSnapshot, TruncateSuffix, Sync and Close always sync.
+type SyncPolicy interface {
+	// ShouldSync is called after writing a save that needs to be durable,
+	// with the number of bytes written and the time elapsed since the last
+	// sync. It reports whether to sync now.
+	ShouldSync(unsyncedBytes int64, sinceLastSync time.Duration) bool
+	// Interval returns how long written data may stay unsynced; the WAL
+	// syncs in the background once it elapsed. Zero means no limit.
+	Interval() time.Duration
+}
+
+type syncAlways struct{}
+
+func (syncAlways) ShouldSync(int64, time.Duration) bool { return true }
+func (syncAlways) Interval() time.Duration              { return 0 }
+
+// SyncAlways syncs every save that needs to be durable before Save returns.
+// It is the default policy.
+func SyncAlways() SyncPolicy { return syncAlways{} }
+
+type syncEvery time.Duration
+
+func (p syncEvery) ShouldSync(_ int64, since time.Duration) bool { return since >= time.Duration(p) }
+func (p syncEvery) Interval() time.Duration                      { return time.Duration(p) }
+
+// SyncEvery syncs at most once every d, so that up to d of saves may be lost
+// on power failure.
+func SyncEvery(d time.Duration) SyncPolicy { return syncEvery(d) }
+
+type syncEveryBytes int64
+
+func (p syncEveryBytes) ShouldSync(n int64, _ time.Duration) bool { return n >= int64(p) }
+func (p syncEveryBytes) Interval() time.Duration                  { return 0 }
+
+// SyncEveryBytes syncs once at least n bytes were written since the last
+// sync.
+func SyncEveryBytes(n int64) SyncPolicy { return syncEveryBytes(n) }
+
+type syncNever struct{}
+
+func (syncNever) ShouldSync(int64, time.Duration) bool { return false }
+func (syncNever) Interval() time.Duration              { return 0 }
+
+// SyncNever only syncs when the WAL must, see SyncPolicy. Unlike
+// WithUnsafeNoFsync, saves are not reported as durable before that.
+func SyncNever() SyncPolicy { return syncNever{} }
+
+// SyncMethod is the system call used to sync the tail segment.
+type SyncMethod int
+
+const (
+	// SyncFdatasync syncs with fdatasync(2). It is the default method.
+	SyncFdatasync SyncMethod = iota
+	// SyncFsync syncs with fsync(2), flushing file metadata as well.
+	SyncFsync
+	// SyncODsync opens the segment files with O_DSYNC, so that every write
+	// of the encoder is synchronous and a sync only flushes the encoder.
+	SyncODsync
+	// SyncFileRange writes back the tail with sync_file_range(2), which
+	// neither flushes metadata nor the drive cache; a full fdatasync is
+	// issued at least every full sync interval, see WithFullSyncInterval.
+	// The saves are only durable, and reported by DurableIndex, Follow and
+	// ReadRange, once fully synced.
+	SyncFileRange
+)
+
+func (m SyncMethod) String() string {
+	switch m {
+	case SyncFdatasync:
+		return "fdatasync"
+	case SyncFsync:
+		return "fsync"
+	case SyncODsync:
+		return "O_DSYNC"
+	case SyncFileRange:
+		return "sync_file_range"
+	}
+	return "unknown"
+}
+
+// UnsyncedBytes returns the number of bytes written to the WAL since the
+// last sync that made them durable.
+func (w *WAL) UnsyncedBytes() int64 {
+	return atomic.LoadInt64(&w.unsynced)
+}
+
+// Sync makes every save that returned before durable, regardless of the sync
+// policy. Saves queued by SaveAsync meanwhile are committed first.
+func (w *WAL) Sync() error {
+	return w.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync, but gives up once ctx is done, with ctx.Err() or,
+// if the sync is under way, an error matching both ErrSaveInProgress and
+// ctx.Err(). The saves queued before are still committed.
+func (w *WAL) SyncContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f := newSaveFuture()
+	if !w.enqueue(&saveReq{barrier: true, f: f}) {
+		return ErrClosed
+	}
+	return w.waitContext(ctx, f)
+}
+
+// sync syncs the tail with the configured method. With SyncFileRange, a
+// full sync is only issued when the full sync interval elapsed.
+func (w *WAL) sync() error {
+	full := w.opts.syncMethod != SyncFileRange || time.Since(w.lastFullSync) >= w.opts.fullSyncInterval
+	return w.doSync(full)
+}
+
+// fullSync syncs the tail, including the drive cache.
+func (w *WAL) fullSync() error {
+	return w.doSync(true)
+}
+
+func (w *WAL) doSync(full bool) error {
+	if w.encoder != nil {
+		if err := w.encoder.flush(); err != nil {
+			return err
+		}
+	}
+	if w.opts.unsafeNoSync {
+		// reported durable all the same
+		w.markSynced(true)
+		return nil
+	}
+
+	start := time.Now()
+	var err error
+	switch {
+	case w.opts.syncMethod == SyncODsync:
+		// the writes were synchronous
+	case !full:
+		err = w.opts.fs.SyncFileRange(w.tail().File)
+	case w.opts.syncMethod == SyncFsync:
+		err = w.opts.fs.Fsync(w.tail().File)
+	default:
+		err = w.opts.fs.Fdatasync(w.tail().File)
+	}
+	took := time.Since(start)
+	w.opts.metrics.ObserveSync(took)
+	if took > warnSyncDuration {
+		w.opts.lg.Warn("slow sync", "sync-took", took.Seconds(), "expected-duration", warnSyncDuration.Seconds(), "sync-method", w.opts.syncMethod.String())
+	}
+	if err == nil {
+		w.markSynced(full)
+	}
+	return err
+}
+
+// markSynced records a sync. Only a full one makes the data written so far
+// durable; until then, it stays counted as unsynced.
+func (w *WAL) markSynced(full bool) {
+	now := time.Now()
+	w.lastSync = now
+	if !full {
+		return
+	}
+	w.lastFullSync = now
+	atomic.StoreInt64(&w.unsynced, 0)
+	w.opts.metrics.SetUnsyncedBytes(0)
+	w.markDurable()
+}
+
+// backgroundSyncInterval returns how often the writer goroutine checks for
+// data to sync in the background, or zero.
+func (w *WAL) backgroundSyncInterval() time.Duration {
+	d := w.opts.syncPolicy.Interval()
+	if w.opts.syncMethod == SyncFileRange && (d <= 0 || w.opts.fullSyncInterval < d) {
+		d = w.opts.fullSyncInterval
+	}
+	return d
+}
+
+// backgroundSync syncs the data that stayed unsynced longer than the policy
+// allows, and issues the periodic full sync of SyncFileRange.
+func (w *WAL) backgroundSync() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.encoder == nil || w.tail() == nil {
+		return
+	}
+
+	var err error
+	if d := w.opts.syncPolicy.Interval(); d > 0 && w.UnsyncedBytes() > 0 && time.Since(w.lastSync) >= d {
+		err = w.sync()
+	}
+	if err == nil && w.opts.syncMethod == SyncFileRange && w.lastSync.After(w.lastFullSync) &&
+		time.Since(w.lastFullSync) >= w.opts.fullSyncInterval {
+		err = w.fullSync()
+	}
+	if err != nil {
+		w.opts.lg.Warn("failed to sync WAL in the background", "error", err)
+	}
+}
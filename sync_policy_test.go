@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+func TestSyncPolicies(t *testing.T) {
+	tests := []struct {
+		p        SyncPolicy
+		unsynced int64
+		since    time.Duration
+		w        bool
+	}{
+		{SyncAlways(), 0, 0, true},
+		{SyncNever(), 1 << 30, time.Hour, false},
+		{SyncEvery(time.Second), 1 << 30, time.Millisecond, false},
+		{SyncEvery(time.Second), 1, time.Second, true},
+		{SyncEveryBytes(4096), 4095, time.Hour, false},
+		{SyncEveryBytes(4096), 4096, 0, true},
+	}
+	for i, tt := range tests {
+		assert.Equal(t, tt.w, tt.p.ShouldSync(tt.unsynced, tt.since), "#%d", i)
+	}
+	assert.Equal(t, time.Second, SyncEvery(time.Second).Interval())
+	assert.Equal(t, time.Duration(0), SyncAlways().Interval())
+}
+
+func TestSyncNever(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSyncPolicy(SyncNever()))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	for i := 1; i <= 10; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1}})
+		assert.Empty(t, err)
+	}
+	assert.True(t, w.UnsyncedBytes() > 0)
+	assert.Equal(t, uint64(0), w.DurableIndex())
+
+	// Sync is a barrier regardless of the policy
+	assert.Empty(t, w.Sync())
+	assert.Equal(t, int64(0), w.UnsyncedBytes())
+	assert.Equal(t, uint64(10), w.DurableIndex())
+}
+
+func TestSyncEveryBytes(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSyncPolicy(SyncEveryBytes(1024)))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	data := make([]byte, 100)
+	err = w.Save(nil, []walpb.Entry{{Index: 1, Term: 1, Data: data}})
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(0), w.DurableIndex())
+	for i := 2; i <= 20; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	assert.True(t, w.DurableIndex() > 1)
+	assert.True(t, w.UnsyncedBytes() < 1024)
+}
+
+func TestSyncEvery(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSyncPolicy(SyncEvery(20*time.Millisecond)))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	for i := 1; i <= 10; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1}})
+		assert.Empty(t, err)
+	}
+	// the background sync catches up with the last saves
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Empty(t, w.WaitDurable(ctx, 10))
+	assert.Equal(t, int64(0), w.UnsyncedBytes())
+}
+
+func TestSyncMethods(t *testing.T) {
+	for _, m := range []SyncMethod{SyncFdatasync, SyncFsync, SyncODsync, SyncFileRange} {
+		t.Run(m.String(), func(t *testing.T) {
+			p, err := ioutil.TempDir(os.TempDir(), "waltest")
+			assert.Empty(t, err)
+			defer os.RemoveAll(p)
+
+			opts := []Option{WithSyncMethod(m), WithSegmentSizeBytes(1024), WithFullSyncInterval(10 * time.Millisecond)}
+			w, err := Create(p, []byte("metadata"), opts...)
+			assert.Empty(t, err)
+			data := make([]byte, 100)
+			for i := 1; i <= 20; i++ {
+				err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+				assert.Empty(t, err)
+			}
+			// sync_file_range leaves the last saves to the background full sync
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			assert.Empty(t, w.WaitDurable(ctx, 20))
+			w.Close()
+
+			w, err = Open(p, &walpb.Snapshot{}, opts...)
+			assert.Empty(t, err)
+			defer w.Close()
+			_, _, ents, err := w.ReadAll()
+			assert.Empty(t, err)
+			assert.Equal(t, 20, len(ents))
+			err = w.Save(nil, []walpb.Entry{{Index: 21, Term: 1, Data: data}})
+			assert.Empty(t, err)
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto" // nolint
+
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+// TruncateSuffix durably removes every entry after index from the WAL, so
+// that a conflicting suffix dropped by raft is not replayed again. Segment
+// files that only hold removed records are deleted and the segment holding
+// the entry after index is truncated right before it; new entries are then
+// appended there, chained to the remaining records.
+//
+// Records saved after the removed entries, such as HardStates, are removed
+// as well; the latest HardState is saved again afterwards. Live followers
+// continue from the truncation point.
+// The WAL must be in append mode, and index must not be before the first
+// entry read or saved by this WAL. Once the truncation failed after changing
+// the log, every later write fails with that error.
+func (w *WAL) TruncateSuffix(index uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.werr != nil {
+		return w.werr
+	}
+	if w.encoder == nil || w.tail() == nil {
+		return ErrNotAppendMode
+	}
+	if w.index.empty() || index >= w.index.last {
+		// nothing after index
+		return nil
+	}
+	if index+1 < w.index.first {
+		return ErrIndexOutOfRange
+	}
+
+	if err := w.encoder.flush(); err != nil {
+		return err
+	}
+	pos, crc, err := w.truncatePoint(index)
+	if err != nil {
+		return err
+	}
+	// the first removal changes the log on disk; a later failure leaves it
+	// in a state no save may build on
+	return w.fail(w.truncateAt(index, pos, crc))
+}
+
+// truncateAt removes every record from pos on, the one of the entry following
+// index, with crc the crc chained up to it.
+func (w *WAL) truncateAt(index uint64, pos position, crc uint64) error {
+	// Delete the later segments first, newest first, so that a crash leaves
+	// behind a prefix of the old log with a valid crc chain.
+	i := len(w.locks) - 1
+	for ; i >= 0; i-- {
+		l := w.locks[i]
+		seq, _, err := parseWALName(filepath.Base(l.Name()))
+		if err != nil {
+			return err
+		}
+		if seq <= pos.seq {
+			break
+		}
+		if err = w.opts.fs.Remove(filepath.Join(w.dir, filepath.Base(l.Name()))); err != nil {
+			return err
+		}
+		l.Close()
+		w.opts.lg.Info("removed WAL segment while truncating suffix", "path", l.Name(), "index", index)
+	}
+	w.locks = w.locks[:i+1]
+	if err := w.opts.fs.Fsync(w.dirFile); err != nil {
+		return err
+	}
+
+	seq, err := w.seq()
+	if err != nil {
+		return err
+	}
+	if len(w.locks) == 0 || seq != pos.seq {
+		// the segment lock was released; take it back
+		seqNames, err := readWALSeqNames(w.opts, w.dir)
+		if err != nil {
+			return err
+		}
+		name, ok := seqNames[pos.seq]
+		if !ok {
+			return ErrFileNotFound
+		}
+		l, err := w.opts.fs.LockFile(filepath.Join(w.dir, name), os.O_RDWR|w.opts.syncFlag(), w.opts.filePerm)
+		if err != nil {
+			return err
+		}
+		w.locks = append(w.locks, l)
+	}
+
+	tail := w.tail()
+	if err = tail.Truncate(pos.off); err != nil {
+		return err
+	}
+	// keep the segment preallocated, with zeros after the truncation point
+	if err = w.opts.preallocate(tail.File); err != nil {
+		return err
+	}
+	if _, err = tail.Seek(pos.off, io.SeekStart); err != nil {
+		return err
+	}
+	if err = w.opts.fs.Fsync(tail.File); err != nil {
+		return err
+	}
+
+	if w.encoder, err = newFileEncoder(tail.File, crc, w.opts); err != nil {
+		return err
+	}
+	w.index.truncate(index, pos)
+	w.enti = index
+	w.markTruncated(index, pos, crc)
+
+	if err = w.saveState(w.state); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// truncatePoint returns the position of the record of the entry following
+// index, together with the crc chained up to it.
+func (w *WAL) truncatePoint(index uint64) (position, uint64, error) {
+	next := index + 1
+	cp := w.index.lookup(next)
+	if cp.index == next {
+		return cp.pos, cp.crc, nil
+	}
+
+	seqNames, err := readWALSeqNames(w.opts, w.dir)
+	if err != nil {
+		return position{}, 0, err
+	}
+	var (
+		found bool
+		at    position
+	)
+	visit := func(rec *walpb.Record, pos position) (bool, error) {
+		if rec.GetType() != walpb.RecordType_EntryType {
+			return true, nil
+		}
+		ent := &walpb.Entry{}
+		if err := proto.Unmarshal(rec.GetData(), ent); err != nil {
+			return false, err
+		}
+		if ent.Index == next && !w.index.stale(next, pos) {
+			found, at = true, pos
+			return false, nil
+		}
+		return true, nil
+	}
+
+	seq, off, crc := cp.pos.seq, cp.pos.off, cp.crc
+	for {
+		name, ok := seqNames[seq]
+		if !ok {
+			return position{}, 0, ErrFileNotFound
+		}
+		f, err := w.opts.fs.OpenFile(filepath.Join(w.dir, name), os.O_RDONLY, w.opts.filePerm)
+		if err != nil {
+			return position{}, 0, err
+		}
+		_, crc, err = scanSegment(w.opts, f, seq, off, -1, crc, visit)
+		f.Close()
+		if err != nil {
+			return position{}, 0, err
+		}
+		if found {
+			return at, crc, nil
+		}
+		seq, off = seq+1, 0
+	}
+}
@@ -0,0 +1,204 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/amazingchow/photon-dance-wal/fileutil"
+	"github.com/amazingchow/photon-dance-wal/walpb"
+)
+
+var errPreallocate = errors.New("preallocate failed")
+
+// failPreallocateFS fails Preallocate once failing is set.
+type failPreallocateFS struct {
+	fileutil.FS
+	failing bool
+}
+
+func (fs *failPreallocateFS) Preallocate(f fileutil.File, sizeInBytes int64, extendFile bool) error {
+	if fs.failing {
+		return errPreallocate
+	}
+	return fs.FS.Preallocate(f, sizeInBytes, extendFile)
+}
+
+func TestTruncateSuffix(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(1024))
+	assert.Empty(t, err)
+
+	data := make([]byte, 100)
+	for i := 1; i <= 30; i++ {
+		err = w.Save(&walpb.HardState{Term: 1, Commit: uint64(i)}, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+	names, err := readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	nsegs := len(names)
+	assert.True(t, nsegs > 2)
+
+	// nothing to truncate
+	assert.Empty(t, w.TruncateSuffix(30))
+
+	err = w.TruncateSuffix(5)
+	assert.Empty(t, err)
+	names, err = readWALNames(w.opts, p)
+	assert.Empty(t, err)
+	assert.True(t, len(names) < nsegs)
+
+	ents, err := w.ReadRange(1, 6, 0)
+	assert.Empty(t, err)
+	assert.Equal(t, 5, len(ents))
+	_, err = w.ReadRange(1, 7, 0)
+	assert.Equal(t, ErrIndexOutOfRange, err)
+
+	// appending continues right after the truncation point
+	for i := 6; i <= 8; i++ {
+		err = w.Save(&walpb.HardState{Term: 2, Commit: 5}, []walpb.Entry{{Index: uint64(i), Term: 2, Data: data}})
+		assert.Empty(t, err)
+	}
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	metadata, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, []byte("metadata"), metadata)
+	assert.Equal(t, uint64(2), state.Term)
+	assert.Equal(t, 8, len(ents))
+	for i, ent := range ents {
+		assert.Equal(t, uint64(i+1), ent.Index)
+		if ent.Index > 5 {
+			assert.Equal(t, uint64(2), ent.Term)
+		} else {
+			assert.Equal(t, uint64(1), ent.Term)
+		}
+	}
+	// the truncated entries are physically gone
+	assert.Equal(t, uint64(0), w.ReplacedEntries())
+}
+
+func TestTruncateSuffixNotAppendMode(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = OpenForRead(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, ErrNotAppendMode, w.TruncateSuffix(1))
+}
+
+func TestTruncateSuffixFollow(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(1024))
+	assert.Empty(t, err)
+	defer w.Close()
+
+	data := make([]byte, 100)
+	for i := 1; i <= 20; i++ {
+		err = w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}})
+		assert.Empty(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fl, err := w.Follow(ctx, 1)
+	assert.Empty(t, err)
+	next := func() *walpb.Entry {
+		select {
+		case ent := <-fl.Entries():
+			return ent
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for entry")
+		}
+		return nil
+	}
+	for i := 1; i <= 20; i++ {
+		assert.Equal(t, uint64(i), next().Index)
+	}
+
+	err = w.TruncateSuffix(3)
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Index: 4, Term: 2, Data: data}})
+	assert.Empty(t, err)
+
+	ent := next()
+	assert.Equal(t, uint64(4), ent.Index)
+	assert.Equal(t, uint64(2), ent.Term)
+}
+
+func TestTruncateSuffixFailed(t *testing.T) {
+	fs := &failPreallocateFS{FS: fileutil.NewMemFS()}
+	w, err := Create("/wal", []byte("metadata"), WithFS(fs), WithSegmentSizeBytes(1024))
+	assert.Empty(t, err)
+	data := make([]byte, 100)
+	for i := 1; i <= 10; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1, Data: data}}))
+	}
+
+	// the tail is truncated before the preallocation fails
+	fs.failing = true
+	assert.Equal(t, errPreallocate, w.TruncateSuffix(5))
+	fs.failing = false
+	assert.Equal(t, errPreallocate, w.Save(nil, []walpb.Entry{{Index: 6, Term: 2, Data: data}}))
+	assert.Equal(t, errPreallocate, w.Sync())
+	assert.Equal(t, errPreallocate, w.TruncateSuffix(3))
+	assert.Equal(t, errPreallocate, w.Close())
+
+	w, err = Open("/wal", &walpb.Snapshot{}, WithFS(fs))
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 5, len(ents))
+}
+
+func TestTruncateSuffixDurableIndex(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"), WithSyncMethod(SyncFileRange), WithFullSyncInterval(time.Hour))
+	assert.Empty(t, err)
+	defer w.Close()
+	for i := 1; i <= 10; i++ {
+		assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: uint64(i), Term: 1}}))
+	}
+	assert.Empty(t, w.Sync())
+	assert.Equal(t, uint64(10), w.DurableIndex())
+
+	assert.Empty(t, w.TruncateSuffix(5))
+	assert.Equal(t, uint64(5), w.DurableIndex())
+
+	// the new entry is not durable before a full sync
+	assert.Empty(t, w.Save(nil, []walpb.Entry{{Index: 6, Term: 2}}))
+	assert.Equal(t, uint64(5), w.DurableIndex())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, w.WaitDurable(ctx, 6))
+	assert.Empty(t, w.Sync())
+	assert.Equal(t, uint64(6), w.DurableIndex())
+}
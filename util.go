@@ -5,16 +5,14 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/rs/zerolog/log"
-
 	"github.com/amazingchow/photon-dance-wal/fileutil"
 )
 
 var errBadWALName = errors.New("bad wal name")
 
 // Exist returns true if there are any files in a given directory.
-func Exist(dir string) bool {
-	names, err := fileutil.ReadDir(dir, fileutil.WithExt(".wal"))
+func Exist(dir string, opts ...Option) bool {
+	names, err := fileutil.ReadDir(newOptions(opts).fs, dir, fileutil.WithExt(".wal"))
 	if err != nil {
 		return false
 	}
@@ -24,56 +22,71 @@ func Exist(dir string) bool {
 // searchIndex returns the last array index of names whose raft index section is
 // equal to or smaller than the given index.
 // The given names MUST be sorted.
-func searchIndex(names []string, index uint64) (int, bool) {
+func searchIndex(names []string, index uint64) (int, bool, error) {
 	for i := len(names) - 1; i >= 0; i-- {
 		name := names[i]
 		_, curIndex, err := parseWALName(name)
 		if err != nil {
-			log.Panic().Err(err).Str("path", name).Msg("failed to parse WAL file name")
+			return -1, false, fmt.Errorf("wal: failed to parse WAL file name %q: %w", name, err)
 		}
 		if index >= curIndex {
-			return i, true
+			return i, true, nil
 		}
 	}
-	return -1, false
+	return -1, false, nil
 }
 
 // names should have been sorted based on sequence number.
 // isValidSeq checks whether seq increases continuously.
-func isValidSeq(names []string) bool {
+func isValidSeq(names []string) (bool, error) {
 	var lastSeq uint64
 	for _, name := range names {
 		curSeq, _, err := parseWALName(name)
 		if err != nil {
-			log.Panic().Err(err).Str("path", name).Msg("failed to parse WAL file name")
+			return false, fmt.Errorf("wal: failed to parse WAL file name %q: %w", name, err)
 		}
 		if lastSeq != 0 && lastSeq != curSeq-1 {
-			return false
+			return false, nil
 		}
 		lastSeq = curSeq
 	}
-	return true
+	return true, nil
 }
 
-func readWALNames(dirpath string) ([]string, error) {
-	names, err := fileutil.ReadDir(dirpath)
+func readWALNames(opts *Options, dirpath string) ([]string, error) {
+	names, err := fileutil.ReadDir(opts.fs, dirpath)
 	if err != nil {
 		return nil, err
 	}
-	wnames := checkWalNames(names)
+	wnames := checkWalNames(opts.lg, names)
 	if len(wnames) == 0 {
 		return nil, ErrFileNotFound
 	}
 	return wnames, nil
 }
 
-func checkWalNames(names []string) []string {
+// readWALSeqNames returns the wal file names in dirpath by sequence.
+func readWALSeqNames(opts *Options, dirpath string) (map[uint64]string, error) {
+	names, err := readWALNames(opts, dirpath)
+	if err != nil {
+		return nil, err
+	}
+	seqNames := make(map[uint64]string, len(names))
+	for _, name := range names {
+		seq, _, _ := parseWALName(name)
+		seqNames[seq] = name
+	}
+	return seqNames, nil
+}
+
+func checkWalNames(lg Logger, names []string) []string {
 	wnames := make([]string, 0)
 	for _, name := range names {
 		if _, _, err := parseWALName(name); err != nil {
-			// don't complain about left over tmp files
-			if !strings.HasSuffix(name, ".tmp") {
-				log.Warn().Str("path", name).Msg("ignored file in WAL directory")
+			// don't complain about left over tmp files or the backups
+			// of Repair
+			if !strings.HasSuffix(name, ".tmp") && !strings.HasSuffix(name, ".broken") {
+				lg.Warn("ignored file in WAL directory", "path", name)
 			}
 			continue
 		}
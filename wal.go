@@ -16,9 +16,9 @@ package wal
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -27,7 +27,6 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto" // nolint
-	"github.com/rs/zerolog/log"
 
 	"github.com/amazingchow/photon-dance-wal/fileutil"
 	"github.com/amazingchow/photon-dance-wal/walpb"
@@ -40,10 +39,11 @@ const (
 )
 
 var (
-	// SegmentSizeBytes is the preallocated size of each wal segment file.
-	// The actual size might be larger than this. In general, the default
-	// value should be used, but this is defined as an exported variable
-	// so that tests can set a different segment size.
+	// SegmentSizeBytes is the default preallocated size of each wal segment
+	// file, used when WithSegmentSizeBytes is not given. The actual size might
+	// be larger than this. In general, the default value should be used, but
+	// this is defined as an exported variable so that tests can set a
+	// different segment size.
 	SegmentSizeBytes int64 = 64 * 1000 * 1000 // 64MB
 
 	ErrMetadataConflict             = errors.New("wal: conflicting metadata found")
@@ -54,77 +54,158 @@ var (
 	ErrSliceOutOfRange              = errors.New("wal: slice bounds out of range")
 	ErrMaxWALEntrySizeLimitExceeded = errors.New("wal: max entry size limit exceeded")
 	ErrDecoderNotFound              = errors.New("wal: decoder not found")
-	crcTable                        = crc32.MakeTable(crc32.Castagnoli)
+	ErrEntryTermConflict            = errors.New("wal: entry term conflict")
+	ErrNotAppendMode                = errors.New("wal: not in append mode")
+	ErrClosed                       = errors.New("wal: closed")
+	ErrIndexOutOfRange              = errors.New("wal: index out of range")
+	ErrCorruptNotTail               = errors.New("wal: corruption before the tail of the log")
+	ErrCodecNotFound                = errors.New("wal: unknown codec")
+	ErrKeyNotFound                  = errors.New("wal: encryption key not found")
+	ErrUnsupportedSegment           = errors.New("wal: unsupported segment format")
+	ErrFragmentSequence             = errors.New("wal: fragment out of sequence")
+	ErrUnexpectedRecordType         = errors.New("wal: unexpected record type")
+	ErrSaveInProgress               = errors.New("wal: save still in progress")
 )
 
+// CorruptionError locates a record that ReadAll, Replay, Verify or a scan of
+// the segments found corrupted. It matches its cause, such as ErrCRCMismatch,
+// with errors.Is; a crc mismatch matches both ErrCRCMismatch and
+// walpb.ErrCRCMismatch. Torn writes are reported as io.ErrUnexpectedEOF
+// instead.
+type CorruptionError struct {
+	Segment string // file name of the segment, empty if unknown
+	Offset  int64  // offset of the record in the segment
+	// RecordType is the type of the record, MetadataType when the record
+	// could not be decoded at all.
+	RecordType walpb.RecordType
+	LastIndex  uint64 // index of the last entry read before the record, 0 if unknown
+	Err        error  // the damage found
+}
+
+func (e *CorruptionError) Error() string {
+	segment := e.Segment
+	if segment == "" {
+		segment = "segment"
+	}
+	return fmt.Sprintf("wal: corrupted %v record in %s at offset %d after index %d: %v", e.RecordType, segment, e.Offset, e.LastIndex, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+// Is makes the crc mismatches of walpb and of this package equivalent.
+func (e *CorruptionError) Is(target error) bool {
+	isCRC := func(err error) bool { return err == ErrCRCMismatch || err == walpb.ErrCRCMismatch }
+	return isCRC(target) && isCRC(e.Err)
+}
+
+// TermConflictError is returned by ReadAll when an entry overwrites an
+// earlier entry of the same index without carrying a higher term.
+// It matches ErrEntryTermConflict with errors.Is.
+type TermConflictError struct {
+	Index    uint64 // raft index of the conflicting entries
+	Term     uint64 // term of the later entry
+	PrevTerm uint64 // term of the entry it tries to overwrite
+}
+
+func (e *TermConflictError) Error() string {
+	return fmt.Sprintf("wal: entry term conflict at index %d (term %d does not supersede term %d)", e.Index, e.Term, e.PrevTerm)
+}
+
+func (e *TermConflictError) Unwrap() error { return ErrEntryTermConflict }
+
 // WAL is a logical representation of the stable storage.
 // WAL is either in read mode or append mode but not both.
 // A newly created WAL is in append mode, and ready for appending records.
 // A just opened WAL is in read mode, and ready for reading records.
 // The WAL will be ready for appending after reading out all the previous records.
 type WAL struct {
-	dir string // the living directory of the underlay files
+	dir  string   // the living directory of the underlay files
+	opts *Options // per-instance configuration
 
-	dirFile *os.File // a fd for the wal directory for syncing on Rename
+	dirFile fileutil.File // a fd for the wal directory for syncing on Rename
 
 	metadata []byte // metadata recorded at the head of each WAL
 
 	start     *walpb.Snapshot // snapshot to start reading
+	startSeq  uint64          // sequence of the first segment to read
 	decoder   *decoder        // decoder to decode records
 	readClose func() error    // closer for decode reader
-
-	unsafeNoSync bool // if set, do not fsync
+	replaced  uint64          // number of entries overwritten during the last ReadAll
 
 	mu      sync.Mutex
-	enti    uint64   // index of the last entry saved to the wal
-	encoder *encoder // encoder to encode records
+	enti    uint64           // index of the last entry saved to the wal
+	state   *walpb.HardState // hardstate recorded at the head of each WAL
+	encoder *encoder         // encoder to encode records
+	index   entryIndex       // positions of the entries read or saved
+	// werr is the first error writing or syncing the tail, which is in an
+	// unknown state after it; every later write fails with it.
+	werr error
 
 	locks []*fileutil.LockedFile // the locked files the WAL holds (the name is increasing)
 	fp    *FilePipeline
+	wr    writer // saves waiting to be committed
+
+	unsynced     int64     // bytes written since the last sync, accessed atomically
+	lastSync     time.Time // time of the last sync
+	lastFullSync time.Time // time of the last sync that was not a sync_file_range
+
+	dmu      sync.Mutex
+	durable  position      // end of the last record known to be on stable storage
+	durablei uint64        // index of the last entry known to be on stable storage
+	durablec chan struct{} // closed and replaced whenever durable advances or the WAL closes
+	closed   bool
+	trunc    truncation // last suffix truncation, see TruncateSuffix
 }
 
 // Create creates a WAL ready for appending records. The given metadata is
 // recorded at the head of each WAL file, and can be retrieved with ReadAll
 // after the file is Open.
-func Create(dirpath string, metadata []byte) (*WAL, error) {
-	if Exist(dirpath) {
+func Create(dirpath string, metadata []byte, opts ...Option) (*WAL, error) {
+	op := newOptions(opts)
+	if err := op.validate(); err != nil {
+		return nil, err
+	}
+	if Exist(dirpath, opts...) {
 		return nil, os.ErrExist
 	}
 
 	// !!!keep temporary wal directory so WAL initialization appears atomic
 	tmpdirpath := filepath.Clean(dirpath) + ".tmp"
-	if fileutil.Exist(tmpdirpath) {
-		if err := os.RemoveAll(tmpdirpath); err != nil {
+	if fileutil.Exist(op.fs, tmpdirpath) {
+		if err := op.fs.RemoveAll(tmpdirpath); err != nil {
 			return nil, err
 		}
 	}
-	defer os.RemoveAll(tmpdirpath)
+	defer op.fs.RemoveAll(tmpdirpath)
 
-	if err := fileutil.CreateDirAll(tmpdirpath); err != nil {
-		log.Warn().Err(err).Str("tmp-dirpath", tmpdirpath).Str("dirpath", dirpath).Msg("failed to create a temporary WAL directory")
+	if err := fileutil.CreateDirAll(op.lg, op.fs, tmpdirpath); err != nil {
+		op.lg.Warn("failed to create a temporary WAL directory", "error", err, "tmp-dirpath", tmpdirpath, "dirpath", dirpath)
 		return nil, err
 	}
 
 	p := filepath.Join(tmpdirpath, walName(0, 0))
-	f, err := fileutil.LockFile(p, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
+	f, err := op.fs.LockFile(p, os.O_WRONLY|os.O_CREATE|op.syncFlag(), op.filePerm)
 	if err != nil {
-		log.Warn().Err(err).Str("path", p).Msg("failed to flock an initial WAL file")
+		op.lg.Warn("failed to flock an initial WAL file", "error", err, "path", p)
 		return nil, err
 	}
 	if _, err = f.Seek(0, io.SeekEnd); err != nil {
-		log.Warn().Err(err).Str("path", p).Msg("failed to seek an initial WAL file")
+		op.lg.Warn("failed to seek an initial WAL file", "error", err, "path", p)
 		return nil, err
 	}
-	if err = fileutil.Preallocate(f.File, SegmentSizeBytes, true); err != nil {
-		log.Warn().Err(err).Str("path", p).Int64("segment-size-bytes", SegmentSizeBytes).Msg("failed to preallocate an initial WAL file")
+	if err = op.preallocate(f.File); err != nil {
+		op.lg.Warn("failed to preallocate an initial WAL file", "error", err, "path", p, "segment-size-bytes", op.segmentSizeBytes)
 		return nil, err
 	}
 
 	w := &WAL{
 		dir:      dirpath,
+		opts:     op,
 		metadata: metadata,
+		state:    &walpb.HardState{},
+		durablec: make(chan struct{}),
 	}
-	w.encoder, err = newFileEncoder(f.File, 0)
+	w.encoder, err = newFileEncoder(f.File, 0, w.opts)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +213,9 @@ func Create(dirpath string, metadata []byte) (*WAL, error) {
 	if err = w.saveCrc(0); err != nil {
 		return nil, err
 	}
+	if err = w.saveHeader(); err != nil {
+		return nil, err
+	}
 	if err = w.saveMetadata(metadata); err != nil {
 		return nil, err
 	}
@@ -139,60 +223,73 @@ func Create(dirpath string, metadata []byte) (*WAL, error) {
 		return nil, err
 	}
 
+	// sync the temporary directory so that the initial file survives a crash
+	// once the directory is renamed
+	tmpdir, err := op.fs.OpenDir(tmpdirpath)
+	if err != nil {
+		return nil, err
+	}
+	err = op.fs.Fsync(tmpdir)
+	tmpdir.Close()
+	if err != nil {
+		op.lg.Warn("failed to fsync the temporary WAL directory", "error", err, "tmp-dirpath", tmpdirpath)
+		return nil, err
+	}
+
 	logDirPath := w.dir
 	if w, err = w.renameWAL(tmpdirpath); err != nil {
-		log.Warn().Err(err).Str("tmp-dirpath", tmpdirpath).Str("dirpath", logDirPath).Msg("failed to rename the temporary WAL directory")
+		op.lg.Warn("failed to rename the temporary WAL directory", "error", err, "tmp-dirpath", tmpdirpath, "dirpath", logDirPath)
 		return nil, err
 	}
 
-	var perr error
-	defer func() {
-		if perr != nil {
-			w.cleanupWAL()
-		}
-	}()
-
 	// directory was renamed; sync parent dir to persist rename
-	pdir, perr := fileutil.OpenDir(filepath.Dir(w.dir))
-	if perr != nil {
-		log.Warn().Err(perr).Str("parent-dirpath", filepath.Dir(w.dir)).Str("dirpath", w.dir).Msg("failed to open the parent data directory")
+	if perr := w.syncParentDir(); perr != nil {
+		if err = w.cleanupWAL(); err != nil {
+			return nil, fmt.Errorf("%v; %w", perr, err)
+		}
 		return nil, perr
 	}
-	dirCloser := func() error {
-		if perr = pdir.Close(); perr != nil {
-			log.Warn().Err(perr).Str("parent-dirpath", filepath.Dir(w.dir)).Str("dirpath", w.dir).Msg("failed to close the parent data directory")
-			return perr
-		}
-		return nil
+	return w, nil
+}
+
+func (w *WAL) syncParentDir() error {
+	pdir, err := w.opts.fs.OpenDir(filepath.Dir(w.dir))
+	if err != nil {
+		w.opts.lg.Warn("failed to open the parent data directory", "error", err, "parent-dirpath", filepath.Dir(w.dir), "dirpath", w.dir)
+		return err
 	}
-	if perr = fileutil.Fsync(pdir); perr != nil {
-		log.Warn().Err(perr).Str("parent-dirpath", filepath.Dir(w.dir)).Str("dirpath", w.dir).Msg("failed to fsync the parent data directory")
-		dirCloser() // nolint
-		return nil, perr
+	if err = w.opts.fs.Fsync(pdir); err != nil {
+		w.opts.lg.Warn("failed to fsync the parent data directory", "error", err, "parent-dirpath", filepath.Dir(w.dir), "dirpath", w.dir)
+		pdir.Close() // nolint
+		return err
 	}
-	if err = dirCloser(); err != nil {
-		return nil, err
+	if err = pdir.Close(); err != nil {
+		w.opts.lg.Warn("failed to close the parent data directory", "error", err, "parent-dirpath", filepath.Dir(w.dir), "dirpath", w.dir)
+		return err
 	}
-
-	return w, nil
+	return nil
 }
 
+// SetUnsafeNoFsync disables fsync on an existing WAL, see WithUnsafeNoFsync.
 func (w *WAL) SetUnsafeNoFsync() {
-	w.unsafeNoSync = true
+	w.opts.unsafeNoSync = true
 }
 
-func (w *WAL) cleanupWAL() {
+// cleanupWAL closes a WAL whose creation failed and moves its directory
+// aside.
+func (w *WAL) cleanupWAL() error {
 	if err := w.Close(); err != nil {
-		log.Panic().Err(err).Msg("failed to close WAL during cleanup")
+		return fmt.Errorf("wal: failed to close WAL during cleanup: %w", err)
 	}
 	brokenDirName := fmt.Sprintf("%s.broken.%v", w.dir, time.Now().Format("20060102.150405.999999"))
-	if err := os.Rename(w.dir, brokenDirName); err != nil {
-		log.Panic().Err(err).Str("source-path", w.dir).Str("rename-path", brokenDirName).Msg("failed to rename WAL during cleanup")
+	if err := w.opts.fs.Rename(w.dir, brokenDirName); err != nil {
+		return fmt.Errorf("wal: failed to rename WAL to %s during cleanup: %w", brokenDirName, err)
 	}
+	return nil
 }
 
 func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
-	if err := os.RemoveAll(w.dir); err != nil {
+	if err := w.opts.fs.RemoveAll(w.dir); err != nil {
 		return nil, err
 	}
 	// On non-Windows platforms, hold the lock while renaming. Releasing
@@ -201,14 +298,14 @@ func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
 	// happening. The fds are set up as close-on-exec by the Go runtime,
 	// but there is a window between the fork and the exec where another
 	// process holds the lock.
-	if err := os.Rename(tmpdirpath, w.dir); err != nil {
+	if err := w.opts.fs.Rename(tmpdirpath, w.dir); err != nil {
 		if _, ok := err.(*os.LinkError); ok {
 			return w.renameWALUnlock(tmpdirpath)
 		}
 		return nil, err
 	}
-	w.fp = NewFilePipeline(w.dir, SegmentSizeBytes)
-	df, err := fileutil.OpenDir(w.dir)
+	w.fp = newFilePipeline(w.dir, w.opts)
+	df, err := w.opts.fs.OpenDir(w.dir)
 	w.dirFile = df
 	return w, err
 }
@@ -216,15 +313,15 @@ func (w *WAL) renameWAL(tmpdirpath string) (*WAL, error) {
 func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 	// rename of directory with locked files doesn't work on windows/cifs;
 	// close the WAL to release the locks so the directory can be renamed.
-	log.Info().Str("from", tmpdirpath).Str("to", w.dir).Msg("closing WAL to release flock and retry directory renaming")
+	w.opts.lg.Info("closing WAL to release flock and retry directory renaming", "from", tmpdirpath, "to", w.dir)
 	w.Close()
 
-	if err := os.Rename(tmpdirpath, w.dir); err != nil {
+	if err := w.opts.fs.Rename(tmpdirpath, w.dir); err != nil {
 		return nil, err
 	}
 
 	// reopen and relock
-	newWAL, oerr := Open(w.dir, &walpb.Snapshot{})
+	newWAL, oerr := open(context.Background(), w.dir, &walpb.Snapshot{}, w.opts)
 	if oerr != nil {
 		return nil, oerr
 	}
@@ -241,12 +338,22 @@ func (w *WAL) renameWALUnlock(tmpdirpath string) (*WAL, error) {
 // The returned WAL is ready to read and the first record will be the one after
 // the given snap. The WAL cannot be appended to before reading out all of its
 // previous records.
-func Open(dirpath string, snap *walpb.Snapshot) (*WAL, error) {
-	w, err := openAtIndex(dirpath, snap, true)
+func Open(dirpath string, snap *walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return OpenContext(context.Background(), dirpath, snap, opts...)
+}
+
+// OpenContext is like Open, but gives up with ctx.Err() between two segments
+// once ctx is done.
+func OpenContext(ctx context.Context, dirpath string, snap *walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return open(ctx, dirpath, snap, newOptions(opts))
+}
+
+func open(ctx context.Context, dirpath string, snap *walpb.Snapshot, opts *Options) (*WAL, error) {
+	w, err := openAtIndex(ctx, dirpath, snap, true, opts)
 	if err != nil {
 		return nil, err
 	}
-	if w.dirFile, err = fileutil.OpenDir(w.dir); err != nil {
+	if w.dirFile, err = w.opts.fs.OpenDir(w.dir); err != nil {
 		return nil, err
 	}
 	return w, nil
@@ -254,26 +361,41 @@ func Open(dirpath string, snap *walpb.Snapshot) (*WAL, error) {
 
 // OpenForRead only opens the wal files for read.
 // Write on a read only wal panics.
-func OpenForRead(dirpath string, snap *walpb.Snapshot) (*WAL, error) {
-	return openAtIndex(dirpath, snap, false)
+func OpenForRead(dirpath string, snap *walpb.Snapshot, opts ...Option) (*WAL, error) {
+	return openAtIndex(context.Background(), dirpath, snap, false, newOptions(opts))
 }
 
-func openAtIndex(dirpath string, snap *walpb.Snapshot, write bool) (*WAL, error) {
-	names, nameIndex, err := selectWALFiles(dirpath, snap)
+func openAtIndex(ctx context.Context, dirpath string, snap *walpb.Snapshot, write bool, opts *Options) (*WAL, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	names, nameIndex, err := selectWALFiles(dirpath, snap, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	rs, ls, closer, err := openWALFiles(dirpath, names, nameIndex, write)
+	startSeq, _, err := parseWALName(names[nameIndex])
 	if err != nil {
 		return nil, err
 	}
 
+	rs, ls, closer, err := openWALFiles(ctx, dirpath, names, nameIndex, write, opts)
+	if err != nil {
+		return nil, err
+	}
+	d := newDecoder(opts, rs...)
+	d.names = names[nameIndex:]
+
 	// create a WAL ready for reading
 	w := &WAL{
 		dir:       dirpath,
+		opts:      opts,
+		state:     &walpb.HardState{},
+		durablec:  make(chan struct{}),
 		start:     snap,
-		decoder:   newDecoder(rs...),
+		startSeq:  startSeq,
+		decoder:   d,
 		readClose: closer,
 		locks:     ls,
 	}
@@ -286,54 +408,78 @@ func openAtIndex(dirpath string, snap *walpb.Snapshot, write bool) (*WAL, error)
 			closer() // nolint
 			return nil, err
 		}
-		w.fp = NewFilePipeline(w.dir, SegmentSizeBytes)
+		w.fp = newFilePipeline(w.dir, w.opts)
 	}
 
 	return w, nil
 }
 
-func selectWALFiles(dirpath string, snap *walpb.Snapshot) ([]string, int, error) {
-	names, err := readWALNames(dirpath)
+func selectWALFiles(dirpath string, snap *walpb.Snapshot, opts *Options) ([]string, int, error) {
+	names, err := readWALNames(opts, dirpath)
 	if err != nil {
 		return nil, -1, err
 	}
 
-	nameIndex, ok := searchIndex(names, snap.Index)
-	if !ok || !isValidSeq(names[nameIndex:]) {
-		err = ErrFileNotFound
+	nameIndex, ok, err := searchIndex(names, snap.Index)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !ok {
+		return nil, -1, ErrFileNotFound
+	}
+	if ok, err = isValidSeq(names[nameIndex:]); err != nil || !ok {
+		if err == nil {
+			err = ErrFileNotFound
+		}
 		return nil, -1, err
 	}
 
 	return names, nameIndex, nil
 }
 
-func openWALFiles(dirpath string, names []string, nameIndex int, write bool) ([]io.Reader, []*fileutil.LockedFile, func() error, error) {
+func openWALFiles(ctx context.Context, dirpath string, names []string, nameIndex int, write bool, opts *Options) ([]io.Reader, []*fileutil.LockedFile, func() error, error) {
 	rcs := make([]io.ReadCloser, 0)
 	rs := make([]io.Reader, 0)
 	ls := make([]*fileutil.LockedFile, 0)
 	for _, name := range names[nameIndex:] {
+		if err := ctx.Err(); err != nil {
+			closeAll(opts.lg, rcs...) // nolint
+			return nil, nil, nil, err
+		}
 		p := filepath.Join(dirpath, name)
 		if write {
-			l, err := fileutil.TryLockFile(p, os.O_RDWR, fileutil.PrivateFileMode)
+			l, err := opts.fs.TryLockFile(p, os.O_RDWR|opts.syncFlag(), opts.filePerm)
 			if err != nil {
-				closeAll(rcs...) // nolint
+				closeAll(opts.lg, rcs...) // nolint
 				return nil, nil, nil, err
 			}
 			ls = append(ls, l)
 			rcs = append(rcs, l)
 		} else {
-			rf, err := os.OpenFile(p, os.O_RDONLY, fileutil.PrivateFileMode)
+			rf, err := opts.fs.OpenFile(p, os.O_RDONLY, opts.filePerm)
 			if err != nil {
-				closeAll(rcs...) // nolint
+				closeAll(opts.lg, rcs...) // nolint
 				return nil, nil, nil, err
 			}
 			ls = append(ls, nil)
 			rcs = append(rcs, rf)
 		}
+		// refuse the segments written with features this version lacks
+		h, err := readSegmentHeader(opts, rcs[len(rcs)-1].(io.ReaderAt))
+		if err == nil {
+			err = checkSegmentHeader(name, h)
+		}
+		if err == nil {
+			err = useSegmentHeader(opts, name, h, len(rcs) == 1)
+		}
+		if err != nil {
+			closeAll(opts.lg, rcs...) // nolint
+			return nil, nil, nil, err
+		}
 		rs = append(rs, rcs[len(rcs)-1])
 	}
 
-	closer := func() error { return closeAll(rcs...) }
+	closer := func() error { return closeAll(opts.lg, rcs...) }
 
 	return rs, ls, closer, nil
 }
@@ -345,121 +491,51 @@ func openWALFiles(dirpath string, names []string, nameIndex int, write bool) ([]
 // If it cannot read out the expected snap, it will return ErrSnapshotNotFound.
 // If loaded snap doesn't match with the expected one, it will return
 // all the records and error ErrSnapshotMismatch.
+// The returned state is the last HardState saved to the WAL, or an empty one
+// if none was saved.
+// An entry with an index that was already read replaces the earlier entry and
+// everything after it only if its term is higher; otherwise a
+// *TermConflictError is returned. Entries of term 0, as written before terms
+// were recorded, always replace the earlier ones. ReplacedEntries reports how
+// many entries were replaced.
+// ReadAll keeps every entry in memory; use Replay to stream large WALs.
 // TODO: detect not-last-snap error.
 // TODO: maybe loose the checking of match.
 // After ReadAll, the WAL will be ready for appending new records.
-func (w *WAL) ReadAll() (metadata []byte, entries uint64, ents []*walpb.Entry, err error) {
+func (w *WAL) ReadAll() (metadata []byte, state *walpb.HardState, ents []*walpb.Entry, err error) {
+	return w.ReadAllContext(context.Background())
+}
+
+// ReadAllContext is like ReadAll, but stops with ctx.Err() between two
+// records once ctx is done. The WAL cannot be appended to afterwards and
+// should be closed.
+func (w *WAL) ReadAllContext(ctx context.Context) (metadata []byte, state *walpb.HardState, ents []*walpb.Entry, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	rec := &walpb.Record{}
-
 	if w.decoder == nil {
-		return nil, 0, nil, ErrDecoderNotFound
+		return nil, nil, nil, ErrDecoderNotFound
 	}
-	decoder := w.decoder
 
-	var match bool
-	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
-		switch rec.GetType() {
-		case walpb.RecordType_EntryType:
-			var ent walpb.Entry
-			proto.Unmarshal(rec.GetData(), &ent) // nolint
-			// 0 <= e.Index-w.start.Index - 1 < len(ents)
-			if ent.Index > w.start.Index {
-				// prevent "panic: runtime error: slice bounds out of range [:13038096702221461992] with capacity 0"
-				up := ent.Index - w.start.Index - 1
-				if up > uint64(len(ents)) {
-					// return error before append call causes runtime panic
-					return nil, 0, nil, ErrSliceOutOfRange
-				}
-				// The line below is potentially overriding some 'uncommitted' entries.
-				ents = append(ents[:up], &ent)
-				entries++
-			}
-			w.enti = ent.Index
-
-		case walpb.RecordType_MetadataType:
-			if metadata != nil && !bytes.Equal(metadata, rec.GetData()) {
-				return nil, 0, nil, ErrMetadataConflict
-			}
-			metadata = rec.GetData()
-
-		case walpb.RecordType_CrcType:
-			crc := decoder.crc.Sum32()
-			// current crc of decoder must match the crc of the record.
-			// do no need to match 0 crc, since the decoder is a new one at this case.
-			if crc != 0 && rec.Validate(crc) != nil {
-				return nil, 0, nil, ErrCRCMismatch
-			}
-			decoder.updateCRC(rec.Crc)
-
-		case walpb.RecordType_SnapshotType:
-			var snap walpb.Snapshot
-			proto.Unmarshal(rec.Data, &snap) // nolint
-			if snap.Index == w.start.Index {
-				if snap.Term != w.start.Term {
-					return nil, 0, nil, ErrSnapshotMismatch
-				}
-				match = true
-			}
-
-		default:
-			return nil, 0, nil, fmt.Errorf("unexpected block type %d", rec.Type)
-		}
-	}
-
-	switch w.tail() {
-	case nil:
-		// We do not have to read out all entries in read mode.
-		// The last record maybe a partial written one, so
-		// ErrunexpectedEOF might be returned.
-		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			return nil, 0, nil, err
-		}
-	default:
-		// We must read all of the entries if WAL is opened in write mode.
-		if err != io.EOF {
-			return nil, 0, nil, err
-		}
-		// decodeRecord() will return io.EOF if it detects a zero record,
-		// but this zero record may be followed by non-zero records from
-		// a torn write. Overwriting some of these non-zero records, but
-		// not all, will cause CRC errors on WAL open. Since the records
-		// were never fully synced to disk in the first place, it's safe
-		// to zero them out to avoid any CRC errors from new writes.
-		if _, err = w.tail().Seek(w.decoder.lastOffset(), io.SeekStart); err != nil {
-			return nil, 0, nil, err
-		}
-		if err = fileutil.ZeroToEnd(w.tail().File); err != nil {
-			return nil, 0, nil, err
-		}
-	}
-
-	err = nil
-	if !match {
-		err = ErrSnapshotNotFound
-	}
-
-	// close decoder, disable reading
-	if w.readClose != nil {
-		w.readClose()
-		w.readClose = nil
-	}
-	w.start = &walpb.Snapshot{}
-
-	w.metadata = metadata
-
-	if w.tail() != nil {
-		// create encoder (chain crc with the decoder), enable appending
-		w.encoder, err = newFileEncoder(w.tail().File, w.decoder.lastCRC())
-		if err != nil {
-			return
-		}
+	start := w.start.Index
+	metadata, state, err = w.replay(ctx, func(ent *walpb.Entry) error {
+		// 0 <= e.Index-start - 1 <= len(ents), which is checked by replay.
+		// The line below is potentially overriding some 'uncommitted' entries.
+		ents = append(ents[:ent.Index-start-1], ent)
+		return nil
+	})
+	if err != nil && err != ErrSnapshotNotFound {
+		return nil, nil, nil, err
 	}
-	w.decoder = nil
+	return metadata, state, ents, err
+}
 
-	return metadata, entries, ents, err
+// ReplacedEntries returns the number of entries that were overwritten by
+// entries of a higher term during the last ReadAll.
+func (w *WAL) ReplacedEntries() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.replaced
 }
 
 // Verify reads through the given WAL and verifies that it is not corrupted.
@@ -469,21 +545,31 @@ func (w *WAL) ReadAll() (metadata []byte, entries uint64, ents []*walpb.Entry, e
 // If it cannot read out the expected snap, it will return ErrSnapshotNotFound.
 // If the loaded snap doesn't match with the expected one, it will
 // return error ErrSnapshotMismatch.
-func Verify(walDir string, snap *walpb.Snapshot) error {
+// Encrypted records are only checked against the crc chain when no key
+// provider is given, an encrypted snapshot record then matches any snap.
+func Verify(walDir string, snap *walpb.Snapshot, opts ...Option) error {
+	return VerifyContext(context.Background(), walDir, snap, opts...)
+}
+
+// VerifyContext is like Verify, but gives up with ctx.Err() between two
+// records once ctx is done.
+func VerifyContext(ctx context.Context, walDir string, snap *walpb.Snapshot, opts ...Option) error {
 	var metadata []byte
 	var err error
 	var match bool
 
 	rec := &walpb.Record{}
 
-	names, nameIndex, err := selectWALFiles(walDir, snap)
+	op := newOptions(opts)
+	op.keepSealed = true
+	names, nameIndex, err := selectWALFiles(walDir, snap, op)
 	if err != nil {
 		return err
 	}
 
 	// open wal files in read mode, so that there is no conflict
 	// when the same WAL is opened elsewhere in write mode
-	rs, _, closer, err := openWALFiles(walDir, names, nameIndex, false)
+	rs, _, closer, err := openWALFiles(ctx, walDir, names, nameIndex, false, op)
 	if err != nil {
 		return err
 	}
@@ -494,24 +580,38 @@ func Verify(walDir string, snap *walpb.Snapshot) error {
 	}()
 
 	// create a new decoder from the readers on the WAL files
-	decoder := newDecoder(rs...)
+	decoder := newDecoder(op, rs...)
+	decoder.names = names[nameIndex:]
 
 	for err = decoder.decode(rec); err == nil; err = decoder.decode(rec) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		sealed := op.keys == nil && rec.KeyId != ""
 		switch rec.GetType() {
 		case walpb.RecordType_MetadataType:
+			// the ciphertexts of the same metadata differ
+			if sealed {
+				continue
+			}
 			if metadata != nil && !bytes.Equal(metadata, rec.GetData()) {
 				return ErrMetadataConflict
 			}
 			metadata = rec.GetData()
 		case walpb.RecordType_CrcType:
-			crc := decoder.crc.Sum32()
+			crc := decoder.crc.Sum64()
 			// Current crc of decoder must match the crc of the record.
 			// We need not match 0 crc, since the decoder is a new one at this point.
 			if crc != 0 && rec.Validate(crc) != nil {
-				return ErrCRCMismatch
+				op.metrics.ObserveCRCFailure()
+				return decoder.corruption(decoder.lastRecOff, walpb.RecordType_CrcType, ErrCRCMismatch)
 			}
 			decoder.updateCRC(rec.GetCrc())
 		case walpb.RecordType_SnapshotType:
+			if sealed {
+				match = true
+				continue
+			}
 			var loadedSnap walpb.Snapshot
 			proto.Unmarshal(rec.GetData(), &loadedSnap) // nolint
 			if loadedSnap.Index == snap.Index {
@@ -520,11 +620,17 @@ func Verify(walDir string, snap *walpb.Snapshot) error {
 				}
 				match = true
 			}
-		// We ignore all entry type records as these
-		// are not necessary for validating the WAL contents
 		case walpb.RecordType_EntryType:
+			// only tracked to locate corrupted records
+			var ent walpb.Entry
+			if !sealed && proto.Unmarshal(rec.GetData(), &ent) == nil {
+				decoder.lastIndex = ent.Index
+			}
+		// We ignore all state and header type records as these
+		// are not necessary for validating the WAL contents
+		case walpb.RecordType_StateType, walpb.RecordType_HeaderType:
 		default:
-			return fmt.Errorf("unexpected block type %d", rec.GetType())
+			return decoder.corruption(decoder.lastRecOff, rec.GetType(), ErrUnexpectedRecordType)
 		}
 	}
 
@@ -555,11 +661,15 @@ func (w *WAL) cut() error {
 		return err
 	}
 
-	if err := w.sync(); err != nil {
+	if err := w.fullSync(); err != nil {
 		return err
 	}
 
-	fpath := filepath.Join(w.dir, walName(w.seq()+1, w.enti+1))
+	seq, err := w.seq()
+	if err != nil {
+		return err
+	}
+	fpath := filepath.Join(w.dir, walName(seq+1, w.enti+1))
 
 	// create a temp wal file with name sequence + 1, or truncate the existing one
 	newTail, err := w.fp.Open()
@@ -569,8 +679,8 @@ func (w *WAL) cut() error {
 
 	// update writer and save the previous crc
 	w.locks = append(w.locks, newTail)
-	prevCrc := w.encoder.crc.Sum32()
-	w.encoder, err = newFileEncoder(w.tail().File, prevCrc)
+	prevCrc := w.encoder.crc.Sum64()
+	w.encoder, err = newFileEncoder(w.tail().File, prevCrc, w.opts)
 	if err != nil {
 		return err
 	}
@@ -579,12 +689,20 @@ func (w *WAL) cut() error {
 		return err
 	}
 
+	if err = w.saveHeader(); err != nil {
+		return err
+	}
+
 	if err = w.saveMetadata(w.metadata); err != nil {
 		return err
 	}
 
+	if err = w.saveState(w.state); err != nil {
+		return err
+	}
+
 	// atomically move temp wal file to wal file
-	if err = w.sync(); err != nil {
+	if err = w.fullSync(); err != nil {
 		return err
 	}
 
@@ -593,17 +711,17 @@ func (w *WAL) cut() error {
 		return err
 	}
 
-	if err = os.Rename(newTail.Name(), fpath); err != nil {
+	if err = w.opts.fs.Rename(newTail.Name(), fpath); err != nil {
 		return err
 	}
-	if err = fileutil.Fsync(w.dirFile); err != nil {
+	if err = w.opts.fs.Fsync(w.dirFile); err != nil {
 		return err
 	}
 
 	// reopen newTail with its new path so calls to Name() match the wal filename format
 	newTail.Close() // nolint
 
-	if newTail, err = fileutil.LockFile(fpath, os.O_WRONLY, fileutil.PrivateFileMode); err != nil {
+	if newTail, err = w.opts.fs.LockFile(fpath, os.O_WRONLY|w.opts.syncFlag(), w.opts.filePerm); err != nil {
 		return err
 	}
 	if _, err = newTail.Seek(off, io.SeekStart); err != nil {
@@ -612,37 +730,17 @@ func (w *WAL) cut() error {
 
 	w.locks[len(w.locks)-1] = newTail
 
-	prevCrc = w.encoder.crc.Sum32()
-	w.encoder, err = newFileEncoder(w.tail().File, prevCrc)
+	prevCrc = w.encoder.crc.Sum64()
+	w.encoder, err = newFileEncoder(w.tail().File, prevCrc, w.opts)
 	if err != nil {
 		return err
 	}
 
-	log.Info().Str("path", fpath).Msg("created a new WAL segment")
-	return nil
-}
-
-func (w *WAL) sync() error {
-	if w.unsafeNoSync {
-		return nil
-	}
-	if w.encoder != nil {
-		if err := w.encoder.flush(); err != nil {
-			return err
-		}
-	}
+	w.markDurable()
 
-	start := time.Now()
-	err := fileutil.Fdatasync(w.tail().File)
-	took := time.Since(start)
-	if took > warnSyncDuration {
-		log.Warn().Float64("sync-took", took.Seconds()).Float64("expected-duration", warnSyncDuration.Seconds()).Msg("slow fdatasync")
-	}
-	return err
-}
-
-func (w *WAL) Sync() error {
-	return w.sync()
+	w.opts.metrics.ObserveCut()
+	w.opts.lg.Info("created a new WAL segment", "path", fpath)
+	return nil
 }
 
 // ReleaseLockTo releases the locks, which has smaller index than the given index
@@ -689,34 +787,91 @@ func (w *WAL) ReleaseLockTo(index uint64) error {
 	}
 	w.locks = w.locks[smaller:]
 
+	// the released segments may be purged at any time
+	seq, _, err := parseWALName(filepath.Base(w.locks[0].Name()))
+	if err != nil {
+		return err
+	}
+	w.index.trim(seq)
+
 	return nil
 }
 
-// Close closes the current WAL file and directory.
+// Close closes the current WAL file and directory. It returns the error that
+// failed an earlier write, if any.
 func (w *WAL) Close() error {
+	w.stopWriter()
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	defer w.markClosed()
+
 	if w.fp != nil {
 		w.fp.Close() // nolint
 		w.fp = nil
 	}
 
-	if w.tail() != nil {
-		if err := w.sync(); err != nil {
-			return err
-		}
+	err := w.werr
+	if err == nil && w.tail() != nil {
+		err = w.fail(w.fullSync())
 	}
 	for _, l := range w.locks {
 		if l == nil {
 			continue
 		}
-		if err := l.Close(); err != nil {
-			log.Error().Err(err).Msg("failed to close WAL")
+		if cerr := l.Close(); cerr != nil {
+			w.opts.lg.Error("failed to close WAL", "error", cerr)
 		}
 	}
 
-	return w.dirFile.Close()
+	if w.dirFile == nil {
+		// opened for read
+		return err
+	}
+	if cerr := w.dirFile.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fail records err, if any, as the write error of the WAL and returns it.
+func (w *WAL) fail(err error) error {
+	if err != nil && w.werr == nil {
+		w.werr = err
+	}
+	return err
+}
+
+// saveEntries encodes the entries and the state of a save, and returns the
+// function accounting for them once their records are written. The records
+// are staged, see encoder.begin, and must be committed or rolled back.
+func (w *WAL) saveEntries(st *walpb.HardState, ents []walpb.Entry) (func(), error) {
+	seq, err := w.seq()
+	if err != nil {
+		return nil, err
+	}
+	cps := make([]checkpoint, 0, len(ents))
+	for i := range ents {
+		cp := checkpoint{index: ents[i].Index, pos: position{seq: seq, off: w.encoder.off}, crc: w.encoder.crc.Sum64()}
+		if err = w.saveEntry(&ents[i]); err != nil {
+			return nil, err
+		}
+		cps = append(cps, cp)
+	}
+	state, err := w.encodeState(st)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		for _, cp := range cps {
+			w.index.add(cp.index, cp.pos, cp.crc)
+			w.enti = cp.index
+		}
+		if state != nil {
+			w.state = state
+		}
+	}, nil
 }
 
 func (w *WAL) saveEntry(e *walpb.Entry) error {
@@ -724,72 +879,150 @@ func (w *WAL) saveEntry(e *walpb.Entry) error {
 	if err != nil {
 		return err
 	}
-	if err := w.encoder.encode(&walpb.Record{Type: walpb.RecordType_EntryType, Data: b}); err != nil {
-		return err
+	if n := w.opts.fragmentBytes; n > 0 && len(b) > n {
+		return w.saveFragments(walpb.RecordType_EntryType, b, n)
+	}
+	return w.encoder.encode(&walpb.Record{Type: walpb.RecordType_EntryType, Data: b})
+}
+
+// saveFragments writes data as a sequence of records of type t with at most
+// n bytes each, which the decoder reassembles.
+func (w *WAL) saveFragments(t walpb.RecordType, data []byte, n int) error {
+	frag := walpb.FragmentType_FirstFragment
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > n {
+			chunk = chunk[:n]
+		} else {
+			frag = walpb.FragmentType_LastFragment
+		}
+		if err := w.encoder.encode(&walpb.Record{Type: t, Data: chunk, Fragment: frag}); err != nil {
+			return err
+		}
+		data, frag = data[len(chunk):], walpb.FragmentType_MiddleFragment
 	}
-	w.enti = e.Index
 	return nil
 }
 
-func (w *WAL) needSync(entsLen int) bool {
-	return entsLen != 0
+func (w *WAL) saveState(s *walpb.HardState) error {
+	state, err := w.encodeState(s)
+	if err == nil && state != nil {
+		w.state = state
+	}
+	return err
 }
 
-func (w *WAL) Save(ents []walpb.Entry) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// encodeState encodes s unless it is empty, and returns the state to keep.
+func (w *WAL) encodeState(s *walpb.HardState) (*walpb.HardState, error) {
+	if isEmptyHardState(s) {
+		return nil, nil
+	}
+	state := &walpb.HardState{Term: s.GetTerm(), Vote: s.GetVote(), Commit: s.GetCommit()}
+	b, err := proto.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return state, w.encoder.encode(&walpb.Record{Type: walpb.RecordType_StateType, Data: b})
+}
 
-	// short cut, do not call sync
-	if len(ents) == 0 {
-		return nil
+// needSync reports whether the given save must be synced. A change of
+// commit index alone can be recovered from the rest of the cluster.
+func (w *WAL) needSync(st *walpb.HardState, entsLen int) bool {
+	if entsLen != 0 {
+		return true
+	}
+	if isEmptyHardState(st) {
+		return false
 	}
+	return st.GetVote() != w.state.GetVote() || st.GetTerm() != w.state.GetTerm()
+}
 
-	mustSync := w.needSync(len(ents))
+// Save appends the given entries to the WAL. The optional state st is
+// written in the same batch, so that it becomes durable atomically with
+// the entries. A nil or empty state is not recorded.
+//
+// Concurrent calls are committed together with a single sync by the writer
+// goroutine, see SaveAsync and WithGroupCommitWindow; each call still
+// returns once its own entries are synced as the sync policy requires, and
+// all the calls of a batch share the result of the sync. A save is written
+// as a whole or not at all: one that cannot be encoded fails on its own, and
+// the saves queued after it in the batch fail with the same error. Once
+// writing or syncing the tail failed, every later save fails with that error.
+func (w *WAL) Save(st *walpb.HardState, ents []walpb.Entry) error {
+	return w.SaveContext(context.Background(), st, ents)
+}
 
-	// TODO(xiangli): no more reference operator
-	for i := range ents {
-		if err := w.saveEntry(&ents[i]); err != nil {
-			return err
-		}
+// SaveContext is like Save, but gives up once ctx is done. A save still
+// waiting for the writer goroutine is then withdrawn, so that none of it is
+// written, and ctx.Err() is returned. A save that is being written, or that a
+// later save queued after it may depend on, is instead completed in the
+// background, as a whole; the returned error then matches both
+// ErrSaveInProgress and ctx.Err(), and ents must not be modified until the
+// save completed, as told by a later Sync.
+func (w *WAL) SaveContext(ctx context.Context, st *walpb.HardState, ents []walpb.Entry) error {
+	// short cut, do not call sync
+	if isEmptyHardState(st) && len(ents) == 0 {
+		return nil
 	}
-
-	curOff, err := w.tail().Seek(0, io.SeekCurrent)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if curOff < SegmentSizeBytes {
-		if mustSync {
-			return w.sync()
-		}
-		return nil
-	}
-
-	return w.cut()
+	return w.waitContext(ctx, w.SaveAsync(st, ents))
 }
 
 func (w *WAL) SaveSnapshot(e *walpb.Snapshot) error {
+	return w.SaveSnapshotContext(context.Background(), e)
+}
+
+// SaveSnapshotContext is like SaveSnapshot, but returns ctx.Err() without
+// writing the snapshot if ctx is done before it could be.
+func (w *WAL) SaveSnapshotContext(ctx context.Context, e *walpb.Snapshot) error {
 	b, err := proto.Marshal(e)
 	if err != nil {
-		log.Fatal().Err(err).Msg(("failed to marshal Snapshot"))
+		return fmt.Errorf("wal: failed to marshal snapshot: %w", err)
 	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	// the lock may have been waited for during a commit
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	if w.werr != nil {
+		return w.werr
+	}
+	if w.encoder == nil || w.tail() == nil {
+		return ErrNotAppendMode
+	}
+
+	w.encoder.begin()
 	if err = w.encoder.encode(&walpb.Record{Type: walpb.RecordType_SnapshotType, Data: b}); err != nil {
+		w.encoder.rollback()
 		return err
 	}
+	if err = w.encoder.commit(); err != nil {
+		return w.fail(err)
+	}
 	// !!!update enti only when snapshot is ahead of last index
 	if w.enti < e.Index {
 		w.enti = e.Index
 	}
-	return w.sync()
+	return w.fail(w.sync())
 }
 
-func (w *WAL) saveCrc(prevCrc uint32) error {
+func (w *WAL) saveCrc(prevCrc uint64) error {
 	return w.encoder.encode(&walpb.Record{Type: walpb.RecordType_CrcType, Crc: prevCrc})
 }
 
+func (w *WAL) saveHeader() error {
+	b, err := proto.Marshal(newSegmentHeader(w.opts))
+	if err != nil {
+		return err
+	}
+	return w.encoder.encode(&walpb.Record{Type: walpb.RecordType_HeaderType, Data: b})
+}
+
 func (w *WAL) saveMetadata(metadata []byte) error {
 	return w.encoder.encode(&walpb.Record{Type: walpb.RecordType_MetadataType, Data: metadata})
 }
@@ -801,23 +1034,27 @@ func (w *WAL) tail() *fileutil.LockedFile {
 	return nil
 }
 
-func (w *WAL) seq() uint64 {
+func (w *WAL) seq() (uint64, error) {
 	lf := w.tail()
 	if lf == nil {
-		return 0
+		return 0, nil
 	}
 	seq, _, err := parseWALName(filepath.Base(lf.Name()))
 	if err != nil {
-		log.Fatal().Err(err).Str("name", lf.Name()).Msg("failed to parse WAL name")
+		return 0, fmt.Errorf("wal: failed to parse WAL name %q: %w", lf.Name(), err)
 	}
-	return seq
+	return seq, nil
+}
+
+func isEmptyHardState(st *walpb.HardState) bool {
+	return st == nil || (st.GetTerm() == 0 && st.GetVote() == 0 && st.GetCommit() == 0)
 }
 
-func closeAll(rcs ...io.ReadCloser) error {
+func closeAll(lg Logger, rcs ...io.ReadCloser) error {
 	stringArr := make([]string, 0)
 	for _, f := range rcs {
 		if err := f.Close(); err != nil {
-			log.Warn().Err(err).Msg("failed to close")
+			lg.Warn("failed to close", "error", err)
 			stringArr = append(stringArr, err.Error())
 		}
 	}
@@ -2,6 +2,7 @@ package wal
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -39,12 +40,15 @@ func TestNew(t *testing.T) {
 	defer f.Close()
 	n, err := io.ReadFull(f, gd)
 	assert.Empty(t, err)
-	assert.Equal(t, 64, n)
 
 	var wb bytes.Buffer
-	enc := newEncoder(&wb, 0, 0)
+	enc := newEncoder(&wb, 0, 0, newOptions(nil))
 	err = enc.encode(&walpb.Record{Type: walpb.RecordType_CrcType, Crc: 0})
 	assert.Empty(t, err)
+	header, err := proto.Marshal(newSegmentHeader(newOptions(nil)))
+	assert.Empty(t, err)
+	err = enc.encode(&walpb.Record{Type: walpb.RecordType_HeaderType, Data: header})
+	assert.Empty(t, err)
 	err = enc.encode(&walpb.Record{Type: walpb.RecordType_MetadataType, Data: []byte("some metadata")})
 	assert.Empty(t, err)
 	data, err := proto.Marshal(&walpb.Snapshot{})
@@ -53,6 +57,7 @@ func TestNew(t *testing.T) {
 	assert.Empty(t, err)
 	err = enc.flush()
 	assert.Empty(t, err)
+	assert.Equal(t, wb.Len(), n)
 	assert.Equal(t, wb.Bytes(), gd)
 }
 
@@ -77,8 +82,8 @@ func TestWalCleanup(t *testing.T) {
 
 	w, err := Create(p, []byte(""))
 	assert.Empty(t, err)
-	w.cleanupWAL()
-	fnames, err := fileutil.ReadDir(testRoot)
+	assert.Empty(t, w.cleanupWAL())
+	fnames, err := fileutil.ReadDir(fileutil.DefaultFS, testRoot)
 	assert.Empty(t, err)
 	assert.Equal(t, 1, len(fnames))
 	pattern := fmt.Sprintf(`%s.broken\.[\d]{8}\.[\d]{6}\.[\d]{1,6}?`, filepath.Base(p))
@@ -125,7 +130,9 @@ func TestOpenAtIndex(t *testing.T) {
 	assert.Empty(t, err)
 	g := filepath.Base(w.tail().Name())
 	assert.Equal(t, walName(0, 0), g)
-	assert.Equal(t, uint64(0), w.seq())
+	seq, err := w.seq()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(0), seq)
 	err = w.Close()
 	assert.Empty(t, err)
 
@@ -138,7 +145,9 @@ func TestOpenAtIndex(t *testing.T) {
 	assert.Empty(t, err)
 	g = filepath.Base(w.tail().Name())
 	assert.Equal(t, wname, g)
-	assert.Equal(t, uint64(2), w.seq())
+	seq, err = w.seq()
+	assert.Empty(t, err)
+	assert.Equal(t, uint64(2), seq)
 	w.Close()
 
 	emptydir, err := ioutil.TempDir(os.TempDir(), "waltestempty")
@@ -164,7 +173,7 @@ func TestVerify(t *testing.T) {
 	// make 5 separate files
 	for i := 0; i < 5; i++ {
 		ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i), Data: []byte(fmt.Sprintf("waldata%d", i+1))}}
-		err = w.Save(ents)
+		err = w.Save(nil, ents)
 		assert.Empty(t, err)
 		err = w.cut()
 		assert.Empty(t, err)
@@ -202,7 +211,7 @@ func TestCut(t *testing.T) {
 	assert.Equal(t, wname, g)
 
 	ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 1, Data: []byte{1}}}
-	err = w.Save(ents)
+	err = w.Save(nil, ents)
 	assert.Empty(t, err)
 	err = w.cut()
 	assert.Empty(t, err)
@@ -220,7 +229,8 @@ func TestCut(t *testing.T) {
 	assert.Empty(t, err)
 	defer f.Close()
 	nw := &WAL{
-		decoder: newDecoder(f),
+		opts:    newOptions(nil),
+		decoder: newDecoder(newOptions(nil), f),
 		start:   &snap,
 	}
 	_, _, _, err = nw.ReadAll()
@@ -232,9 +242,6 @@ func TestSaveWithCut(t *testing.T) {
 	assert.Empty(t, err)
 	defer os.RemoveAll(p)
 
-	w, err := Create(p, []byte("metadata"))
-	assert.Empty(t, err)
-
 	bigData := make([]byte, 500)
 	strdata := "Hello World!!!"
 	copy(bigData, strdata)
@@ -243,10 +250,13 @@ func TestSaveWithCut(t *testing.T) {
 	const EntrySize int = 500
 	SegmentSizeBytes = 2 * 1024
 	defer func() { SegmentSizeBytes = restoreLater }()
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
 	index := uint64(0)
 	for totalSize := 0; totalSize < int(SegmentSizeBytes); totalSize += EntrySize {
 		ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: index, Data: bigData}}
-		err = w.Save(ents)
+		err = w.Save(nil, ents)
 		assert.Empty(t, err)
 		index++
 	}
@@ -269,6 +279,50 @@ func TestSaveWithCut(t *testing.T) {
 	}
 }
 
+func TestSaveWithCutOption(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	const segmentSizeBytes = 2 * 1024
+	w, err := Create(p, []byte("metadata"), WithSegmentSizeBytes(segmentSizeBytes))
+	assert.Empty(t, err)
+
+	// the global default must not leak into a WAL created with options
+	assert.Equal(t, int64(64*1000*1000), SegmentSizeBytes)
+
+	bigData := make([]byte, 500)
+	index := uint64(0)
+	for totalSize := 0; totalSize < segmentSizeBytes; totalSize += len(bigData) {
+		ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: index, Data: bigData}}
+		err = w.Save(nil, ents)
+		assert.Empty(t, err)
+		index++
+	}
+	w.Close()
+
+	neww, err := Open(p, &walpb.Snapshot{}, WithSegmentSizeBytes(segmentSizeBytes))
+	assert.Empty(t, err)
+	defer neww.Close()
+	assert.Equal(t, walName(1, index), filepath.Base(neww.tail().Name()))
+	_, _, ents, err := neww.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, segmentSizeBytes/len(bigData), len(ents))
+}
+
+func TestInvalidOptions(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	_, err = Create(p, nil, WithPageBytes(1000))
+	assert.NotEmpty(t, err)
+	_, err = Create(p, nil, WithSegmentSizeBytes(0))
+	assert.NotEmpty(t, err)
+	_, err = Create(p, nil, WithMaxRecordBytes(-1))
+	assert.NotEmpty(t, err)
+}
+
 func TestRecover(t *testing.T) {
 	p, err := ioutil.TempDir(os.TempDir(), "waltest")
 	assert.Empty(t, err)
@@ -282,17 +336,23 @@ func TestRecover(t *testing.T) {
 		{Type: walpb.RecordType_EntryType, Index: 1, Data: []byte{1}},
 		{Type: walpb.RecordType_EntryType, Index: 2, Data: []byte{2}},
 	}
-	err = w.Save(ents)
+	err = w.Save(nil, ents)
 	assert.Empty(t, err)
+	sts := []*walpb.HardState{{Term: 1, Vote: 1, Commit: 1}, {Term: 2, Vote: 2, Commit: 2}}
+	for _, st := range sts {
+		err = w.Save(st, nil)
+		assert.Empty(t, err)
+	}
 	w.Close()
 
 	w, err = Open(p, &walpb.Snapshot{})
 	assert.Empty(t, err)
-	metadata, entries, recoveredEnts, err := w.ReadAll()
+	metadata, state, recoveredEnts, err := w.ReadAll()
 	assert.Empty(t, err)
 
 	assert.Equal(t, []byte("metadata"), metadata)
-	assert.Equal(t, uint64(2), entries)
+	assert.Equal(t, 2, len(recoveredEnts))
+	assert.True(t, proto.Equal(sts[len(sts)-1], state))
 	for i := 0; i < 2; i++ {
 		assert.Equal(t, ents[i].GetIndex(), recoveredEnts[i].GetIndex())
 		assert.Equal(t, ents[i].GetData(), recoveredEnts[i].GetData())
@@ -300,6 +360,119 @@ func TestRecover(t *testing.T) {
 	w.Close()
 }
 
+func TestRecoverOverwriteWithHigherTerm(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	ents := []walpb.Entry{
+		{Type: walpb.RecordType_EntryType, Index: 1, Term: 1, Data: []byte{1}},
+		{Type: walpb.RecordType_EntryType, Index: 2, Term: 1, Data: []byte{2}},
+		{Type: walpb.RecordType_EntryType, Index: 3, Term: 1, Data: []byte{3}},
+	}
+	err = w.Save(nil, ents)
+	assert.Empty(t, err)
+	// a new leader rewrites the log from index 2
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 2, Term: 2, Data: []byte{22}}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, recoveredEnts, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(recoveredEnts))
+	assert.Equal(t, uint64(2), recoveredEnts[1].GetTerm())
+	assert.Equal(t, []byte{22}, recoveredEnts[1].GetData())
+	assert.Equal(t, uint64(2), w.ReplacedEntries())
+}
+
+func TestRecoverOverwriteWithoutHigherTerm(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	ents := []walpb.Entry{
+		{Type: walpb.RecordType_EntryType, Index: 1, Term: 2, Data: []byte{1}},
+		{Type: walpb.RecordType_EntryType, Index: 2, Term: 2, Data: []byte{2}},
+	}
+	err = w.Save(nil, ents)
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 2, Term: 2, Data: []byte{22}}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, _, err = w.ReadAll()
+	assert.True(t, errors.Is(err, ErrEntryTermConflict))
+	var terr *TermConflictError
+	assert.True(t, errors.As(err, &terr))
+	assert.Equal(t, &TermConflictError{Index: 2, Term: 2, PrevTerm: 2}, terr)
+}
+
+func TestRecoverOverwriteLegacyTerm(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	// entries written before terms were recorded
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	ents := []walpb.Entry{
+		{Type: walpb.RecordType_EntryType, Index: 1, Data: []byte{1}},
+		{Type: walpb.RecordType_EntryType, Index: 2, Data: []byte{2}},
+		{Type: walpb.RecordType_EntryType, Index: 3, Data: []byte{3}},
+	}
+	err = w.Save(nil, ents)
+	assert.Empty(t, err)
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 2, Data: []byte{22}}})
+	assert.Empty(t, err)
+	w.Close()
+
+	w, err = Open(p, &walpb.Snapshot{})
+	assert.Empty(t, err)
+	defer w.Close()
+	_, _, recoveredEnts, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 2, len(recoveredEnts))
+	assert.Equal(t, []byte{22}, recoveredEnts[1].GetData())
+	assert.Equal(t, uint64(2), w.ReplacedEntries())
+}
+
+func TestRecoverStateAfterCut(t *testing.T) {
+	p, err := ioutil.TempDir(os.TempDir(), "waltest")
+	assert.Empty(t, err)
+	defer os.RemoveAll(p)
+
+	w, err := Create(p, []byte("metadata"))
+	assert.Empty(t, err)
+	st := &walpb.HardState{Term: 3, Vote: 1, Commit: 1}
+	err = w.Save(st, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 1, Term: 3}})
+	assert.Empty(t, err)
+	err = w.cut()
+	assert.Empty(t, err)
+	err = w.SaveSnapshot(&walpb.Snapshot{Index: 2, Term: 3})
+	assert.Empty(t, err)
+	w.Close()
+
+	// the state is carried over to the new segment by cut
+	w, err = Open(p, &walpb.Snapshot{Index: 2, Term: 3})
+	assert.Empty(t, err)
+	assert.Equal(t, walName(1, 2), filepath.Base(w.tail().Name()))
+	defer w.Close()
+	_, state, ents, err := w.ReadAll()
+	assert.Empty(t, err)
+	assert.Equal(t, 0, len(ents))
+	assert.True(t, proto.Equal(st, state))
+}
+
 func TestSearchIndex(t *testing.T) {
 	tests := []struct {
 		names []string
@@ -333,7 +506,8 @@ func TestSearchIndex(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		idx, ok := searchIndex(tt.names, tt.index)
+		idx, ok, err := searchIndex(tt.names, tt.index)
+		assert.Empty(t, err)
 		assert.Equal(t, tt.widx, idx)
 		assert.Equal(t, tt.wok, ok)
 	}
@@ -369,7 +543,7 @@ func TestRecoverAfterCut(t *testing.T) {
 		err = md.SaveSnapshot(&walpb.Snapshot{Index: uint64(i)})
 		assert.Empty(t, err)
 		ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i)}}
-		err = md.Save(ents)
+		err = md.Save(nil, ents)
 		assert.Empty(t, err)
 		err = md.cut()
 		assert.Empty(t, err)
@@ -407,7 +581,7 @@ func TestOpenAtUncommittedIndex(t *testing.T) {
 	assert.Empty(t, err)
 	err = w.SaveSnapshot(&walpb.Snapshot{})
 	assert.Empty(t, err)
-	err = w.Save([]walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 0}})
+	err = w.Save(nil, []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: 0}})
 	assert.Empty(t, err)
 	w.Close()
 
@@ -434,7 +608,7 @@ func TestOpenForRead(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		ents := []walpb.Entry{{Type: walpb.RecordType_EntryType, Index: uint64(i)}}
-		err = w.Save(ents)
+		err = w.Save(nil, ents)
 		assert.Empty(t, err)
 		err = w.cut()
 		assert.Empty(t, err)
@@ -20,7 +20,7 @@ var (
 	ErrCRCMismatch = errors.New("walpb: crc mismatch")
 )
 
-func (rec *Record) Validate(crc uint32) error {
+func (rec *Record) Validate(crc uint64) error {
 	if rec.GetCrc() == crc {
 		return nil
 	}
@@ -32,6 +32,8 @@ const (
 	RecordType_EntryType    RecordType = 1
 	RecordType_CrcType      RecordType = 2
 	RecordType_SnapshotType RecordType = 3
+	RecordType_StateType    RecordType = 4
+	RecordType_HeaderType   RecordType = 5
 )
 
 // Enum value maps for RecordType.
@@ -41,12 +43,16 @@ var (
 		1: "EntryType",
 		2: "CrcType",
 		3: "SnapshotType",
+		4: "StateType",
+		5: "HeaderType",
 	}
 	RecordType_value = map[string]int32{
 		"MetadataType": 0,
 		"EntryType":    1,
 		"CrcType":      2,
 		"SnapshotType": 3,
+		"StateType":    4,
+		"HeaderType":   5,
 	}
 )
 
@@ -77,14 +83,115 @@ func (RecordType) EnumDescriptor() ([]byte, []int) {
 	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{0}
 }
 
+type FragmentType int32
+
+const (
+	FragmentType_NoFragment     FragmentType = 0
+	FragmentType_FirstFragment  FragmentType = 1
+	FragmentType_MiddleFragment FragmentType = 2
+	FragmentType_LastFragment   FragmentType = 3
+)
+
+// Enum value maps for FragmentType.
+var (
+	FragmentType_name = map[int32]string{
+		0: "NoFragment",
+		1: "FirstFragment",
+		2: "MiddleFragment",
+		3: "LastFragment",
+	}
+	FragmentType_value = map[string]int32{
+		"NoFragment":     0,
+		"FirstFragment":  1,
+		"MiddleFragment": 2,
+		"LastFragment":   3,
+	}
+)
+
+func (x FragmentType) Enum() *FragmentType {
+	p := new(FragmentType)
+	*p = x
+	return p
+}
+
+func (x FragmentType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (FragmentType) Descriptor() protoreflect.EnumDescriptor {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes[1].Descriptor()
+}
+
+func (FragmentType) Type() protoreflect.EnumType {
+	return &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes[1]
+}
+
+func (x FragmentType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use FragmentType.Descriptor instead.
+func (FragmentType) EnumDescriptor() ([]byte, []int) {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{1}
+}
+
+type ChecksumType int32
+
+const (
+	ChecksumType_CRC32C     ChecksumType = 0
+	ChecksumType_CRC64_ECMA ChecksumType = 1
+)
+
+// Enum value maps for ChecksumType.
+var (
+	ChecksumType_name = map[int32]string{
+		0: "CRC32C",
+		1: "CRC64_ECMA",
+	}
+	ChecksumType_value = map[string]int32{
+		"CRC32C":     0,
+		"CRC64_ECMA": 1,
+	}
+)
+
+func (x ChecksumType) Enum() *ChecksumType {
+	p := new(ChecksumType)
+	*p = x
+	return p
+}
+
+func (x ChecksumType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ChecksumType) Descriptor() protoreflect.EnumDescriptor {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes[2].Descriptor()
+}
+
+func (ChecksumType) Type() protoreflect.EnumType {
+	return &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes[2]
+}
+
+func (x ChecksumType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ChecksumType.Descriptor instead.
+func (ChecksumType) EnumDescriptor() ([]byte, []int) {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{2}
+}
+
 type Record struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Type RecordType `protobuf:"varint,1,opt,name=type,proto3,enum=walpb.RecordType" json:"type,omitempty"`
-	Crc  uint32     `protobuf:"varint,2,opt,name=crc,proto3" json:"crc,omitempty"`
-	Data []byte     `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Type     RecordType   `protobuf:"varint,1,opt,name=type,proto3,enum=walpb.RecordType" json:"type,omitempty"`
+	Crc      uint64       `protobuf:"varint,2,opt,name=crc,proto3" json:"crc,omitempty"` // chained checksum, as wide as the checksum of the segment
+	Data     []byte       `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	Codec    uint32       `protobuf:"varint,4,opt,name=codec,proto3" json:"codec,omitempty"`                               // codec the data is compressed with, 0 if stored raw
+	KeyId    string       `protobuf:"bytes,5,opt,name=key_id,json=keyId,proto3" json:"key_id,omitempty"`                   // key the data is encrypted with, empty if stored in clear
+	Fragment FragmentType `protobuf:"varint,6,opt,name=fragment,proto3,enum=walpb.FragmentType" json:"fragment,omitempty"` // part of a record split for its size
 }
 
 func (x *Record) Reset() {
@@ -126,7 +233,7 @@ func (x *Record) GetType() RecordType {
 	return RecordType_MetadataType
 }
 
-func (x *Record) GetCrc() uint32 {
+func (x *Record) GetCrc() uint64 {
 	if x != nil {
 		return x.Crc
 	}
@@ -140,6 +247,116 @@ func (x *Record) GetData() []byte {
 	return nil
 }
 
+func (x *Record) GetCodec() uint32 {
+	if x != nil {
+		return x.Codec
+	}
+	return 0
+}
+
+func (x *Record) GetKeyId() string {
+	if x != nil {
+		return x.KeyId
+	}
+	return ""
+}
+
+func (x *Record) GetFragment() FragmentType {
+	if x != nil {
+		return x.Fragment
+	}
+	return FragmentType_NoFragment
+}
+
+// SegmentHeader follows the crc record at the start of a segment and tells
+// how the segment was written. Segments without one are of format version 0.
+type SegmentHeader struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	FormatVersion    uint32       `protobuf:"varint,1,opt,name=format_version,json=formatVersion,proto3" json:"format_version,omitempty"`
+	Checksum         ChecksumType `protobuf:"varint,2,opt,name=checksum,proto3,enum=walpb.ChecksumType" json:"checksum,omitempty"`                 // checksum of the crc chain
+	PageBytes        uint32       `protobuf:"varint,3,opt,name=page_bytes,json=pageBytes,proto3" json:"page_bytes,omitempty"`                      // alignment the records were flushed with
+	RequiredFeatures uint64       `protobuf:"varint,4,opt,name=required_features,json=requiredFeatures,proto3" json:"required_features,omitempty"` // features a reader must understand
+	OptionalFeatures uint64       `protobuf:"varint,5,opt,name=optional_features,json=optionalFeatures,proto3" json:"optional_features,omitempty"` // features a reader may ignore
+	WriterVersion    string       `protobuf:"bytes,6,opt,name=writer_version,json=writerVersion,proto3" json:"writer_version,omitempty"`
+}
+
+func (x *SegmentHeader) Reset() {
+	*x = SegmentHeader{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *SegmentHeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SegmentHeader) ProtoMessage() {}
+
+func (x *SegmentHeader) ProtoReflect() protoreflect.Message {
+	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SegmentHeader.ProtoReflect.Descriptor instead.
+func (*SegmentHeader) Descriptor() ([]byte, []int) {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *SegmentHeader) GetFormatVersion() uint32 {
+	if x != nil {
+		return x.FormatVersion
+	}
+	return 0
+}
+
+func (x *SegmentHeader) GetChecksum() ChecksumType {
+	if x != nil {
+		return x.Checksum
+	}
+	return ChecksumType_CRC32C
+}
+
+func (x *SegmentHeader) GetPageBytes() uint32 {
+	if x != nil {
+		return x.PageBytes
+	}
+	return 0
+}
+
+func (x *SegmentHeader) GetRequiredFeatures() uint64 {
+	if x != nil {
+		return x.RequiredFeatures
+	}
+	return 0
+}
+
+func (x *SegmentHeader) GetOptionalFeatures() uint64 {
+	if x != nil {
+		return x.OptionalFeatures
+	}
+	return 0
+}
+
+func (x *SegmentHeader) GetWriterVersion() string {
+	if x != nil {
+		return x.WriterVersion
+	}
+	return ""
+}
+
 type Snapshot struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -152,7 +369,7 @@ type Snapshot struct {
 func (x *Snapshot) Reset() {
 	*x = Snapshot{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[1]
+		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[2]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -165,7 +382,7 @@ func (x *Snapshot) String() string {
 func (*Snapshot) ProtoMessage() {}
 
 func (x *Snapshot) ProtoReflect() protoreflect.Message {
-	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[1]
+	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[2]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -178,7 +395,7 @@ func (x *Snapshot) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Snapshot.ProtoReflect.Descriptor instead.
 func (*Snapshot) Descriptor() ([]byte, []int) {
-	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{1}
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{2}
 }
 
 func (x *Snapshot) GetIndex() uint64 {
@@ -195,6 +412,69 @@ func (x *Snapshot) GetTerm() uint64 {
 	return 0
 }
 
+type HardState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Term   uint64 `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	Vote   uint64 `protobuf:"varint,2,opt,name=vote,proto3" json:"vote,omitempty"`
+	Commit uint64 `protobuf:"varint,3,opt,name=commit,proto3" json:"commit,omitempty"`
+}
+
+func (x *HardState) Reset() {
+	*x = HardState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HardState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HardState) ProtoMessage() {}
+
+func (x *HardState) ProtoReflect() protoreflect.Message {
+	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HardState.ProtoReflect.Descriptor instead.
+func (*HardState) Descriptor() ([]byte, []int) {
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *HardState) GetTerm() uint64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *HardState) GetVote() uint64 {
+	if x != nil {
+		return x.Vote
+	}
+	return 0
+}
+
+func (x *HardState) GetCommit() uint64 {
+	if x != nil {
+		return x.Commit
+	}
+	return 0
+}
+
 type Entry struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -203,12 +483,13 @@ type Entry struct {
 	Type  RecordType `protobuf:"varint,1,opt,name=Type,proto3,enum=walpb.RecordType" json:"Type,omitempty"`
 	Index uint64     `protobuf:"varint,2,opt,name=Index,proto3" json:"Index,omitempty"` // must be 64-bit aligned for atomic operations
 	Data  []byte     `protobuf:"bytes,3,opt,name=Data,proto3" json:"Data,omitempty"`
+	Term  uint64     `protobuf:"varint,4,opt,name=Term,proto3" json:"Term,omitempty"`
 }
 
 func (x *Entry) Reset() {
 	*x = Entry{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[2]
+		mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[4]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -221,7 +502,7 @@ func (x *Entry) String() string {
 func (*Entry) ProtoMessage() {}
 
 func (x *Entry) ProtoReflect() protoreflect.Message {
-	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[2]
+	mi := &file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[4]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -234,7 +515,7 @@ func (x *Entry) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Entry.ProtoReflect.Descriptor instead.
 func (*Entry) Descriptor() ([]byte, []int) {
-	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{2}
+	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Entry) GetType() RecordType {
@@ -258,6 +539,13 @@ func (x *Entry) GetData() []byte {
 	return nil
 }
 
+func (x *Entry) GetTerm() uint64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
 var File_github_com_amazingchow_photon_dance_wal_walpb_record_proto protoreflect.FileDescriptor
 
 var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDesc = []byte{
@@ -265,30 +553,68 @@ var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDesc = []
 	0x7a, 0x69, 0x6e, 0x67, 0x63, 0x68, 0x6f, 0x77, 0x2f, 0x70, 0x68, 0x6f, 0x74, 0x6f, 0x6e, 0x2d,
 	0x64, 0x61, 0x6e, 0x63, 0x65, 0x2d, 0x77, 0x61, 0x6c, 0x2f, 0x77, 0x61, 0x6c, 0x70, 0x62, 0x2f,
 	0x72, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x77, 0x61,
-	0x6c, 0x70, 0x62, 0x22, 0x55, 0x0a, 0x06, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x25, 0x0a,
-	0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x77, 0x61,
-	0x6c, 0x70, 0x62, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04,
-	0x74, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x63, 0x72, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0d, 0x52, 0x03, 0x63, 0x72, 0x63, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x22, 0x34, 0x0a, 0x08, 0x53, 0x6e,
-	0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18,
-	0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04,
-	0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d,
-	0x22, 0x58, 0x0a, 0x05, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x25, 0x0a, 0x04, 0x54, 0x79, 0x70,
-	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x77, 0x61, 0x6c, 0x70, 0x62, 0x2e,
-	0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x54, 0x79, 0x70, 0x65,
-	0x12, 0x14, 0x0a, 0x05, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52,
-	0x05, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04, 0x44, 0x61, 0x74, 0x61, 0x18, 0x03,
-	0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x44, 0x61, 0x74, 0x61, 0x2a, 0x4c, 0x0a, 0x0a, 0x52, 0x65,
-	0x63, 0x6f, 0x72, 0x64, 0x54, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x65, 0x74, 0x61,
-	0x64, 0x61, 0x74, 0x61, 0x54, 0x79, 0x70, 0x65, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x45, 0x6e,
-	0x74, 0x72, 0x79, 0x54, 0x79, 0x70, 0x65, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x72, 0x63,
-	0x54, 0x79, 0x70, 0x65, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68,
-	0x6f, 0x74, 0x54, 0x79, 0x70, 0x65, 0x10, 0x03, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68,
-	0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x61, 0x6d, 0x61, 0x7a, 0x69, 0x6e, 0x67, 0x63, 0x68,
-	0x6f, 0x77, 0x2f, 0x70, 0x68, 0x6f, 0x74, 0x6f, 0x6e, 0x2d, 0x64, 0x61, 0x6e, 0x63, 0x65, 0x2d,
-	0x77, 0x61, 0x6c, 0x2f, 0x77, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f,
-	0x33,
+	0x6c, 0x70, 0x62, 0x22, 0xb3, 0x01, 0x0a, 0x06, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x12, 0x25,
+	0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x77,
+	0x61, 0x6c, 0x70, 0x62, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x63, 0x72, 0x63, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x04, 0x52, 0x03, 0x63, 0x72, 0x63, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x14, 0x0a, 0x05, 0x63,
+	0x6f, 0x64, 0x65, 0x63, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x63, 0x6f, 0x64, 0x65,
+	0x63, 0x12, 0x15, 0x0a, 0x06, 0x6b, 0x65, 0x79, 0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x6b, 0x65, 0x79, 0x49, 0x64, 0x12, 0x2f, 0x0a, 0x08, 0x66, 0x72, 0x61, 0x67,
+	0x6d, 0x65, 0x6e, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x77, 0x61, 0x6c,
+	0x70, 0x62, 0x2e, 0x46, 0x72, 0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x52,
+	0x08, 0x66, 0x72, 0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x22, 0x87, 0x02, 0x0a, 0x0d, 0x53, 0x65,
+	0x67, 0x6d, 0x65, 0x6e, 0x74, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x25, 0x0a, 0x0e, 0x66,
+	0x6f, 0x72, 0x6d, 0x61, 0x74, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x0d, 0x66, 0x6f, 0x72, 0x6d, 0x61, 0x74, 0x56, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x12, 0x2f, 0x0a, 0x08, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x13, 0x2e, 0x77, 0x61, 0x6c, 0x70, 0x62, 0x2e, 0x43, 0x68, 0x65,
+	0x63, 0x6b, 0x73, 0x75, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x52, 0x08, 0x63, 0x68, 0x65, 0x63, 0x6b,
+	0x73, 0x75, 0x6d, 0x12, 0x1d, 0x0a, 0x0a, 0x70, 0x61, 0x67, 0x65, 0x5f, 0x62, 0x79, 0x74, 0x65,
+	0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x09, 0x70, 0x61, 0x67, 0x65, 0x42, 0x79, 0x74,
+	0x65, 0x73, 0x12, 0x2b, 0x0a, 0x11, 0x72, 0x65, 0x71, 0x75, 0x69, 0x72, 0x65, 0x64, 0x5f, 0x66,
+	0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x10, 0x72,
+	0x65, 0x71, 0x75, 0x69, 0x72, 0x65, 0x64, 0x46, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x12,
+	0x2b, 0x0a, 0x11, 0x6f, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x61, 0x6c, 0x5f, 0x66, 0x65, 0x61, 0x74,
+	0x75, 0x72, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x04, 0x52, 0x10, 0x6f, 0x70, 0x74, 0x69,
+	0x6f, 0x6e, 0x61, 0x6c, 0x46, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x0e,
+	0x77, 0x72, 0x69, 0x74, 0x65, 0x72, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x06,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x77, 0x72, 0x69, 0x74, 0x65, 0x72, 0x56, 0x65, 0x72, 0x73,
+	0x69, 0x6f, 0x6e, 0x22, 0x34, 0x0a, 0x08, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x12,
+	0x14, 0x0a, 0x05, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05,
+	0x69, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x02, 0x20,
+	0x01, 0x28, 0x04, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x22, 0x4b, 0x0a, 0x09, 0x48, 0x61, 0x72,
+	0x64, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x74, 0x65, 0x72, 0x6d, 0x12, 0x12, 0x0a, 0x04, 0x76, 0x6f,
+	0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04, 0x76, 0x6f, 0x74, 0x65, 0x12, 0x16,
+	0x0a, 0x06, 0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x04, 0x52, 0x06,
+	0x63, 0x6f, 0x6d, 0x6d, 0x69, 0x74, 0x22, 0x6c, 0x0a, 0x05, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12,
+	0x25, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e,
+	0x77, 0x61, 0x6c, 0x70, 0x62, 0x2e, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x54, 0x79, 0x70, 0x65,
+	0x52, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x04, 0x52, 0x05, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x12, 0x0a, 0x04,
+	0x44, 0x61, 0x74, 0x61, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x44, 0x61, 0x74, 0x61,
+	0x12, 0x12, 0x0a, 0x04, 0x54, 0x65, 0x72, 0x6d, 0x18, 0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x04,
+	0x54, 0x65, 0x72, 0x6d, 0x2a, 0x6b, 0x0a, 0x0a, 0x52, 0x65, 0x63, 0x6f, 0x72, 0x64, 0x54, 0x79,
+	0x70, 0x65, 0x12, 0x10, 0x0a, 0x0c, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x54, 0x79,
+	0x70, 0x65, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x54, 0x79, 0x70,
+	0x65, 0x10, 0x01, 0x12, 0x0b, 0x0a, 0x07, 0x43, 0x72, 0x63, 0x54, 0x79, 0x70, 0x65, 0x10, 0x02,
+	0x12, 0x10, 0x0a, 0x0c, 0x53, 0x6e, 0x61, 0x70, 0x73, 0x68, 0x6f, 0x74, 0x54, 0x79, 0x70, 0x65,
+	0x10, 0x03, 0x12, 0x0d, 0x0a, 0x09, 0x53, 0x74, 0x61, 0x74, 0x65, 0x54, 0x79, 0x70, 0x65, 0x10,
+	0x04, 0x12, 0x0e, 0x0a, 0x0a, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x54, 0x79, 0x70, 0x65, 0x10,
+	0x05, 0x2a, 0x57, 0x0a, 0x0c, 0x46, 0x72, 0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70,
+	0x65, 0x12, 0x0e, 0x0a, 0x0a, 0x4e, 0x6f, 0x46, 0x72, 0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x10,
+	0x00, 0x12, 0x11, 0x0a, 0x0d, 0x46, 0x69, 0x72, 0x73, 0x74, 0x46, 0x72, 0x61, 0x67, 0x6d, 0x65,
+	0x6e, 0x74, 0x10, 0x01, 0x12, 0x12, 0x0a, 0x0e, 0x4d, 0x69, 0x64, 0x64, 0x6c, 0x65, 0x46, 0x72,
+	0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x10, 0x02, 0x12, 0x10, 0x0a, 0x0c, 0x4c, 0x61, 0x73, 0x74,
+	0x46, 0x72, 0x61, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x10, 0x03, 0x2a, 0x2a, 0x0a, 0x0c, 0x43, 0x68,
+	0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0a, 0x0a, 0x06, 0x43, 0x52,
+	0x43, 0x33, 0x32, 0x43, 0x10, 0x00, 0x12, 0x0e, 0x0a, 0x0a, 0x43, 0x52, 0x43, 0x36, 0x34, 0x5f,
+	0x45, 0x43, 0x4d, 0x41, 0x10, 0x01, 0x42, 0x2f, 0x5a, 0x2d, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62,
+	0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x61, 0x6d, 0x61, 0x7a, 0x69, 0x6e, 0x67, 0x63, 0x68, 0x6f, 0x77,
+	0x2f, 0x70, 0x68, 0x6f, 0x74, 0x6f, 0x6e, 0x2d, 0x64, 0x61, 0x6e, 0x63, 0x65, 0x2d, 0x77, 0x61,
+	0x6c, 0x2f, 0x77, 0x61, 0x6c, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -303,22 +629,28 @@ func file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescGZIP
 	return file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDescData
 }
 
-var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
+var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_goTypes = []interface{}{
-	(RecordType)(0),  // 0: walpb.RecordType
-	(*Record)(nil),   // 1: walpb.Record
-	(*Snapshot)(nil), // 2: walpb.Snapshot
-	(*Entry)(nil),    // 3: walpb.Entry
+	(RecordType)(0),       // 0: walpb.RecordType
+	(FragmentType)(0),     // 1: walpb.FragmentType
+	(ChecksumType)(0),     // 2: walpb.ChecksumType
+	(*Record)(nil),        // 3: walpb.Record
+	(*SegmentHeader)(nil), // 4: walpb.SegmentHeader
+	(*Snapshot)(nil),      // 5: walpb.Snapshot
+	(*HardState)(nil),     // 6: walpb.HardState
+	(*Entry)(nil),         // 7: walpb.Entry
 }
 var file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_depIdxs = []int32{
 	0, // 0: walpb.Record.type:type_name -> walpb.RecordType
-	0, // 1: walpb.Entry.Type:type_name -> walpb.RecordType
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	1, // 1: walpb.Record.fragment:type_name -> walpb.FragmentType
+	2, // 2: walpb.SegmentHeader.checksum:type_name -> walpb.ChecksumType
+	0, // 3: walpb.Entry.Type:type_name -> walpb.RecordType
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_init() }
@@ -340,7 +672,7 @@ func file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_init() {
 			}
 		}
 		file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*Snapshot); i {
+			switch v := v.(*SegmentHeader); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -352,6 +684,30 @@ func file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_init() {
 			}
 		}
 		file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Snapshot); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*HardState); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*Entry); i {
 			case 0:
 				return &v.state
@@ -369,8 +725,8 @@ func file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_github_com_amazingchow_photon_dance_wal_walpb_record_proto_rawDesc,
-			NumEnums:      1,
-			NumMessages:   3,
+			NumEnums:      3,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   0,
 		},